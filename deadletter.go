@@ -0,0 +1,108 @@
+package nazuna
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/callummance/nazuna/messages"
+)
+
+//DeadLetter describes a notification which a handler still failed to process after all of its retries
+type DeadLetter struct {
+	Message messages.EventNotificationMessage `json:"message"`
+	//Handler is the name of the handler which failed, as given in HandlerOpts
+	Handler string `json:"handler"`
+	//Err is the error returned by the final attempt, which is also stored as a string in Error
+	Err      error     `json:"-"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+//DeadLetterSink stores notifications which could not be handled so they can be inspected or replayed later
+type DeadLetterSink interface {
+	Put(letter DeadLetter) error
+}
+
+//DeadLetterFunc adapts a function into a DeadLetterSink
+type DeadLetterFunc func(letter DeadLetter) error
+
+//Put passes the dead letter on to the function
+func (f DeadLetterFunc) Put(letter DeadLetter) error {
+	return f(letter)
+}
+
+//FileDeadLetterStore is a DeadLetterSink which appends dead letters to a file as lines of JSON
+type FileDeadLetterStore struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+//OpenFileDeadLetterStore opens the store kept at path, creating the file if it does not already exist
+func OpenFileDeadLetterStore(path string) (*FileDeadLetterStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterStore{
+		path: path,
+		file: file,
+	}, nil
+}
+
+//Put appends a dead letter to the file
+func (s *FileDeadLetterStore) Put(letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+//ReadAll returns every dead letter which has been stored. The Err field of each will be nil, with the error
+//available only as a string.
+func (s *FileDeadLetterStore) ReadAll() ([]DeadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		var raw struct {
+			DeadLetter
+			Message json.RawMessage `json:"message"`
+		}
+		err := json.Unmarshal(scanner.Bytes(), &raw)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := messages.DecodeNotification(raw.Message, "")
+		if err != nil {
+			return nil, err
+		}
+		letter := raw.DeadLetter
+		letter.Message = *msg
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
+
+//Close closes the underlying file
+func (s *FileDeadLetterStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,193 @@
+package dedup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//minCompactionEntries is the minimum number of lines the file may contain before it is compacted
+const minCompactionEntries = 1024
+
+//FileStore is a Store which appends message IDs to a file so that they are remembered across restarts.
+//The file is rewritten without expired entries whenever it has doubled in length since it was last compacted.
+//It should only be used by a single process at a time.
+type FileStore struct {
+	lock      sync.Mutex
+	path      string
+	file      *os.File
+	expiry    map[string]time.Time
+	written   int
+	compactAt int
+}
+
+//OpenFileStore opens the store kept at path, creating the file if it does not already exist
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:   path,
+		expiry: make(map[string]time.Time),
+	}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.scheduleCompaction()
+	s.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//load reads all unexpired entries from the file into memory
+func (s *FileStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		s.written++
+		id, expiry, err := parseEntry(scanner.Text())
+		if err != nil {
+			//Most likely a partially written final line, so skip it
+			continue
+		}
+		if expiry.After(now) {
+			s.expiry[id] = expiry
+		} else {
+			//Later entries replace earlier ones, including those written by Unmark
+			delete(s.expiry, id)
+		}
+	}
+	return scanner.Err()
+}
+
+func parseEntry(line string) (string, time.Time, error) {
+	sep := strings.LastIndexByte(line, ' ')
+	if sep < 0 {
+		return "", time.Time{}, fmt.Errorf("malformed entry %q", line)
+	}
+	expiry, err := strconv.ParseInt(line[sep+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("malformed entry %q: %v", line, err)
+	}
+	return line[:sep], time.Unix(expiry, 0), nil
+}
+
+//Seen reports whether the message with the given ID has been marked and has not yet expired
+func (s *FileStore) Seen(id string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expiry, ok := s.expiry[id]
+	return ok && expiry.After(time.Now()), nil
+}
+
+//Mark records that the message with the given ID has been processed, remembering it for ttl
+func (s *FileStore) Mark(id string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.write(id, time.Now().Add(ttl))
+}
+
+//MarkIfAbsent marks the message with the given ID for ttl unless it is already marked, returning true if it was not
+func (s *FileStore) MarkIfAbsent(id string, ttl time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if expiry, ok := s.expiry[id]; ok && expiry.After(now) {
+		return false, nil
+	}
+	return true, s.write(id, now.Add(ttl))
+}
+
+//Unmark forgets the message with the given ID, recording an entry which has already expired so that it stays
+//forgotten after a restart
+func (s *FileStore) Unmark(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.expiry[id]; !ok {
+		return nil
+	}
+	err := s.write(id, time.Unix(0, 0))
+	delete(s.expiry, id)
+	return err
+}
+
+//write appends an entry to the file and records it in memory, compacting the file if it is due. Must be called with
+//the lock held.
+func (s *FileStore) write(id string, expiry time.Time) error {
+	_, err := fmt.Fprintf(s.file, "%s %d\n", id, expiry.Unix())
+	if err != nil {
+		return err
+	}
+	s.expiry[id] = expiry
+	s.written++
+	if s.written >= s.compactAt {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileStore) scheduleCompaction() {
+	s.compactAt = 2 * len(s.expiry)
+	if s.compactAt < minCompactionEntries {
+		s.compactAt = minCompactionEntries
+	}
+}
+
+//compact rewrites the file to contain only unexpired entries. Must be called with the lock held.
+func (s *FileStore) compact() error {
+	now := time.Now()
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for id, expiry := range s.expiry {
+		if !expiry.After(now) {
+			delete(s.expiry, id)
+			continue
+		}
+		fmt.Fprintf(writer, "%s %d\n", id, expiry.Unix())
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		return err
+	}
+
+	s.file.Close()
+	s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.written = len(s.expiry)
+	s.scheduleCompaction()
+	return nil
+}
+
+//Close closes the underlying file
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
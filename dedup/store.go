@@ -0,0 +1,60 @@
+package dedup
+
+import (
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const memoryStoreCleanup = time.Hour
+
+//Store records the IDs of messages which have already been processed so that redelivered messages can be discarded.
+//Implementations must be safe for concurrent use. A store shared between several replicas (for example one backed by
+//redis) allows duplicate deliveries to be detected no matter which replica recieves them.
+type Store interface {
+	//Seen reports whether the message with the given ID has been marked and has not yet expired
+	Seen(id string) (bool, error)
+	//Mark records that the message with the given ID has been processed, remembering it for at least ttl
+	Mark(id string, ttl time.Duration) error
+	//MarkIfAbsent atomically marks the message with the given ID unless it is already marked, returning true if it was
+	//not. Of several concurrent calls with the same ID, only one returns true.
+	MarkIfAbsent(id string, ttl time.Duration) (bool, error)
+	//Unmark forgets the message with the given ID, such as when it was marked but could not be passed on, so that a
+	//redelivery of it is accepted
+	Unmark(id string) error
+}
+
+//MemoryStore is a Store which keeps message IDs in memory, so they are forgotten when the process exits.
+type MemoryStore struct {
+	cache *cache.Cache
+}
+
+//NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		cache: cache.New(cache.NoExpiration, memoryStoreCleanup),
+	}
+}
+
+//Seen reports whether the message with the given ID has been marked and has not yet expired
+func (s *MemoryStore) Seen(id string) (bool, error) {
+	_, seen := s.cache.Get(id)
+	return seen, nil
+}
+
+//Mark records that the message with the given ID has been processed, remembering it for ttl
+func (s *MemoryStore) Mark(id string, ttl time.Duration) error {
+	s.cache.Set(id, nil, ttl)
+	return nil
+}
+
+//MarkIfAbsent marks the message with the given ID for ttl unless it is already marked, returning true if it was not
+func (s *MemoryStore) MarkIfAbsent(id string, ttl time.Duration) (bool, error) {
+	return s.cache.Add(id, nil, ttl) == nil, nil
+}
+
+//Unmark forgets the message with the given ID
+func (s *MemoryStore) Unmark(id string) error {
+	s.cache.Delete(id)
+	return nil
+}
@@ -0,0 +1,263 @@
+package dedup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemoryStore() })
+}
+
+func TestFileStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		s, err := OpenFileStore(filepath.Join(t.TempDir(), "dedup"))
+		if err != nil {
+			t.Fatalf("OpenFileStore() error = %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+//testStore checks the behaviour every Store must have, using stores created by newStore
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("marking", func(t *testing.T) { testMarking(t, newStore) })
+	t.Run("concurrent claims", func(t *testing.T) { testConcurrentClaims(t, newStore) })
+}
+
+func testMarking(t *testing.T, newStore func(t *testing.T) Store) {
+	type op struct {
+		action string
+		id     string
+		//ttl is also how long a wait lasts
+		ttl time.Duration
+		//want is the result of MarkIfAbsent or Seen
+		want bool
+	}
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{
+			name: "unmarked messages are not seen",
+			ops:  []op{{action: "seen", id: "a", want: false}},
+		},
+		{
+			name: "marked messages are seen",
+			ops: []op{
+				{action: "mark", id: "a", ttl: time.Hour},
+				{action: "seen", id: "a", want: true},
+				{action: "seen", id: "b", want: false},
+			},
+		},
+		{
+			name: "mark if absent only succeeds once",
+			ops: []op{
+				{action: "markIfAbsent", id: "a", ttl: time.Hour, want: true},
+				{action: "markIfAbsent", id: "a", ttl: time.Hour, want: false},
+				{action: "seen", id: "a", want: true},
+			},
+		},
+		{
+			name: "mark if absent fails for marked messages",
+			ops: []op{
+				{action: "mark", id: "a", ttl: time.Hour},
+				{action: "markIfAbsent", id: "a", ttl: time.Hour, want: false},
+			},
+		},
+		{
+			name: "unmarked messages can be claimed again",
+			ops: []op{
+				{action: "markIfAbsent", id: "a", ttl: time.Hour, want: true},
+				{action: "unmark", id: "a"},
+				{action: "seen", id: "a", want: false},
+				{action: "markIfAbsent", id: "a", ttl: time.Hour, want: true},
+			},
+		},
+		{
+			name: "unmarking an unknown message has no effect",
+			ops: []op{
+				{action: "unmark", id: "a"},
+				{action: "seen", id: "a", want: false},
+			},
+		},
+		{
+			name: "expired messages can be claimed again",
+			ops: []op{
+				{action: "mark", id: "a", ttl: 10 * time.Millisecond},
+				{action: "wait", ttl: 20 * time.Millisecond},
+				{action: "seen", id: "a", want: false},
+				{action: "markIfAbsent", id: "a", ttl: time.Hour, want: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			for i, op := range tt.ops {
+				var got bool
+				var err error
+				switch op.action {
+				case "mark":
+					err = s.Mark(op.id, op.ttl)
+				case "markIfAbsent":
+					got, err = s.MarkIfAbsent(op.id, op.ttl)
+				case "unmark":
+					err = s.Unmark(op.id)
+				case "seen":
+					got, err = s.Seen(op.id)
+				case "wait":
+					time.Sleep(op.ttl)
+				}
+				if err != nil {
+					t.Fatalf("op %v: %v(%v) error = %v", i, op.action, op.id, err)
+				}
+				if got != op.want {
+					t.Errorf("op %v: %v(%v) = %v, want %v", i, op.action, op.id, got, op.want)
+				}
+			}
+		})
+	}
+}
+
+func testConcurrentClaims(t *testing.T, newStore func(t *testing.T) Store) {
+	s := newStore(t)
+	var wg sync.WaitGroup
+	var claimed int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first, err := s.MarkIfAbsent("a", time.Hour)
+			if err != nil {
+				t.Errorf("MarkIfAbsent() error = %v", err)
+			}
+			if first {
+				atomic.AddInt32(&claimed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed != 1 {
+		t.Errorf("%v concurrent calls to MarkIfAbsent succeeded, want 1", claimed)
+	}
+}
+
+func TestFileStoreRestart(t *testing.T) {
+	tests := []struct {
+		name   string
+		mark   map[string]time.Duration
+		unmark []string
+		want   map[string]bool
+	}{
+		{
+			name: "unexpired messages are remembered",
+			mark: map[string]time.Duration{"a": time.Hour, "b": time.Hour},
+			want: map[string]bool{"a": true, "b": true, "c": false},
+		},
+		{
+			name: "expired messages are forgotten",
+			mark: map[string]time.Duration{"a": time.Hour, "b": -time.Second},
+			want: map[string]bool{"a": true, "b": false},
+		},
+		{
+			name:   "unmarked messages stay forgotten",
+			mark:   map[string]time.Duration{"a": time.Hour, "b": time.Hour},
+			unmark: []string{"b"},
+			want:   map[string]bool{"a": true, "b": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dedup")
+			s, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			for id, ttl := range tt.mark {
+				if err := s.Mark(id, ttl); err != nil {
+					t.Fatalf("Mark(%v) error = %v", id, err)
+				}
+			}
+			for _, id := range tt.unmark {
+				if err := s.Unmark(id); err != nil {
+					t.Fatalf("Unmark(%v) error = %v", id, err)
+				}
+			}
+			s.Close()
+
+			reopened, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatalf("OpenFileStore() after restart error = %v", err)
+			}
+			defer reopened.Close()
+			for id, want := range tt.want {
+				if got, _ := reopened.Seen(id); got != want {
+					t.Errorf("Seen(%v) after restart = %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		expired int
+		live    int
+		//compacted is whether the file should have been rewritten without the expired entries
+		compacted bool
+	}{
+		{name: "below the threshold", expired: 10, live: 10},
+		{name: "past the threshold", expired: minCompactionEntries, live: 10, compacted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dedup")
+			s, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			for i := 0; i < tt.expired; i++ {
+				if err := s.Mark(fmt.Sprint("expired", i), -time.Second); err != nil {
+					t.Fatalf("Mark() error = %v", err)
+				}
+			}
+			for i := 0; i < tt.live; i++ {
+				if err := s.Mark(fmt.Sprint("live", i), time.Hour); err != nil {
+					t.Fatalf("Mark() error = %v", err)
+				}
+			}
+			s.Close()
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read store file: %v", err)
+			}
+			lines := strings.Count(string(data), "\n")
+			if tt.compacted && lines >= tt.expired {
+				t.Errorf("file has %v lines, want expired entries to have been removed", lines)
+			} else if !tt.compacted && lines != tt.expired+tt.live {
+				t.Errorf("file has %v lines, want %v", lines, tt.expired+tt.live)
+			}
+
+			reopened, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatalf("OpenFileStore() after restart error = %v", err)
+			}
+			defer reopened.Close()
+			for i := 0; i < tt.live; i++ {
+				if seen, _ := reopened.Seen(fmt.Sprint("live", i)); !seen {
+					t.Errorf("Seen(live%v) after restart = false, want true", i)
+				}
+			}
+		})
+	}
+}
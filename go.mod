@@ -1,10 +1,20 @@
 module github.com/callummance/nazuna
 
-go 1.15
+go 1.18
 
 require (
 	github.com/google/go-querystring v1.0.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/sirupsen/logrus v1.7.1
 	golang.org/x/oauth2 v0.0.0-20210220000619-9bb904979d93
 )
+
+require (
+	github.com/golang/protobuf v1.4.2 // indirect
+	github.com/magefile/mage v1.10.0 // indirect
+	golang.org/x/net v0.0.0-20200822124328-c89045814202 // indirect
+	golang.org/x/sys v0.0.0-20200803210538-64077c9b5642 // indirect
+	google.golang.org/appengine v1.6.6 // indirect
+	google.golang.org/protobuf v1.25.0 // indirect
+)
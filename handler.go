@@ -0,0 +1,306 @@
+package nazuna
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/messages"
+	"github.com/callummance/nazuna/tracing"
+	"github.com/callummance/nazuna/webhooklistener"
+)
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = time.Minute
+)
+
+//HandlerOpts configures how failures of an individual handler are dealt with. A handler fails if it returns an error
+//or panics.
+type HandlerOpts struct {
+	//Name identifies the handler in logs and dead letters, defaulting to the name of the handler function
+	Name string
+	//MaxRetries is the number of times a failed handler is retried before the notification is dead-lettered. Retries
+	//are run by the dispatch queue's workers once their backoff has passed, and with ordered dispatch later
+	//notifications sharing a key wait until they have finished.
+	MaxRetries int
+	//InitialBackoff is the delay before the first retry, defaulting to one second. It doubles after each retry.
+	InitialBackoff time.Duration
+	//MaxBackoff limits the delay between retries, defaulting to one minute
+	MaxBackoff time.Duration
+	//Timeout limits how long each attempt may run for, after which the context passed to the handler is cancelled.
+	//Defaults to NazunaOpts.HandlerTimeout.
+	Timeout time.Duration
+}
+
+//HandlerError describes a single failed attempt by a handler to process a notification
+type HandlerError struct {
+	Message messages.EventNotificationMessage
+	//Handler is the name of the handler which failed, as given in HandlerOpts
+	Handler string
+	Err     error
+	//Attempt counts the attempts made so far, starting from 1
+	Attempt  int
+	Duration time.Duration
+}
+
+type contextKey int
+
+const messageContextKey contextKey = iota
+
+//MessageFromContext returns the notification being handled, given the context passed to a handler
+func MessageFromContext(ctx context.Context) (*messages.EventNotificationMessage, bool) {
+	msg, ok := ctx.Value(messageContextKey).(*messages.EventNotificationMessage)
+	return msg, ok
+}
+
+type registeredHandler struct {
+	id      uint64
+	handler webhooklistener.WebhookHandler
+	opts    HandlerOpts
+}
+
+//Registration represents a handler which has been registered with an EventsubClient
+type Registration struct {
+	client *EventsubClient
+	id     uint64
+}
+
+//Unregister removes the handler, so that it will not be passed any notifications which have not yet started being dispatched
+func (r *Registration) Unregister() {
+	c := r.client
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	handlers := make([]registeredHandler, 0, len(c.handlers))
+	for _, h := range c.handlers {
+		if h.id != r.id {
+			handlers = append(handlers, h)
+		}
+	}
+	c.handlers = handlers
+}
+
+//On registers a function to handle events of type E, for example:
+//
+//	nazuna.On(client, func(ctx context.Context, sub *messages.Subscription, ev *messages.StreamOnlineEvent) error {...})
+func On[E messages.Event](c *EventsubClient, handler func(context.Context, *messages.Subscription, *E) error) *Registration {
+	return OnWithOpts(c, handler, HandlerOpts{})
+}
+
+//OnWithOpts registers a function to handle events of type E, using opts to decide how its failures are dealt with
+func OnWithOpts[E messages.Event](c *EventsubClient, handler func(context.Context, *messages.Subscription, *E) error, opts HandlerOpts) *Registration {
+	return c.RegisterHandlerWithOpts(webhooklistener.EventHandler[E](handler), opts)
+}
+
+//OnNotification registers a function which will be passed every notification, whatever its event type
+func OnNotification(c *EventsubClient, handler func(context.Context, *messages.EventNotificationMessage) error) *Registration {
+	return c.RegisterHandler(webhooklistener.NotificationHandler(handler))
+}
+
+//handlerName finds the name of the function underlying a handler
+func handlerName(handler interface{}) string {
+	v := reflect.ValueOf(handler)
+	if v.Kind() == reflect.Func {
+		if f := runtime.FuncForPC(v.Pointer()); f != nil {
+			return f.Name()
+		}
+	}
+	return fmt.Sprintf("%T", handler)
+}
+
+//handlerRun tracks the attempts made by one handler to process one notification
+type handlerRun struct {
+	ctx        context.Context
+	handler    registeredHandler
+	message    messages.EventNotificationMessage
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+	//done is called once the handler has succeeded or the notification has been dead-lettered. abandoned is set if the
+	//handler was given up on early because the client is closing.
+	done func(abandoned bool)
+}
+
+//runHandler makes the first attempt at passing a notification to a handler, returning its error. If it fails, retries
+//are scheduled on the dispatch queue with exponential backoff rather than holding up the calling worker, and the
+//notification is dead-lettered once all retries have been used. done is called once the handler has either succeeded
+//or been given up on.
+func (c *EventsubClient) runHandler(ctx context.Context, h registeredHandler, message messages.EventNotificationMessage, done func(abandoned bool)) error {
+	run := &handlerRun{
+		ctx:        ctx,
+		handler:    h,
+		message:    message,
+		backoff:    h.opts.InitialBackoff,
+		maxBackoff: h.opts.MaxBackoff,
+		timeout:    h.opts.Timeout,
+		done:       done,
+	}
+	if run.backoff <= 0 {
+		run.backoff = defaultInitialBackoff
+	}
+	if run.maxBackoff <= 0 {
+		run.maxBackoff = defaultMaxBackoff
+	}
+	if run.timeout <= 0 {
+		run.timeout = c.handlerTimeout
+	}
+	return c.attemptRun(run)
+}
+
+//attemptRun makes the next attempt of a run, scheduling a retry or giving up if it fails
+func (c *EventsubClient) attemptRun(run *handlerRun) error {
+	h := run.handler
+	run.attempts++
+	err := c.attemptHandler(run.ctx, h, run.message, run.attempts, run.timeout)
+	if err == nil {
+		run.done(false)
+		return nil
+	}
+	if run.attempts > h.opts.MaxRetries {
+		c.giveUp(run, err, false)
+		return err
+	}
+
+	backoff := run.backoff
+	run.backoff *= 2
+	if run.backoff > run.maxBackoff {
+		run.backoff = run.maxBackoff
+	}
+	abandon := func() {
+		logging.FromContext(run.ctx).Warnf("Abandoning retries of handler %v for message %v as the client is closing", h.opts.Name, run.message.MessageID)
+		c.giveUp(run, err, true)
+	}
+	retry := func() {
+		select {
+		case <-c.closing:
+			abandon()
+		default:
+			c.attemptRun(run)
+		}
+	}
+	switch c.queue.schedule(backoff, retry, abandon) {
+	case retryScheduled:
+		return err
+	case retryRejected:
+		abandon()
+		return err
+	}
+
+	//Too many retries are already waiting, so this one holds up the worker which made the attempt until its backoff
+	//has passed, which stops more notifications being taken from the queue until retries drain
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		c.attemptRun(run)
+	case <-c.closing:
+		abandon()
+	}
+	return err
+}
+
+//giveUp dead-letters the notification of a run which has failed for the last time
+func (c *EventsubClient) giveUp(run *handlerRun, err error, abandoned bool) {
+	c.deadLetter(DeadLetter{
+		Message:  run.message,
+		Handler:  run.handler.opts.Name,
+		Err:      err,
+		Error:    err.Error(),
+		Attempts: run.attempts,
+		FailedAt: time.Now(),
+	})
+	run.done(abandoned)
+}
+
+//attemptHandler makes a single attempt at passing a notification to a handler, reporting any failure. Handlers are
+//filtered by subscription type before this is called, so no span or metric is recorded for handlers which would
+//ignore the notification.
+func (c *EventsubClient) attemptHandler(ctx context.Context, h registeredHandler, message messages.EventNotificationMessage, attempt int, timeout time.Duration) error {
+	ctx = context.WithValue(ctx, messageContextKey, &message)
+	ctx, span := c.tracer.Start(ctx, "eventsub.handler",
+		tracing.String("eventsub.handler", h.opts.Name),
+		tracing.String("eventsub.message_id", message.MessageID),
+		tracing.String("eventsub.subscription_type", message.Subscription.Type),
+		tracing.Int("eventsub.attempt", attempt),
+	)
+	defer span.End()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := callHandler(ctx, h.handler, message)
+	c.metrics.ObserveHandler(h.opts.Name, time.Since(start), err)
+	if err == nil {
+		return nil
+	}
+	if timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("handler timed out after %v: %w", timeout, err)
+	}
+	span.RecordError(err)
+	logging.FromContext(ctx).WithField(logging.FieldHandler, h.opts.Name).Warnf("Handler %v failed to handle message %v on attempt %v due to error %v", h.opts.Name, message.MessageID, attempt, err)
+
+	c.handlersLock.RLock()
+	handlers := c.handlerErrorHandlers
+	c.handlersLock.RUnlock()
+	handlerErr := HandlerError{
+		Message:  message,
+		Handler:  h.opts.Name,
+		Err:      err,
+		Attempt:  attempt,
+		Duration: time.Since(start),
+	}
+	for _, handler := range handlers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					c.log.Errorf("Handler error callback panicked with %v\n%s", r, debug.Stack())
+				}
+			}()
+			handler(handlerErr)
+		}()
+	}
+	return err
+}
+
+//callHandler passes a notification to a handler, converting any panic into an error
+func callHandler(ctx context.Context, handler webhooklistener.WebhookHandler, message messages.EventNotificationMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked with %v\n%s", r, debug.Stack())
+		}
+	}()
+	return handler.Handle(ctx, message)
+}
+
+//deadLetter passes a failed notification to the dead letter store and callbacks
+func (c *EventsubClient) deadLetter(letter DeadLetter) {
+	c.log.WithFields(logging.MessageFields(&letter.Message)).Errorf("Giving up on handler %v for message %v after %v attempts", letter.Handler, letter.Message.MessageID, letter.Attempts)
+	if c.deadLetterStore != nil {
+		err := c.deadLetterStore.Put(letter)
+		if err != nil {
+			c.log.WithFields(logging.MessageFields(&letter.Message)).Errorf("Failed to store dead letter for message %v due to error %v", letter.Message.MessageID, err)
+		}
+	}
+
+	c.handlersLock.RLock()
+	handlers := c.deadLetterHandlers
+	c.handlersLock.RUnlock()
+	for _, handler := range handlers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					c.log.Errorf("Dead letter handler panicked with %v\n%s", r, debug.Stack())
+				}
+			}()
+			handler(letter)
+		}()
+	}
+}
@@ -0,0 +1,250 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/callummance/nazuna/messages"
+)
+
+//minCompactionRecords is the minimum number of records the file may contain before it is compacted
+const minCompactionRecords = 1024
+
+const (
+	opAppend = "append"
+	opDone   = "done"
+)
+
+//Journal persists notifications before they are acknowledged so that any which had not been fully handled when the
+//process stopped can be dispatched again on the next start. Implementations must be safe for concurrent use.
+type Journal interface {
+	//Append durably records a notification, which must have a MessageID. Appending an ID which is already pending has no effect.
+	Append(msg messages.EventNotificationMessage) error
+	//Done records that all handlers have finished with the notification with the given message ID
+	Done(messageID string) error
+	//Pending returns the notifications which have been appended but not marked as done, in the order they were appended
+	Pending() ([]messages.EventNotificationMessage, error)
+}
+
+type record struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id"`
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+//FileJournal is a Journal which appends records to a file, syncing it to disk before Append returns.
+//The file is rewritten to contain only pending notifications whenever it has doubled in length since it was last compacted.
+//It should only be used by a single process at a time.
+type FileJournal struct {
+	lock      sync.Mutex
+	path      string
+	file      *os.File
+	pending   map[string]json.RawMessage
+	order     []string
+	records   int
+	compactAt int
+}
+
+//OpenFileJournal opens the journal kept at path, creating the file if it does not already exist
+func OpenFileJournal(path string) (*FileJournal, error) {
+	j := &FileJournal{
+		path:    path,
+		pending: make(map[string]json.RawMessage),
+	}
+	err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	j.scheduleCompaction()
+	j.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+//load replays the records in the file to find the pending notifications
+func (j *FileJournal) load() error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		j.records++
+		var rec record
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			//Most likely a partially written final record, which can't have been acknowledged
+			continue
+		}
+		j.apply(rec)
+	}
+	return scanner.Err()
+}
+
+//apply updates the in-memory state with a record. Must be called with the lock held.
+func (j *FileJournal) apply(rec record) {
+	switch rec.Op {
+	case opAppend:
+		if _, ok := j.pending[rec.ID]; !ok {
+			j.order = append(j.order, rec.ID)
+		}
+		j.pending[rec.ID] = rec.Message
+	case opDone:
+		delete(j.pending, rec.ID)
+	}
+}
+
+//write appends a record to the file. Must be called with the lock held.
+func (j *FileJournal) write(rec record, sync bool) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	if sync {
+		err = j.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	j.records++
+	return nil
+}
+
+//Append durably records a notification, which must have a MessageID
+func (j *FileJournal) Append(msg messages.EventNotificationMessage) error {
+	if msg.MessageID == "" {
+		return fmt.Errorf("cannot journal a notification without a message ID")
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, ok := j.pending[msg.MessageID]; ok {
+		return nil
+	}
+	rec := record{Op: opAppend, ID: msg.MessageID, Message: body}
+	err = j.write(rec, true)
+	if err != nil {
+		return err
+	}
+	j.apply(rec)
+	return nil
+}
+
+//Done records that all handlers have finished with the notification with the given message ID
+func (j *FileJournal) Done(messageID string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, ok := j.pending[messageID]; !ok {
+		return nil
+	}
+	//There is no need to sync here, as losing the record only causes the notification to be handled again
+	rec := record{Op: opDone, ID: messageID}
+	err := j.write(rec, false)
+	if err != nil {
+		return err
+	}
+	j.apply(rec)
+	if j.records >= j.compactAt {
+		return j.compact()
+	}
+	return nil
+}
+
+//Pending returns the notifications which have been appended but not marked as done, in the order they were appended
+func (j *FileJournal) Pending() ([]messages.EventNotificationMessage, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	var result []messages.EventNotificationMessage
+	for _, id := range j.order {
+		body, ok := j.pending[id]
+		if !ok {
+			continue
+		}
+		msg, err := messages.DecodeNotification(body, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode journalled notification %v: %v", id, err)
+		}
+		result = append(result, *msg)
+	}
+	return result, nil
+}
+
+func (j *FileJournal) scheduleCompaction() {
+	j.compactAt = 2 * len(j.pending)
+	if j.compactAt < minCompactionRecords {
+		j.compactAt = minCompactionRecords
+	}
+}
+
+//compact rewrites the file to contain only pending notifications. Must be called with the lock held.
+func (j *FileJournal) compact() error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	var order []string
+	for _, id := range j.order {
+		body, ok := j.pending[id]
+		if !ok {
+			continue
+		}
+		order = append(order, id)
+		line, err := json.Marshal(record{Op: opAppend, ID: id, Message: body})
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, j.path)
+	if err != nil {
+		return err
+	}
+
+	j.file.Close()
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	j.order = order
+	j.records = len(order)
+	j.scheduleCompaction()
+	return nil
+}
+
+//Close closes the underlying file
+func (j *FileJournal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.file.Close()
+}
@@ -0,0 +1,266 @@
+package journal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/messages"
+)
+
+//notification decodes a stream.online notification as a listener would, giving it the message ID id
+func notification(t *testing.T, id string) messages.EventNotificationMessage {
+	t.Helper()
+	body := `{"subscription":{"id":"sub","type":"stream.online","version":"1"},"event":{"broadcaster_user_id":"1234","type":"live"}}`
+	msg, err := messages.DecodeNotification([]byte(body), "")
+	if err != nil {
+		t.Fatalf("DecodeNotification() error = %v", err)
+	}
+	msg.MessageID = id
+	return *msg
+}
+
+func pendingIDs(t *testing.T, j *FileJournal) []string {
+	t.Helper()
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("Pending() error = %v", err)
+	}
+	var ids []string
+	for _, msg := range pending {
+		ids = append(ids, msg.MessageID)
+	}
+	return ids
+}
+
+func TestFileJournalReplaysPending(t *testing.T) {
+	tests := []struct {
+		name   string
+		append []string
+		done   []string
+		want   []string
+	}{
+		{
+			name: "empty journal",
+		},
+		{
+			name:   "nothing marked done",
+			append: []string{"a", "b", "c"},
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "only unfinished notifications are replayed in order",
+			append: []string{"a", "b", "c", "d"},
+			done:   []string{"b", "d"},
+			want:   []string{"a", "c"},
+		},
+		{
+			name:   "everything marked done",
+			append: []string{"a", "b"},
+			done:   []string{"b", "a"},
+		},
+		{
+			name:   "appending a pending notification again has no effect",
+			append: []string{"a", "b", "a"},
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "marking an unknown notification done has no effect",
+			append: []string{"a"},
+			done:   []string{"z"},
+			want:   []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal")
+			j, err := OpenFileJournal(path)
+			if err != nil {
+				t.Fatalf("OpenFileJournal() error = %v", err)
+			}
+			for _, id := range tt.append {
+				if err := j.Append(notification(t, id)); err != nil {
+					t.Fatalf("Append(%v) error = %v", id, err)
+				}
+			}
+			for _, id := range tt.done {
+				if err := j.Done(id); err != nil {
+					t.Fatalf("Done(%v) error = %v", id, err)
+				}
+			}
+			if got := pendingIDs(t, j); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Pending() = %v, want %v", got, tt.want)
+			}
+			if err := j.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			reopened, err := OpenFileJournal(path)
+			if err != nil {
+				t.Fatalf("OpenFileJournal() after restart error = %v", err)
+			}
+			defer reopened.Close()
+			if got := pendingIDs(t, reopened); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Pending() after restart = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileJournalPendingDecodesEvents(t *testing.T) {
+	j, err := OpenFileJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatalf("OpenFileJournal() error = %v", err)
+	}
+	defer j.Close()
+	if err := j.Append(notification(t, "a")); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	pending, err := j.Pending()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("Pending() = %v, %v, want one notification", pending, err)
+	}
+	event, ok := pending[0].Event.(*messages.StreamOnlineEvent)
+	if !ok || event.BroadcasterUID != "1234" {
+		t.Errorf("Pending()[0].Event = %#v, want the journalled stream.online event", pending[0].Event)
+	}
+}
+
+func TestFileJournalKeepsMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenFileJournal(path)
+	if err != nil {
+		t.Fatalf("OpenFileJournal() error = %v", err)
+	}
+	msg := notification(t, "a")
+	msg.Metadata = messages.Metadata{
+		MessageID:           "a",
+		MessageTimestamp:    time.Date(2022, 5, 6, 7, 8, 9, 123456789, time.UTC),
+		MessageRetry:        3,
+		SubscriptionVersion: "beta",
+	}
+	if err := j.Append(msg); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	j.Close()
+
+	reopened, err := OpenFileJournal(path)
+	if err != nil {
+		t.Fatalf("OpenFileJournal() error = %v", err)
+	}
+	defer reopened.Close()
+	pending, err := reopened.Pending()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("Pending() = %v, %v, want one notification", pending, err)
+	}
+	if got := pending[0].Metadata; !got.MessageTimestamp.Equal(msg.MessageTimestamp) || got.MessageID != "a" || got.MessageRetry != 3 || got.SubscriptionVersion != "beta" {
+		t.Errorf("Pending()[0].Metadata = %+v, want %+v", got, msg.Metadata)
+	}
+	if !bytes.Equal(pending[0].Raw, msg.Raw) {
+		t.Errorf("Pending()[0].Raw = %s, want the body twitch sent: %s", pending[0].Raw, msg.Raw)
+	}
+}
+
+func TestFileJournalRejectsMissingID(t *testing.T) {
+	j, err := OpenFileJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatalf("OpenFileJournal() error = %v", err)
+	}
+	defer j.Close()
+	if err := j.Append(notification(t, "")); err == nil {
+		t.Error("Append() error = nil for a notification without a message ID")
+	}
+}
+
+func TestFileJournalCompaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		records int
+		keep    int
+	}{
+		{name: "below the threshold", records: 100, keep: 3},
+		{name: "just below the threshold", records: minCompactionRecords/2 - 1, keep: 3},
+		{name: "past the threshold", records: 2 * minCompactionRecords, keep: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal")
+			j, err := OpenFileJournal(path)
+			if err != nil {
+				t.Fatalf("OpenFileJournal() error = %v", err)
+			}
+			var want []string
+			for i := 0; i < tt.records; i++ {
+				id := fmt.Sprint(i)
+				if err := j.Append(notification(t, id)); err != nil {
+					t.Fatalf("Append(%v) error = %v", id, err)
+				}
+				if i < tt.records-tt.keep {
+					if err := j.Done(id); err != nil {
+						t.Fatalf("Done(%v) error = %v", id, err)
+					}
+				} else {
+					want = append(want, id)
+				}
+			}
+			if err := j.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			//Each notification writes an append and a done record, so the file is compacted once it reaches the
+			//threshold, leaving only the records written since
+			written := 2*tt.records - tt.keep
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read journal file: %v", err)
+			}
+			lines := bytes.Count(data, []byte("\n"))
+			if written < minCompactionRecords && lines != written {
+				t.Errorf("journal has %v lines, want %v before compaction", lines, written)
+			} else if written >= minCompactionRecords && lines >= minCompactionRecords {
+				t.Errorf("journal has %v lines, want fewer than %v after compaction", lines, minCompactionRecords)
+			}
+
+			reopened, err := OpenFileJournal(path)
+			if err != nil {
+				t.Fatalf("OpenFileJournal() after restart error = %v", err)
+			}
+			defer reopened.Close()
+			if got := pendingIDs(t, reopened); !reflect.DeepEqual(got, want) {
+				t.Errorf("Pending() after restart = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFileJournalSkipsPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenFileJournal(path)
+	if err != nil {
+		t.Fatalf("OpenFileJournal() error = %v", err)
+	}
+	if err := j.Append(notification(t, "a")); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	j.Close()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("failed to open journal file: %v", err)
+	}
+	file.WriteString(`{"op":"append","id":"b","mess`)
+	file.Close()
+
+	reopened, err := OpenFileJournal(path)
+	if err != nil {
+		t.Fatalf("OpenFileJournal() error = %v", err)
+	}
+	defer reopened.Close()
+	if got, want := pendingIDs(t, reopened), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pending() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/callummance/nazuna/messages"
+)
+
+//Level is the severity of a log line
+type Level int
+
+const (
+	TraceLevel Level = iota
+	DebugLevel
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case TraceLevel:
+		return "trace"
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warning"
+	case ErrorLevel:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+//Fields are key-value pairs attached to a log line
+type Fields map[string]interface{}
+
+//Standard field names, used so that log lines from every package can be filtered in the same way
+const (
+	FieldMessageID        = "message_id"
+	FieldSubscriptionID   = "subscription_id"
+	FieldSubscriptionType = "subscription_type"
+	FieldBroadcasterID    = "broadcaster_id"
+	FieldHandler          = "handler"
+)
+
+//Logger is the interface through which nazuna writes logs. By the time Log is called the message and fields have
+//already been redacted.
+type Logger interface {
+	Log(level Level, msg string, fields Fields)
+}
+
+//LevelEnabler may be implemented by a Logger to avoid formatting lines which would be discarded
+type LevelEnabler interface {
+	Enabled(level Level) bool
+}
+
+//MessageFields returns the standard fields identifying a notification
+func MessageFields(msg *messages.EventNotificationMessage) Fields {
+	fields := Fields{
+		FieldMessageID:        msg.MessageID,
+		FieldSubscriptionID:   msg.Subscription.ID,
+		FieldSubscriptionType: msg.Subscription.Type,
+	}
+	if broadcasterID := msg.BroadcasterID(); broadcasterID != "" {
+		fields[FieldBroadcasterID] = broadcasterID
+	}
+	return fields
+}
+
+//Entry formats, redacts and passes log lines on to a Logger, carrying a set of fields which are added to each line.
+//A nil *Entry logs using Default().
+type Entry struct {
+	logger   Logger
+	redactor *Redactor
+	fields   Fields
+}
+
+var defaultEntry = New(Logrus(nil), nil)
+
+//Default returns an Entry which writes to the standard logrus logger, redacting only values which are recognisable
+//as secrets or email addresses
+func Default() *Entry {
+	return defaultEntry
+}
+
+//New creates an Entry writing to logger. If redactor is nil, a new one with no known secrets is used.
+func New(logger Logger, redactor *Redactor) *Entry {
+	if redactor == nil {
+		redactor = NewRedactor()
+	}
+	return &Entry{
+		logger:   logger,
+		redactor: redactor,
+	}
+}
+
+func (e *Entry) get() *Entry {
+	if e == nil {
+		return defaultEntry
+	}
+	return e
+}
+
+//Redactor returns the redactor applied to every line, so that further secrets can be registered with it
+func (e *Entry) Redactor() *Redactor {
+	return e.get().redactor
+}
+
+//WithField returns an Entry which adds the given field to each line
+func (e *Entry) WithField(key string, value interface{}) *Entry {
+	return e.WithFields(Fields{key: value})
+}
+
+//WithFields returns an Entry which adds the given fields to each line, in addition to any it already had
+func (e *Entry) WithFields(fields Fields) *Entry {
+	e = e.get()
+	merged := make(Fields, len(e.fields)+len(fields))
+	for k, v := range e.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Entry{
+		logger:   e.logger,
+		redactor: e.redactor,
+		fields:   merged,
+	}
+}
+
+//WithError returns an Entry which adds err to each line under the key "error"
+func (e *Entry) WithError(err error) *Entry {
+	return e.WithField("error", err)
+}
+
+func (e *Entry) enabled(level Level) bool {
+	if enabler, ok := e.logger.(LevelEnabler); ok {
+		return enabler.Enabled(level)
+	}
+	return true
+}
+
+func (e *Entry) log(level Level, msg string) {
+	fields := make(Fields, len(e.fields))
+	for k, v := range e.fields {
+		switch v := v.(type) {
+		case string:
+			fields[k] = e.redactor.Redact(v)
+		case error:
+			fields[k] = e.redactor.Redact(v.Error())
+		case fmt.Stringer:
+			fields[k] = e.redactor.Redact(v.String())
+		default:
+			fields[k] = v
+		}
+	}
+	e.logger.Log(level, e.redactor.Redact(msg), fields)
+}
+
+func (e *Entry) logf(level Level, format string, args ...interface{}) {
+	e = e.get()
+	if e.enabled(level) {
+		e.log(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (e *Entry) logln(level Level, args ...interface{}) {
+	e = e.get()
+	if e.enabled(level) {
+		e.log(level, fmt.Sprint(args...))
+	}
+}
+
+func (e *Entry) Tracef(format string, args ...interface{}) { e.logf(TraceLevel, format, args...) }
+func (e *Entry) Debugf(format string, args ...interface{}) { e.logf(DebugLevel, format, args...) }
+func (e *Entry) Infof(format string, args ...interface{})  { e.logf(InfoLevel, format, args...) }
+func (e *Entry) Warnf(format string, args ...interface{})  { e.logf(WarnLevel, format, args...) }
+func (e *Entry) Errorf(format string, args ...interface{}) { e.logf(ErrorLevel, format, args...) }
+
+func (e *Entry) Trace(args ...interface{}) { e.logln(TraceLevel, args...) }
+func (e *Entry) Debug(args ...interface{}) { e.logln(DebugLevel, args...) }
+func (e *Entry) Info(args ...interface{})  { e.logln(InfoLevel, args...) }
+func (e *Entry) Warn(args ...interface{})  { e.logln(WarnLevel, args...) }
+func (e *Entry) Error(args ...interface{}) { e.logln(ErrorLevel, args...) }
+
+type contextKey int
+
+const entryContextKey contextKey = iota
+
+//NewContext returns a context carrying entry, which is how handlers are given a logger with fields describing the
+//notification they are handling
+func NewContext(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, entryContextKey, entry)
+}
+
+//FromContext returns the Entry carried by ctx, or Default() if there is none
+func FromContext(ctx context.Context) *Entry {
+	if entry, ok := ctx.Value(entryContextKey).(*Entry); ok {
+		return entry
+	}
+	return Default()
+}
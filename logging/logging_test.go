@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+//line is a log line recieved by a recordingLogger
+type line struct {
+	level  Level
+	msg    string
+	fields Fields
+}
+
+//recordingLogger keeps every line logged through it, discarding those below min
+type recordingLogger struct {
+	min   Level
+	lines []line
+}
+
+func (l *recordingLogger) Log(level Level, msg string, fields Fields) {
+	l.lines = append(l.lines, line{level: level, msg: msg, fields: fields})
+}
+
+func (l *recordingLogger) Enabled(level Level) bool {
+	return level >= l.min
+}
+
+func TestEntryRedactsFields(t *testing.T) {
+	logger := &recordingLogger{}
+	entry := New(logger, NewRedactor("webhook-secret")).WithFields(Fields{
+		"token":    "Bearer abcdef123456",
+		"error":    errors.New("request failed: client_secret=hunter22"),
+		"url":      &url.URL{Scheme: "https", Host: "example.com", RawQuery: "access_token=abcdef123456"},
+		"attempts": 3,
+		"user":     "someone@example.com",
+	})
+	entry.Warnf("Signature did not match secret %v", "webhook-secret")
+
+	if len(logger.lines) != 1 {
+		t.Fatalf("logged %v lines, want 1", len(logger.lines))
+	}
+	got := logger.lines[0]
+	if strings.Contains(got.msg, "webhook-secret") {
+		t.Errorf("message %q contains the webhook secret", got.msg)
+	}
+	for key, value := range got.fields {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		for _, secret := range []string{"abcdef123456", "hunter22", "someone@example.com"} {
+			if strings.Contains(s, secret) {
+				t.Errorf("field %v = %q, which contains %q", key, s, secret)
+			}
+		}
+	}
+	//Errors and Stringers are converted to strings so that they can be redacted; other values are left alone
+	if _, ok := got.fields["error"].(string); !ok {
+		t.Errorf("error field = %#v, want it formatted as a string", got.fields["error"])
+	}
+	if got.fields["attempts"] != 3 {
+		t.Errorf("attempts field = %#v, want it unchanged", got.fields["attempts"])
+	}
+}
+
+func TestEntryLevels(t *testing.T) {
+	logger := &recordingLogger{min: InfoLevel}
+	entry := New(logger, nil).WithField(FieldMessageID, "a")
+	entry.Debugf("hidden %v", "line")
+	entry.Info("shown")
+	entry.WithField(FieldHandler, "h").Error("also shown")
+
+	if len(logger.lines) != 2 {
+		t.Fatalf("logged %v lines, want the 2 at or above the minimum level", len(logger.lines))
+	}
+	if got := logger.lines[1]; got.level != ErrorLevel || got.fields[FieldMessageID] != "a" || got.fields[FieldHandler] != "h" {
+		t.Errorf("last line = %+v, want an error carrying both fields", got)
+	}
+	if _, ok := logger.lines[0].fields[FieldHandler]; ok {
+		t.Error("fields added by WithField leaked into the parent entry")
+	}
+}
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+type logrusLogger struct {
+	logger logrus.FieldLogger
+}
+
+//Logrus adapts a logrus logger or entry into a Logger. If logger is nil, the standard logrus logger is used.
+func Logrus(logger logrus.FieldLogger) Logger {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return logrusLogger{logger: logger}
+}
+
+func (l logrusLogger) Log(level Level, msg string, fields Fields) {
+	l.logger.WithFields(logrus.Fields(fields)).Log(logrusLevel(level), msg)
+}
+
+//Enabled checks the level of the underlying logrus logger, where it can be found
+func (l logrusLogger) Enabled(level Level) bool {
+	switch logger := l.logger.(type) {
+	case *logrus.Logger:
+		return logger.IsLevelEnabled(logrusLevel(level))
+	case *logrus.Entry:
+		return logger.Logger.IsLevelEnabled(logrusLevel(level))
+	}
+	return true
+}
+
+func logrusLevel(level Level) logrus.Level {
+	switch level {
+	case TraceLevel:
+		return logrus.TraceLevel
+	case DebugLevel:
+		return logrus.DebugLevel
+	case InfoLevel:
+		return logrus.InfoLevel
+	case WarnLevel:
+		return logrus.WarnLevel
+	}
+	return logrus.ErrorLevel
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//Redacted replaces each value removed from a log line
+const Redacted = "[REDACTED]"
+
+//minSecretLength stops very short values from being registered as secrets, as they would redact unrelated text
+const minSecretLength = 4
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	//credentialPattern matches credentials written as key-value pairs, whether in JSON, a Go struct dump, a query
+	//string or an HTTP header, including dumps of http.Header which wrap each value in brackets
+	credentialPattern = regexp.MustCompile(`(?i)((?:access_?token|refresh_?token|id_?token|client_?secret|secret|password|authorization|email)["']?\s*[:=]\s*["'\[]?)(?:(?:bearer|oauth)\s+)?[^"'\s,&}\]]+`)
+	//authSchemePattern matches tokens written after an authorization scheme without a key, such as a header value
+	//logged on its own. Short words are left alone so that phrases like "OAuth server" survive.
+	authSchemePattern = regexp.MustCompile(`(?i)\b((?:bearer|oauth)\s+)[A-Za-z0-9\-._~+/]{12,}=*`)
+)
+
+//Redactor removes secrets from log lines. Values registered with AddSecret are removed wherever they appear, along with
+//anything which looks like an email address, a credential in a key-value pair or a token following an authorization
+//scheme.
+type Redactor struct {
+	lock     sync.RWMutex
+	secrets  []string
+	replacer *strings.Replacer
+}
+
+//NewRedactor creates a Redactor which removes the given secrets
+func NewRedactor(secrets ...string) *Redactor {
+	r := &Redactor{}
+	r.AddSecret(secrets...)
+	return r
+}
+
+//AddSecret registers further values to be removed, such as newly issued access tokens
+func (r *Redactor) AddSecret(secrets ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	added := false
+	for _, secret := range secrets {
+		if len(secret) < minSecretLength || r.known(secret) {
+			continue
+		}
+		r.secrets = append(r.secrets, secret)
+		added = true
+	}
+	if !added {
+		return
+	}
+	pairs := make([]string, 0, 2*len(r.secrets))
+	for _, secret := range r.secrets {
+		pairs = append(pairs, secret, Redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+//known must be called with the lock held
+func (r *Redactor) known(secret string) bool {
+	for _, s := range r.secrets {
+		if s == secret {
+			return true
+		}
+	}
+	return false
+}
+
+//Redact returns s with all secrets removed
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	r.lock.RLock()
+	replacer := r.replacer
+	r.lock.RUnlock()
+	if replacer != nil {
+		s = replacer.Replace(s)
+	}
+	s = credentialPattern.ReplaceAllString(s, "${1}"+Redacted)
+	s = authSchemePattern.ReplaceAllString(s, "${1}"+Redacted)
+	return emailPattern.ReplaceAllString(s, Redacted)
+}
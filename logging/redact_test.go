@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestRedact(t *testing.T) {
+	tok := &oauth2.Token{
+		AccessToken:  "acc3ss-t0ken",
+		TokenType:    "bearer",
+		RefreshToken: "r3fresh-t0ken",
+		Expiry:       time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	tests := []struct {
+		name string
+		in   string
+		//leaked are values which must not appear in the output
+		leaked []string
+		//kept are values which must survive redaction
+		kept []string
+	}{
+		{
+			name:   "go syntax dump of a token",
+			in:     fmt.Sprintf("Using token %#v", tok),
+			leaked: []string{"acc3ss-t0ken", "r3fresh-t0ken"},
+			kept:   []string{"TokenType:\"bearer\""},
+		},
+		{
+			name:   "bearer authorization header",
+			in:     "Authorization: Bearer abcdef123456",
+			leaked: []string{"abcdef123456"},
+			kept:   []string{"Authorization: "},
+		},
+		{
+			name:   "oauth authorization header",
+			in:     "map[Authorization:[OAuth abcdef123456] Client-Id:[client]]",
+			leaked: []string{"abcdef123456"},
+			kept:   []string{"Client-Id:[client]"},
+		},
+		{
+			name:   "query string",
+			in:     "POST https://id.twitch.tv/oauth2/token?client_id=client&client_secret=hunter22&grant_type=client_credentials",
+			leaked: []string{"hunter22"},
+			kept:   []string{"client_id=client", "&grant_type=client_credentials"},
+		},
+		{
+			name:   "json body",
+			in:     `{"access_token":"acc3ss-t0ken","refresh_token":"r3fresh-t0ken","expires_in":3600,"scope":["user:read:email"]}`,
+			leaked: []string{"acc3ss-t0ken", "r3fresh-t0ken"},
+			kept:   []string{`"expires_in":3600`},
+		},
+		{
+			name:   "registered secret inside a longer string",
+			in:     "callback verified with signature prefix-s3cret-value-suffix",
+			leaked: []string{"s3cret-value"},
+			kept:   []string{"prefix-", "-suffix"},
+		},
+		{
+			name:   "email address",
+			in:     "Got user {ID:1234 Login:nazuna Email:someone.else+tag@example.co.uk}",
+			leaked: []string{"someone.else+tag@example.co.uk", "example.co.uk"},
+			kept:   []string{"Login:nazuna"},
+		},
+		{
+			name:   "authorization scheme without a key",
+			in:     "retrying with Bearer abcdef123456 after refreshing",
+			leaked: []string{"abcdef123456"},
+			kept:   []string{"retrying with Bearer ", " after refreshing"},
+		},
+		{
+			name: "authorization scheme in prose",
+			in:   "Failed to reach the OAuth server",
+			kept: []string{"Failed to reach the OAuth server"},
+		},
+		{
+			name: "nothing to redact",
+			in:   "Dispatching message 1234 for subscription stream.online",
+			kept: []string{"Dispatching message 1234 for subscription stream.online"},
+		},
+	}
+	r := NewRedactor("s3cret-value", "abc")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := r.Redact(tt.in)
+			for _, leaked := range tt.leaked {
+				if strings.Contains(got, leaked) {
+					t.Errorf("Redact() = %q, which still contains %q", got, leaked)
+				}
+			}
+			for _, kept := range tt.kept {
+				if !strings.Contains(got, kept) {
+					t.Errorf("Redact() = %q, want it to keep %q", got, kept)
+				}
+			}
+			if len(tt.leaked) > 0 && !strings.Contains(got, Redacted) {
+				t.Errorf("Redact() = %q, want it to mark what was removed", got)
+			}
+		})
+	}
+}
+
+func TestRedactorIgnoresShortSecrets(t *testing.T) {
+	//Registering "abc" would otherwise mangle any line containing those letters
+	r := NewRedactor("abc")
+	if got := r.Redact("abcdef"); got != "abcdef" {
+		t.Errorf("Redact() = %q, want short secrets to be ignored", got)
+	}
+	r.AddSecret("abcdef")
+	if got := r.Redact("xabcdefx"); got != "x"+Redacted+"x" {
+		t.Errorf("Redact() = %q after adding a secret, want it removed", got)
+	}
+}
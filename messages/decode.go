@@ -0,0 +1,114 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+//Event is satisfied by each of the structs representing an EventSub event, and is used to check handler types at compile time
+type Event interface {
+	ChannelUpdateEvent |
+		ChannelFollowEvent |
+		ChannelSubscribeEvent |
+		ChannelCheerEvent |
+		ChannelRaidEvent |
+		ChannelBanEvent |
+		ChannelUnbanEvent |
+		ChannelPointsCustomRewardAddEvent |
+		ChannelPointsCustomRewardUpdateEvent |
+		ChannelPointsCustomRewardRemoveEvent |
+		ChannelPointsCustomRewardRedemptionAddEvent |
+		ChannelPointsCustomRewardRedemptionUpdateEvent |
+		ChannelHypeTrainBeginEvent |
+		ChannelHypeTrainProgressEvent |
+		ChannelHypeTrainEndEvent |
+		StreamOnlineEvent |
+		StreamOfflineEvent |
+		UserAuthorizationRevokeEvent |
+		UserUpdateEvent
+}
+
+//eventConstructors creates an empty event struct for each supported subscription type
+var eventConstructors = map[string]func() interface{}{
+	SubscriptionChannelUpdate:                             func() interface{} { return new(ChannelUpdateEvent) },
+	SubscriptionChannelFollow:                             func() interface{} { return new(ChannelFollowEvent) },
+	SubscriptionChannelSubscribe:                          func() interface{} { return new(ChannelSubscribeEvent) },
+	SubscriptionChannelCheer:                              func() interface{} { return new(ChannelCheerEvent) },
+	SubscriptionChannelRaid:                               func() interface{} { return new(ChannelRaidEvent) },
+	SubscriptionChannelBan:                                func() interface{} { return new(ChannelBanEvent) },
+	SubscriptionChannelUnban:                              func() interface{} { return new(ChannelUnbanEvent) },
+	SubscriptionChannelPointsCustomRewardAdd:              func() interface{} { return new(ChannelPointsCustomRewardAddEvent) },
+	SubscriptionChannelPointsCustomRewardUpdate:           func() interface{} { return new(ChannelPointsCustomRewardUpdateEvent) },
+	SubscriptionChannelPointsCustomRewardRemove:           func() interface{} { return new(ChannelPointsCustomRewardRemoveEvent) },
+	SubscriptionChannelPointsCustomRewardRedemptionAdd:    func() interface{} { return new(ChannelPointsCustomRewardRedemptionAddEvent) },
+	SubscriptionChannelPointsCustomRewardRedemptionUpdate: func() interface{} { return new(ChannelPointsCustomRewardRedemptionUpdateEvent) },
+	SubscriptionChannelHypeTrainBegin:                     func() interface{} { return new(ChannelHypeTrainBeginEvent) },
+	SubscriptionChannelHypeTrainProgress:                  func() interface{} { return new(ChannelHypeTrainProgressEvent) },
+	SubscriptionChannelHypeTrainEnd:                       func() interface{} { return new(ChannelHypeTrainEndEvent) },
+	SubscriptionStreamOnline:                              func() interface{} { return new(StreamOnlineEvent) },
+	SubscriptionStreamOffline:                             func() interface{} { return new(StreamOfflineEvent) },
+	SubscriptionUserAuthorizationRevoke:                   func() interface{} { return new(UserAuthorizationRevokeEvent) },
+	SubscriptionUserUpdate:                                func() interface{} { return new(UserUpdateEvent) },
+}
+
+//eventSubscriptionTypes maps each event struct type back to the subscription type which delivers it
+var eventSubscriptionTypes = func() map[reflect.Type]string {
+	types := make(map[reflect.Type]string, len(eventConstructors))
+	for subscriptionType, newEvent := range eventConstructors {
+		types[reflect.TypeOf(newEvent()).Elem()] = subscriptionType
+	}
+	return types
+}()
+
+//SubscriptionTypeOf returns the subscription type which delivers events of type E
+func SubscriptionTypeOf[E Event]() string {
+	return eventSubscriptionTypes[reflect.TypeOf((*E)(nil)).Elem()]
+}
+
+type intermediateNotification struct {
+	Metadata
+	Subscription Subscription    `json:"subscription"`
+	Event        json.RawMessage `json:"event"`
+	Raw          json.RawMessage `json:"raw"`
+}
+
+//DecodeNotification decodes the body of a notification message, using the subscription type to pick the correct event struct.
+//If subscriptionType is empty, the type given in the body's subscription is used instead.
+//The result's Event field will hold a pointer to that struct, or nil if the subscription type is not recognised.
+//Metadata is only present if body was produced by marshalling an EventNotificationMessage; otherwise it must be filled in
+//by the caller. Likewise, Raw is set to body unless body contains a raw field of its own.
+func DecodeNotification(body []byte, subscriptionType string) (*EventNotificationMessage, error) {
+	var intermediate intermediateNotification
+	err := json.Unmarshal(body, &intermediate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal notification body: %v", err)
+	}
+	if subscriptionType == "" {
+		subscriptionType = intermediate.Subscription.Type
+	}
+	raw := intermediate.Raw
+	if len(raw) == 0 {
+		raw = append(json.RawMessage(nil), body...)
+	}
+	res := EventNotificationMessage{
+		Metadata:     intermediate.Metadata,
+		Subscription: intermediate.Subscription,
+		Event:        nil,
+		Raw:          raw,
+	}
+	if res.SubscriptionVersion == "" {
+		res.SubscriptionVersion = intermediate.Subscription.Version
+	}
+	newEvent, ok := eventConstructors[subscriptionType]
+	if !ok {
+		return &res, nil
+	}
+	ev := newEvent()
+	err = json.Unmarshal(intermediate.Event, ev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %v event: %v", subscriptionType, err)
+	}
+	res.Event = ev
+	return &res, nil
+}
@@ -1,10 +1,62 @@
 package messages
 
-import "time"
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/callummance/nazuna/tracing"
+)
+
+//Metadata describes the delivery of a notification, as given in the webhook request headers or websocket message metadata
+type Metadata struct {
+	//MessageID is the unique ID twitch assigned to the message which delivered this notification. It stays the same
+	//when a message is redelivered, so can be used to make handlers idempotent.
+	MessageID string `json:"message_id,omitempty"`
+	//MessageTimestamp is the time at which twitch sent the message which delivered this notification
+	MessageTimestamp time.Time `json:"message_timestamp"`
+	//MessageRetry is the number of times twitch had already tried to deliver the message. It is always zero for the
+	//websocket transport.
+	MessageRetry int `json:"message_retry,omitempty"`
+	//SubscriptionVersion is the version of the subscription type which the event was delivered for
+	SubscriptionVersion string `json:"subscription_version,omitempty"`
+}
+
+//Latency returns the time elapsed between twitch sending the message and now
+func (m Metadata) Latency() time.Duration {
+	return time.Since(m.MessageTimestamp)
+}
 
 type EventNotificationMessage struct {
+	//Metadata is embedded so that its fields, such as MessageID, can be accessed directly
+	Metadata
 	Subscription Subscription `json:"subscription"`
 	Event        interface{}  `json:"event"`
+	//Raw contains the JSON body of the notification exactly as it was recieved from twitch
+	Raw json.RawMessage `json:"raw,omitempty"`
+	//SpanContext identifies the span covering the receipt of the notification, so that spans created whilst
+	//handling it can be linked to it. It is not persisted.
+	SpanContext tracing.SpanContext `json:"-"`
+}
+
+//broadcasterIDFields lists the event fields which may identify the channel an event belongs to, in order of preference
+var broadcasterIDFields = []string{"BroadcasterUID", "ToBroadcasterUID", "UserUID"}
+
+//BroadcasterID returns the user ID of the broadcaster whose channel the event occurred in. For channel.raid events this
+//is the channel being raided, and for user.* events it is the user concerned. Returns an empty string if the event
+//was not recognised.
+func (m *EventNotificationMessage) BroadcasterID() string {
+	v := reflect.ValueOf(m.Event)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+	for _, name := range broadcasterIDFields {
+		field := v.Elem().FieldByName(name)
+		if field.IsValid() && field.Kind() == reflect.String {
+			return field.String()
+		}
+	}
+	return ""
 }
 
 //ChannelUpdateEvent represents a channel.update event `https://dev.twitch.tv/docs/eventsub/eventsub-subscription-types#channelupdate`
@@ -24,6 +24,22 @@ const (
 	SubscriptionUserUpdate                                = "user.update"
 )
 
+//Subscription statuses; the last four are sent in revocation messages to explain why a subscription was removed
+const (
+	SubscriptionStatusEnabled                      = "enabled"
+	SubscriptionStatusVerificationPending          = "webhook_callback_verification_pending"
+	SubscriptionStatusVerificationFailed           = "webhook_callback_verification_failed"
+	SubscriptionStatusUserRemoved                  = "user_removed"
+	SubscriptionStatusAuthorizationRevoked         = "authorization_revoked"
+	SubscriptionStatusNotificationFailuresExceeded = "notification_failures_exceeded"
+	SubscriptionStatusVersionRemoved               = "version_removed"
+)
+
+const (
+	TransportWebhook   = "webhook"
+	TransportWebsocket = "websocket"
+)
+
 type Subscription struct {
 	ID        string        `json:"id,omitempty"`
 	Status    string        `json:"status,omitempty"`
@@ -35,9 +51,10 @@ type Subscription struct {
 }
 
 type TransportOpts struct {
-	Method   string `json:"method"`
-	Callback string `json:"callback"`
-	Secret   string `json:"secret"`
+	Method    string `json:"method"`
+	Callback  string `json:"callback,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
 }
 
 type SubscriptionRequestStatus struct {
@@ -51,6 +68,11 @@ type VerificationMessage struct {
 	Subscription Subscription `json:"subscription"`
 }
 
+//RevocationMessage is sent when twitch stops delivering notifications for a subscription. The reason is given by Subscription.Status.
+type RevocationMessage struct {
+	Subscription Subscription `json:"subscription"`
+}
+
 type ConditionChannelUpdate struct {
 	BroadcasterUID string `json:"broadcaster_user_id"`
 }
@@ -0,0 +1,42 @@
+package messages
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	WebsocketMessageSessionWelcome   = "session_welcome"
+	WebsocketMessageSessionKeepalive = "session_keepalive"
+	WebsocketMessageSessionReconnect = "session_reconnect"
+	WebsocketMessageNotification     = "notification"
+	WebsocketMessageRevocation       = "revocation"
+)
+
+//WebsocketMessage represents a single frame sent over an EventSub WebSocket connection `https://dev.twitch.tv/docs/eventsub/websocket-reference`
+//The contents of Payload depend on the message type given in the metadata.
+type WebsocketMessage struct {
+	Metadata WebsocketMetadata `json:"metadata"`
+	Payload  json.RawMessage   `json:"payload"`
+}
+
+type WebsocketMetadata struct {
+	MessageID           string    `json:"message_id"`
+	MessageType         string    `json:"message_type"`
+	MessageTimestamp    time.Time `json:"message_timestamp"`
+	SubscriptionType    string    `json:"subscription_type,omitempty"`
+	SubscriptionVersion string    `json:"subscription_version,omitempty"`
+}
+
+//WebsocketSessionPayload is the payload of session_welcome and session_reconnect messages
+type WebsocketSessionPayload struct {
+	Session WebsocketSession `json:"session"`
+}
+
+type WebsocketSession struct {
+	ID                      string     `json:"id"`
+	Status                  string     `json:"status"`
+	KeepaliveTimeoutSeconds int        `json:"keepalive_timeout_seconds"`
+	ReconnectURL            string     `json:"reconnect_url"`
+	ConnectedAt             *time.Time `json:"connected_at,omitempty"`
+}
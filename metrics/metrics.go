@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Outcomes recorded for webhook requests
+const (
+	OutcomeAccepted    = "accepted"
+	OutcomeRejected    = "rejected"
+	OutcomeInvalid     = "invalid"
+	OutcomeError       = "error"
+	OutcomeUnavailable = "unavailable"
+	OutcomeUnknownType = "unknown_type"
+)
+
+//Reasons recorded for messages rejected whilst being verified
+const (
+	RejectionTimestamp = "timestamp"
+	RejectionDuplicate = "duplicate"
+	RejectionSignature = "signature"
+)
+
+//QueueStats is the subset of the dispatch queue's statistics which are exported as metrics
+type QueueStats struct {
+	Depth   int
+	Spilled int
+	Dropped uint64
+}
+
+//Metrics contains the instruments used throughout nazuna. All of its methods may be called on a nil *Metrics, in
+//which case they do nothing, so components need not check whether metrics are enabled.
+//A Metrics should only be used by a single EventsubClient.
+type Metrics struct {
+	Registry *Registry
+
+	WebhookRequests *CounterVec
+	Rejections      *CounterVec
+	DecodeFailures  *CounterVec
+	HandlerDuration *HistogramVec
+	HandlerErrors   *CounterVec
+	HelixRequests   *CounterVec
+	HelixDuration   *HistogramVec
+	HelixRetries    *CounterVec
+
+	queueLock  sync.Mutex
+	queueStats func() QueueStats
+}
+
+//New creates a Metrics with its own Registry, which can be mounted as a scrape endpoint using Handler
+func New() *Metrics {
+	r := NewRegistry()
+	m := &Metrics{
+		Registry:        r,
+		WebhookRequests: r.NewCounterVec("nazuna_webhook_requests_total", "Webhook requests recieved from twitch, by message type and outcome.", "type", "outcome"),
+		Rejections:      r.NewCounterVec("nazuna_message_rejections_total", "Messages rejected whilst being verified, by reason.", "reason"),
+		DecodeFailures:  r.NewCounterVec("nazuna_decode_failures_total", "Notifications which could not be decoded, by transport and subscription type.", "transport", "subscription_type"),
+		HandlerDuration: r.NewHistogramVec("nazuna_handler_duration_seconds", "Time taken by each attempt of a handler to process a notification.", nil, "handler"),
+		HandlerErrors:   r.NewCounterVec("nazuna_handler_errors_total", "Failed attempts by a handler to process a notification.", "handler"),
+		HelixRequests:   r.NewCounterVec("nazuna_helix_requests_total", "Requests made to the Helix API, by method, path and response status code.", "method", "path", "code"),
+		HelixDuration:   r.NewHistogramVec("nazuna_helix_request_duration_seconds", "Time taken by requests to the Helix API, by method and path.", nil, "method", "path"),
+		HelixRetries:    r.NewCounterVec("nazuna_helix_retries_total", "Requests to the Helix API which were retried, by method, path and the status code which caused the retry.", "method", "path", "code"),
+	}
+	r.NewGaugeFunc("nazuna_queue_depth", "Notifications waiting in memory to be dispatched to handlers.", func() float64 {
+		return float64(m.readQueueStats().Depth)
+	})
+	r.NewGaugeFunc("nazuna_queue_spilled", "Notifications waiting on disk to be dispatched to handlers.", func() float64 {
+		return float64(m.readQueueStats().Spilled)
+	})
+	r.NewCounterFunc("nazuna_queue_dropped_total", "Notifications discarded because the dispatch queue was full.", func() float64 {
+		return float64(m.readQueueStats().Dropped)
+	})
+	return m
+}
+
+//SetQueueStats sets the function used to read the state of the dispatch queue whenever the metrics are scraped
+func (m *Metrics) SetQueueStats(stats func() QueueStats) {
+	if m == nil {
+		return
+	}
+	m.queueLock.Lock()
+	defer m.queueLock.Unlock()
+	m.queueStats = stats
+}
+
+func (m *Metrics) readQueueStats() QueueStats {
+	m.queueLock.Lock()
+	stats := m.queueStats
+	m.queueLock.Unlock()
+	if stats == nil {
+		return QueueStats{}
+	}
+	return stats()
+}
+
+//Handler returns an http.Handler which serves the metrics in the Prometheus text exposition format
+func (m *Metrics) Handler() http.Handler {
+	return m.Registry
+}
+
+//ObserveWebhookRequest records the outcome of a webhook request
+func (m *Metrics) ObserveWebhookRequest(messageType, outcome string) {
+	if m == nil {
+		return
+	}
+	m.WebhookRequests.Inc(messageType, outcome)
+}
+
+//ObserveRejection records that a message failed verification
+func (m *Metrics) ObserveRejection(reason string) {
+	if m == nil {
+		return
+	}
+	m.Rejections.Inc(reason)
+}
+
+//ObserveDecodeFailure records that a notification could not be decoded
+func (m *Metrics) ObserveDecodeFailure(transport, subscriptionType string) {
+	if m == nil {
+		return
+	}
+	m.DecodeFailures.Inc(transport, subscriptionType)
+}
+
+//ObserveHandler records an attempt by a handler to process a notification
+func (m *Metrics) ObserveHandler(handler string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.HandlerDuration.Observe(duration.Seconds(), handler)
+	if err != nil {
+		m.HandlerErrors.Inc(handler)
+	}
+}
+
+//ObserveHelixRequest records a request made to the Helix API. A status code of 0 indicates that no response was recieved.
+func (m *Metrics) ObserveHelixRequest(method, path string, statusCode int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.HelixRequests.Inc(method, path, statusLabel(statusCode))
+	m.HelixDuration.Observe(duration.Seconds(), method, path)
+}
+
+//ObserveHelixRetry records that a request to the Helix API is being retried after recieving statusCode. A status code
+//of 0 indicates that no response was recieved.
+func (m *Metrics) ObserveHelixRetry(method, path string, statusCode int) {
+	if m == nil {
+		return
+	}
+	m.HelixRetries.Inc(method, path, statusLabel(statusCode))
+}
+
+//statusLabel converts a status code to a label value, using "none" when no response was recieved
+func statusLabel(statusCode int) string {
+	if statusCode == 0 {
+		return "none"
+	}
+	return strconv.Itoa(statusCode)
+}
+
+//InstrumentTransport wraps an http.RoundTripper so that every request made through it is recorded as a Helix request.
+//If base is nil, http.DefaultTransport is used.
+func (m *Metrics) InstrumentTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if m == nil {
+		return base
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := base.RoundTrip(req)
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		m.ObserveHelixRequest(req.Method, req.URL.Path, statusCode, time.Since(start))
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
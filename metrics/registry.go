@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//DefaultBuckets are the upper bounds, in seconds, used by histograms which are not given their own
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+//collector is implemented by each kind of metric which can be added to a Registry
+type collector interface {
+	write(w io.Writer)
+}
+
+//Registry holds a set of metrics and serves them in the Prometheus text exposition format
+type Registry struct {
+	lock       sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+//NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %v is already registered", name))
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+//WriteTo writes every metric in the registry to w in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	collectors := r.collectors
+	r.lock.Unlock()
+
+	counter := &countingWriter{w: w}
+	buf := bufio.NewWriter(counter)
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	err := buf.Flush()
+	return counter.n, err
+}
+
+//ServeHTTP responds with the current value of every metric, so the registry can be mounted as a scrape endpoint
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+//metricDesc contains the parts shared by every kind of metric
+type metricDesc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *metricDesc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+//labelKey joins label values into a single map key
+func (d *metricDesc) labelKey(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %v expects %v label values but was given %v", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+//formatLabels renders label pairs, with any extra name and value appended, as {a="b",c="d"}
+func (d *metricDesc) formatLabels(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//CounterVec is a set of counters, one for each combination of label values
+type CounterVec struct {
+	metricDesc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+//NewCounterVec registers a counter with the given label names
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricDesc: metricDesc{name: name, help: help, kind: "counter", labels: labels},
+		values:     make(map[string]float64),
+	}
+	r.register(name, c)
+	return c
+}
+
+//Inc adds one to the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+//Add adds v, which must not be negative, to the counter with the given label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if c == nil {
+		return
+	}
+	key := c.labelKey(labelValues)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeHeader(w)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.formatLabels(key), formatFloat(c.values[key]))
+	}
+}
+
+//GaugeFunc is a gauge or counter whose value is read from a function each time the registry is scraped
+type GaugeFunc struct {
+	metricDesc
+	value func() float64
+}
+
+//NewGaugeFunc registers a gauge whose value is given by calling value
+func (r *Registry) NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		metricDesc: metricDesc{name: name, help: help, kind: "gauge"},
+		value:      value,
+	}
+	r.register(name, g)
+	return g
+}
+
+//NewCounterFunc registers a counter whose value is given by calling value, which must never decrease
+func (r *Registry) NewCounterFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		metricDesc: metricDesc{name: name, help: help, kind: "counter"},
+		value:      value,
+	}
+	r.register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+type histogramValues struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+//HistogramVec is a set of histograms, one for each combination of label values
+type HistogramVec struct {
+	metricDesc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValues
+}
+
+//NewHistogramVec registers a histogram with the given bucket upper bounds and label names. If buckets is nil,
+//DefaultBuckets is used.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		metricDesc: metricDesc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets:    buckets,
+		values:     make(map[string]*histogramValues),
+	}
+	r.register(name, h)
+	return h
+}
+
+//Observe records v in the histogram with the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	key := h.labelKey(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	values, ok := h.values[key]
+	if !ok {
+		values = &histogramValues{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = values
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			values.counts[i]++
+		}
+	}
+	values.sum += v
+	values.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.writeHeader(w)
+	for _, key := range sortedKeys(h.values) {
+		values := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", formatFloat(bound)), values.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", "+Inf"), values.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.formatLabels(key), formatFloat(values.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.formatLabels(key), values.count)
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const wantExposition = `# HELP nazuna_requests_total Requests made\nby the client, as seen from C:\\nazuna
+# TYPE nazuna_requests_total counter
+nazuna_requests_total{method="GET",path="/a\"b"} 2
+nazuna_requests_total{method="GET",path="/c\\d"} 1.5
+nazuna_requests_total{method="POST",path="/e\nf"} 1
+# HELP nazuna_queue_depth Notifications waiting to be handled
+# TYPE nazuna_queue_depth gauge
+nazuna_queue_depth 3
+# HELP nazuna_handler_duration_seconds Time taken by handlers
+# TYPE nazuna_handler_duration_seconds histogram
+nazuna_handler_duration_seconds_bucket{handler="a",le="0.1"} 0
+nazuna_handler_duration_seconds_bucket{handler="a",le="1"} 1
+nazuna_handler_duration_seconds_bucket{handler="a",le="+Inf"} 1
+nazuna_handler_duration_seconds_sum{handler="a"} 0.5
+nazuna_handler_duration_seconds_count{handler="a"} 1
+nazuna_handler_duration_seconds_bucket{handler="b",le="0.1"} 1
+nazuna_handler_duration_seconds_bucket{handler="b",le="1"} 2
+nazuna_handler_duration_seconds_bucket{handler="b",le="+Inf"} 3
+nazuna_handler_duration_seconds_sum{handler="b"} 2.75
+nazuna_handler_duration_seconds_count{handler="b"} 3
+`
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("nazuna_requests_total", "Requests made\nby the client, as seen from C:\\nazuna", "method", "path")
+	r.NewGaugeFunc("nazuna_queue_depth", "Notifications waiting to be handled", func() float64 { return 3 })
+	//Buckets are sorted, and series are written sorted by their label values rather than in the order they were created
+	durations := r.NewHistogramVec("nazuna_handler_duration_seconds", "Time taken by handlers", []float64{1, 0.1}, "handler")
+
+	requests.Inc("POST", "/e\nf")
+	requests.Inc("GET", `/a"b`)
+	requests.Add(1.5, "GET", `/c\d`)
+	requests.Inc("GET", `/a"b`)
+	durations.Observe(0.25, "b")
+	durations.Observe(0.5, "a")
+	durations.Observe(0.05, "b")
+	durations.Observe(2.45, "b")
+
+	var out strings.Builder
+	n, err := r.WriteTo(&out)
+	if err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if got := out.String(); got != wantExposition {
+		t.Errorf("WriteTo() wrote\n%v\nwant\n%v", got, wantExposition)
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("WriteTo() = %v, want the %v bytes written", n, out.Len())
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != wantExposition || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("ServeHTTP() responded with %v and\n%v\nwant the exposition format", rec.Header().Get("Content-Type"), rec.Body)
+	}
+}
+
+func TestRegistryRejectsDuplicateNames(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("nazuna_requests_total", "Requests")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a metric name twice did not panic")
+		}
+	}()
+	r.NewGaugeFunc("nazuna_requests_total", "Requests", func() float64 { return 0 })
+}
@@ -0,0 +1,91 @@
+package nazuna
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/messages"
+)
+
+//DispatchFunc passes a notification on to the next middleware, or to the registered handlers at the end of the chain.
+//The error returned by the handlers describes those which failed on their first attempt; any retries happen later,
+//after the dispatch has returned.
+type DispatchFunc func(ctx context.Context, msg *messages.EventNotificationMessage) error
+
+//Middleware wraps the dispatch of each notification. A middleware may modify the context or notification before
+//calling next, or return without calling next to stop the notification from reaching any handlers.
+type Middleware func(next DispatchFunc) DispatchFunc
+
+//Use adds middleware which wraps the dispatch of every notification. Middleware is run in the order it was added,
+//so the first middleware added is the outermost and sees each notification first. Notifications which have
+//already started being dispatched are not affected.
+func (c *EventsubClient) Use(middleware ...Middleware) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	//Copy so that dispatches in progress keep the chain they started with
+	chain := make([]Middleware, 0, len(c.middleware)+len(middleware))
+	chain = append(chain, c.middleware...)
+	c.middleware = append(chain, middleware...)
+}
+
+//chainMiddleware wraps dispatch so that middleware[0] is called first
+func chainMiddleware(middleware []Middleware, dispatch DispatchFunc) DispatchFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		dispatch = middleware[i](dispatch)
+	}
+	return dispatch
+}
+
+//RecoverMiddleware converts a panic in any later middleware into an error, so that it cannot stop a dispatch worker
+func RecoverMiddleware() Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(ctx context.Context, msg *messages.EventNotificationMessage) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logging.FromContext(ctx).Errorf("Dispatch of message %v panicked with %v\n%s", msg.MessageID, r, debug.Stack())
+					err = fmt.Errorf("dispatch panicked with %v", r)
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+//TimingMiddleware calls observe with the time taken to dispatch each notification to the first attempt of every handler
+func TimingMiddleware(observe func(msg *messages.EventNotificationMessage, duration time.Duration, err error)) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			observe(msg, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+//LoggingMiddleware logs the start and result of each dispatch with fields identifying the notification. If logger is
+//nil, lines are written to the client's logger.
+func LoggingMiddleware(logger logging.Logger) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+			entry := logging.FromContext(ctx)
+			if logger != nil {
+				entry = logging.New(logger, entry.Redactor())
+			}
+			entry = entry.WithFields(logging.MessageFields(msg))
+			entry.Debug("Dispatching notification")
+			start := time.Now()
+			err := next(ctx, msg)
+			entry = entry.WithField("duration", time.Since(start))
+			if err != nil {
+				entry.WithError(err).Warn("Notification was not handled successfully")
+			} else {
+				entry.Info("Notification handled")
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package nazuna
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/messages"
+	"github.com/callummance/nazuna/webhooklistener"
+)
+
+func TestChainMiddleware(t *testing.T) {
+	var calls []string
+	named := func(name string) Middleware {
+		return func(next DispatchFunc) DispatchFunc {
+			return func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+				calls = append(calls, name+" before")
+				err := next(ctx, msg)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	dispatch := func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		calls = append(calls, "handlers")
+		return nil
+	}
+	msg := testNotification("a")
+	chainMiddleware([]Middleware{named("first"), named("second")}, dispatch)(context.Background(), &msg)
+	want := []string{"first before", "second before", "handlers", "second after", "first after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+//doneJournal is a journal which records the notifications marked as done
+type doneJournal struct {
+	done chan string
+}
+
+func (j *doneJournal) Append(msg messages.EventNotificationMessage) error { return nil }
+
+func (j *doneJournal) Done(messageID string) error {
+	j.done <- messageID
+	return nil
+}
+
+func (j *doneJournal) Pending() ([]messages.EventNotificationMessage, error) { return nil, nil }
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	newFakeTwitch(t)
+	j := &doneJournal{done: make(chan string, 1)}
+	c := newTestClient(t, NazunaOpts{Journal: j})
+	var handled int
+	var lock sync.Mutex
+	c.RegisterHandler(webhooklistener.NotificationHandler(func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		lock.Lock()
+		handled++
+		lock.Unlock()
+		return nil
+	}))
+	c.Use(func(next DispatchFunc) DispatchFunc {
+		return func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+			return nil
+		}
+	})
+
+	pushNotification(t, c, testNotification("a"))
+	select {
+	case id := <-j.done:
+		if id != "a" {
+			t.Errorf("journal marked %v as done, want a", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notification was not marked as done after the middleware dropped it")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if handled != 0 {
+		t.Errorf("handler was called %v times, want the middleware to stop the notification", handled)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	msg := testNotification("a")
+	dispatch := RecoverMiddleware()(func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		panic("oh no")
+	})
+	if err := dispatch(context.Background(), &msg); err == nil || !strings.Contains(err.Error(), "oh no") {
+		t.Errorf("dispatch error = %v, want one describing the panic", err)
+	}
+}
+
+func TestTimingMiddleware(t *testing.T) {
+	handlerErr := errors.New("failed")
+	var observed *messages.EventNotificationMessage
+	var took time.Duration
+	var gotErr error
+	dispatch := TimingMiddleware(func(msg *messages.EventNotificationMessage, duration time.Duration, err error) {
+		observed, took, gotErr = msg, duration, err
+	})(func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		time.Sleep(20 * time.Millisecond)
+		return handlerErr
+	})
+	msg := testNotification("a")
+	if err := dispatch(context.Background(), &msg); err != handlerErr {
+		t.Errorf("dispatch error = %v, want %v", err, handlerErr)
+	}
+	if observed != &msg || took < 20*time.Millisecond || gotErr != handlerErr {
+		t.Errorf("observed %v taking %v with error %v, want a taking at least 20ms with error %v", observed, took, gotErr, handlerErr)
+	}
+}
+
+//logLine is a line received by a recordingLogger
+type logLine struct {
+	level  logging.Level
+	msg    string
+	fields logging.Fields
+}
+
+//recordingLogger keeps every line logged through it
+type recordingLogger struct {
+	lines []logLine
+}
+
+func (l *recordingLogger) Log(level logging.Level, msg string, fields logging.Fields) {
+	l.lines = append(l.lines, logLine{level: level, msg: msg, fields: fields})
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantLevel logging.Level
+	}{
+		{name: "success", wantLevel: logging.InfoLevel},
+		{name: "failure", err: errors.New("failed"), wantLevel: logging.WarnLevel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			dispatch := LoggingMiddleware(logger)(func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+				return tt.err
+			})
+			msg := testNotification("a")
+			if err := dispatch(context.Background(), &msg); err != tt.err {
+				t.Errorf("dispatch error = %v, want %v", err, tt.err)
+			}
+			if len(logger.lines) != 2 || logger.lines[0].level != logging.DebugLevel {
+				t.Fatalf("logged %+v, want a debug line followed by the result", logger.lines)
+			}
+			result := logger.lines[1]
+			if result.level != tt.wantLevel {
+				t.Errorf("result was logged at %v, want %v", result.level, tt.wantLevel)
+			}
+			if result.fields[logging.FieldMessageID] != "a" || result.fields[logging.FieldBroadcasterID] != "1234" {
+				t.Errorf("result was logged with fields %v, want the notification's fields", result.fields)
+			}
+			if _, ok := result.fields["duration"]; !ok {
+				t.Errorf("result was logged with fields %v, want the duration", result.fields)
+			}
+			if tt.err != nil && result.fields["error"] == nil {
+				t.Errorf("failure was logged with fields %v, want the error", result.fields)
+			}
+		})
+	}
+}
@@ -1,15 +1,26 @@
 package nazuna
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"net/url"
 	"regexp"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/callummance/nazuna/dedup"
+	"github.com/callummance/nazuna/journal"
+	"github.com/callummance/nazuna/logging"
 	"github.com/callummance/nazuna/messages"
+	"github.com/callummance/nazuna/metrics"
 	"github.com/callummance/nazuna/restclient"
+	"github.com/callummance/nazuna/tokenstore"
+	"github.com/callummance/nazuna/tracing"
 	"github.com/callummance/nazuna/webhooklistener"
-	"github.com/sirupsen/logrus"
+	"github.com/callummance/nazuna/websocketlistener"
 )
 
 //NazunaOpts contains the required options to set up a twitch client
@@ -22,129 +33,500 @@ type NazunaOpts struct {
 	Secret         string
 	ServerHostname string
 	Permissive     bool
+	//TLSCertFile and TLSKeyFile, if both set, cause the webhook server to serve HTTPS using the certificate and key they contain
+	TLSCertFile string
+	TLSKeyFile  string
+	//Transport selects how notifications are delivered; either messages.TransportWebhook (the default) or messages.TransportWebsocket
+	Transport string
+	//WebsocketURL overrides the EventSub WebSocket server address when using the websocket transport
+	WebsocketURL string
+	//UserClient makes requests using a user access token, such as a client returned by restclient.AuthCodeFlow or
+	//restclient.DeviceCodeFlow. It is required by the websocket transport, as twitch only accepts websocket
+	//subscriptions created with a user access token, and is used for every request which creates, lists or deletes
+	//subscriptions. Its token is validated hourly along with the app access token.
+	UserClient *restclient.Client
+	//DedupStore is used to detect messages which twitch has delivered more than once. Defaults to an in-memory store;
+	//use a shared store when running multiple replicas or dedup.FileStore to remember messages across restarts.
+	DedupStore dedup.Store
+	//Journal, if set, persists notifications before they are acknowledged. Any which were not fully handled when the
+	//client last stopped are dispatched again on start, giving at-least-once delivery to handlers.
+	Journal journal.Journal
+	//DeadLetterStore, if set, recieves notifications which a handler failed to process after exhausting its retries,
+	//in addition to any functions registered with OnDeadLetter
+	DeadLetterStore DeadLetterSink
+	//Queue configures the queue and worker pool used to pass notifications to handlers
+	Queue QueueOpts
+	//RateLimit configures how requests to the Helix API are paced and retried
+	RateLimit restclient.RateLimitOpts
+	//TokenStore, if set, holds the app access token so that it can be reused after a restart
+	TokenStore tokenstore.Store
+	//Logger receives the logs of every component, defaulting to the standard logrus logger. Access tokens, the client
+	//secret, the webhook secret and email addresses are redacted before lines reach it.
+	Logger logging.Logger
+	//Tracer, if set, is used to start spans covering the receipt of each message, each invocation of a handler
+	//registered for the message's subscription type and each request to the Helix API
+	Tracer tracing.Tracer
+	//Metrics, if set, records the activity of the listener, dispatcher and REST client. Serve it using Metrics.Handler().
+	Metrics *metrics.Metrics
+	//Ordering configures ordered dispatch, which is off by default so notifications may be handled in any order
+	Ordering OrderingOpts
+	//BaseContext is the parent of the contexts passed to handlers, and can be used to carry values such as trace IDs.
+	//Defaults to context.Background().
+	BaseContext context.Context
+	//HandlerTimeout limits how long each attempt by a handler may run for, unless overridden by HandlerOpts.Timeout.
+	//Zero means no limit.
+	HandlerTimeout time.Duration
 }
 
-//EventsubClient contains both the REST client and the webhook server required for communication with the Twitch API
+//notificationSource is implemented by each of the listeners which can receive notifications from twitch
+type notificationSource interface {
+	NotificationsChannel() chan messages.EventNotificationMessage
+	RevocationsChannel() chan messages.Subscription
+	Shutdown(ctx context.Context) error
+}
+
+//EventsubClient contains both the REST client and the listener required for communication with the Twitch API
 type EventsubClient struct {
-	listener      webhooklistener.Listener
-	restClient    restclient.Client
-	handlersLock  sync.RWMutex
-	handlers      []webhooklistener.WebhookHandler
-	transportOpts messages.TransportOpts
+	listener             notificationSource
+	restClient           restclient.Client
+	subscriptionClient   *restclient.Client
+	handlersLock         sync.RWMutex
+	handlers             []registeredHandler
+	middleware           []Middleware
+	lastHandlerID        uint64
+	revocationHandlers   []func(*messages.Subscription)
+	deadLetterHandlers   []func(DeadLetter)
+	handlerErrorHandlers []func(HandlerError)
+	invalidTokenHandlers []func(error)
+	deadLetterStore      DeadLetterSink
+	closing              chan struct{}
+	closeOnce            sync.Once
+	handlerCtx           context.Context
+	cancelHandlers       context.CancelFunc
+	handlerTimeout       time.Duration
+	queue                *dispatchQueue
+	journal              journal.Journal
+	workers              int
+	metrics              *metrics.Metrics
+	tracer               tracing.Tracer
+	log                  *logging.Entry
+	ordered              *orderedDispatcher
+	reorderWindow        time.Duration
+	runningWG            sync.WaitGroup
+	dispatchDone         chan struct{}
+	transportLock        sync.RWMutex
+	transportOpts        messages.TransportOpts
+	sessionSubscriptions map[string]interface{}
 }
 
-//NewClient creates a new EventSubClient
+//NewClient creates a new EventSubClient. If twitch rejects the client ID or secret, the returned error is a
+//*restclient.CredentialsError. The websocket transport also requires opts.UserClient to be set.
 func NewClient(opts NazunaOpts) (*EventsubClient, error) {
+	return newClient(opts, true)
+}
+
+//NewHandlerClient creates a new EventSubClient using the webhook transport which does not start its own server. Instead,
+//the http.Handler returned by Handler should be mounted on an existing server at opts.WebhookPath.
+func NewHandlerClient(opts NazunaOpts) (*EventsubClient, error) {
+	if opts.Transport != "" && opts.Transport != messages.TransportWebhook {
+		return nil, fmt.Errorf("transport %v cannot be used without a listener", opts.Transport)
+	}
+	return newClient(opts, false)
+}
+
+func newClient(opts NazunaOpts, listen bool) (*EventsubClient, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = logging.Logrus(nil)
+	}
+	log := logging.New(logger, logging.NewRedactor(opts.ClientSecret, opts.Secret))
+	if opts.Transport == messages.TransportWebsocket && opts.UserClient == nil {
+		return nil, fmt.Errorf("a UserClient must be provided to use transport %v", opts.Transport)
+	}
+
+	queue, err := newDispatchQueue(opts.Queue, log)
+	if err != nil {
+		return nil, err
+	}
+	workers := opts.Queue.Workers
+	if workers <= 0 {
+		workers = defaultQueueWorkers
+	}
+
+	//Create REST client
+	restclient, err := restclient.NewClient(restclient.ClientOpts{
+		ClientID:     opts.ClientID,
+		ClientSecret: opts.ClientSecret,
+		Scopes:       opts.Scopes,
+		TokenStore:   opts.TokenStore,
+		Logger:       log,
+	})
+	if err != nil {
+		return nil, err
+	}
+	restclient.SetRateLimit(opts.RateLimit)
+
+	baseCtx := opts.BaseContext
+	if baseCtx == nil {
+		baseCtx = context.Background()
+	}
+	handlerCtx, cancelHandlers := context.WithCancel(baseCtx)
+
+	if opts.Metrics != nil {
+		restclient.SetMetrics(opts.Metrics)
+	}
+	tracer := opts.Tracer
+	if tracer == nil {
+		tracer = tracing.NoopTracer{}
+	} else {
+		restclient.SetTracer(tracer)
+	}
+	client := &EventsubClient{
+		restClient:      *restclient,
+		queue:           queue,
+		journal:         opts.Journal,
+		workers:         workers,
+		metrics:         opts.Metrics,
+		tracer:          tracer,
+		log:             log,
+		deadLetterStore: opts.DeadLetterStore,
+		closing:         make(chan struct{}),
+		handlerCtx:      handlerCtx,
+		cancelHandlers:  cancelHandlers,
+		handlerTimeout:  opts.HandlerTimeout,
+		dispatchDone:    make(chan struct{}),
+	}
+	client.subscriptionClient = &client.restClient
+	opts.Metrics.SetQueueStats(func() metrics.QueueStats {
+		stats := queue.stats()
+		return metrics.QueueStats{Depth: stats.Depth, Spilled: stats.Spilled, Dropped: stats.Dropped}
+	})
+	if opts.Ordering.Enabled {
+		client.ordered = newOrderedDispatcher(opts.Ordering)
+		client.reorderWindow = opts.Ordering.ReorderWindow
+	}
+
+	switch opts.Transport {
+	case "", messages.TransportWebhook:
+		err = client.startWebhookListener(opts, listen)
+	case messages.TransportWebsocket:
+		err = client.startWebsocketListener(opts)
+	default:
+		err = fmt.Errorf("transport %v is not supported", opts.Transport)
+	}
+	if err != nil {
+		cancelHandlers()
+		return nil, err
+	}
+	//Twitch requires tokens to be validated hourly; these stop once handler contexts are cancelled by Close
+	go client.restClient.RunValidator(handlerCtx, 0, client.dispatchInvalidToken)
+	if opts.UserClient != nil {
+		go opts.UserClient.RunValidator(handlerCtx, 0, client.dispatchInvalidToken)
+	}
+	return client, nil
+}
+
+func (c *EventsubClient) startWebhookListener(opts NazunaOpts, listen bool) error {
 	//Create listener
 	var listener *webhooklistener.Listener
 	var err error
 	if opts.Secret == "" {
 		listener, err = webhooklistener.NewListener(opts.Permissive)
+		if err != nil {
+			return err
+		}
 		opts.Secret = listener.Secret()
+		c.log.Redactor().AddSecret(opts.Secret)
 	} else {
 		listener, err = webhooklistener.NewListenerWithSecret(opts.Secret, opts.Permissive)
+		if err != nil {
+			return err
+		}
 	}
-	if err != nil {
-		return nil, err
+	if opts.DedupStore != nil {
+		listener.SetDedupStore(opts.DedupStore)
 	}
-
-	//Create REST client
-	restclient := restclient.InitClient(opts.ClientID, opts.ClientSecret, opts.Scopes)
+	if opts.Journal != nil {
+		listener.SetJournal(opts.Journal)
+	}
+	listener.SetMetrics(opts.Metrics)
+	listener.SetTracer(c.tracer)
+	listener.SetLogger(c.log)
 
 	//Build transport definition
 	callbackURL, err := url.Parse(opts.ServerHostname)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	callbackURL.Path = opts.WebhookPath
-	transport := messages.TransportOpts{
-		Method:   "webhook",
+	c.transportOpts = messages.TransportOpts{
+		Method:   messages.TransportWebhook,
 		Callback: callbackURL.String(),
 		Secret:   opts.Secret,
 	}
 
-	client := EventsubClient{
-		listener:      *listener,
-		restClient:    *restclient,
-		transportOpts: transport,
+	c.listener = listener
+	go c.dispatchMessages()
+	if !listen {
+		return nil
+	}
+	if opts.TLSCertFile != "" && opts.TLSKeyFile != "" {
+		err = listener.ListenTLS(opts.WebhookPath, opts.ListenOn, opts.TLSCertFile, opts.TLSKeyFile)
+	} else {
+		err = listener.Listen(opts.WebhookPath, opts.ListenOn)
+	}
+	if err != nil {
+		listener.Shutdown(context.Background())
+		return err
 	}
+	return nil
+}
 
-	go client.dispatchMessages()
-	err = client.listener.Listen(opts.WebhookPath, opts.ListenOn)
+//startWebsocketListener connects to the EventSub WebSocket server. Twitch only accepts subscriptions using this
+//transport when they are created with a user access token, so they are managed using opts.UserClient.
+func (c *EventsubClient) startWebsocketListener(opts NazunaOpts) error {
+	c.subscriptionClient = opts.UserClient
+	listener := websocketlistener.NewListener(opts.WebsocketURL)
+	if opts.DedupStore != nil {
+		listener.SetDedupStore(opts.DedupStore)
+	}
+	if opts.Journal != nil {
+		listener.SetJournal(opts.Journal)
+	}
+	listener.SetMetrics(opts.Metrics)
+	listener.SetTracer(c.tracer)
+	listener.SetLogger(c.log)
+	c.listener = listener
+	go c.dispatchMessages()
+	sessionID, err := listener.Connect()
 	if err != nil {
-		return nil, err
+		listener.Shutdown(context.Background())
+		return err
+	}
+	c.transportOpts = messages.TransportOpts{
+		Method:    messages.TransportWebsocket,
+		SessionID: sessionID,
+	}
+	c.sessionSubscriptions = make(map[string]interface{})
+	listener.OnNewSession(c.resubscribe)
+	return nil
+}
+
+//resubscribe recreates the subscriptions made through this client after the websocket listener has been forced to start a
+//new session, as twitch deletes subscriptions belonging to the old session.
+func (c *EventsubClient) resubscribe(sessionID string) {
+	c.transportLock.Lock()
+	c.transportOpts.SessionID = sessionID
+	conditions := c.sessionSubscriptions
+	c.sessionSubscriptions = make(map[string]interface{})
+	c.transportLock.Unlock()
+
+	c.log.Infof("Recreating %v subscriptions for new websocket session %v", len(conditions), sessionID)
+	for _, condition := range conditions {
+		_, err := c.CreateSubscriptionContext(c.handlerCtx, condition)
+		if restclient.IsConflict(err) {
+			c.log.Debugf("Subscription for condition %#v already exists", condition)
+		} else if err != nil {
+			c.log.Warnf("Failed to recreate subscription for condition %#v due to error %v", condition, err)
+		}
+	}
+}
+
+//Close stops the listener from accepting new notifications, dispatches any notifications which were already
+//queued or in flight and waits for running handlers to return. If ctx expires before this completes, the contexts passed
+//to running handlers are cancelled and the context's error is returned.
+func (c *EventsubClient) Close(ctx context.Context) error {
+	//Handlers waiting to be retried will give up and be sent to the dead letter sinks
+	c.closeOnce.Do(func() { close(c.closing) })
+	c.queue.abandonRetries()
+	err := c.listener.Shutdown(ctx)
+
+	handlersDone := make(chan struct{})
+	go func() {
+		<-c.dispatchDone
+		c.runningWG.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+		c.cancelHandlers()
+		return err
+	case <-ctx.Done():
+		//Ask any handlers which are still running to give up
+		c.log.Warnf("Deadline reached whilst waiting for event handlers to finish")
+		c.cancelHandlers()
+		return ctx.Err()
+	}
+}
+
+//QueueStats returns counters describing the notifications waiting to be handled
+func (c *EventsubClient) QueueStats() QueueStats {
+	return c.queue.stats()
+}
+
+//RegisterHandler adds a handler to the handlers slice. Most handlers are more conveniently registered using On.
+func (c *EventsubClient) RegisterHandler(handler webhooklistener.WebhookHandler) *Registration {
+	return c.RegisterHandlerWithOpts(handler, HandlerOpts{})
+}
+
+//RegisterHandlerWithOpts adds a handler to the handlers slice, using opts to decide how its failures are dealt with.
+func (c *EventsubClient) RegisterHandlerWithOpts(handler webhooklistener.WebhookHandler, opts HandlerOpts) *Registration {
+	if opts.Name == "" {
+		opts.Name = handlerName(handler)
+	}
+
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	c.lastHandlerID++
+	registration := &Registration{
+		client: c,
+		id:     c.lastHandlerID,
+	}
+	//Handlers are copied on write, as workers hold on to the slice whilst dispatching
+	handlers := make([]registeredHandler, len(c.handlers), len(c.handlers)+1)
+	copy(handlers, c.handlers)
+	c.handlers = append(handlers, registeredHandler{
+		id:      registration.id,
+		handler: handler,
+		opts:    opts,
+	})
+	return registration
+}
+
+//OnDeadLetter registers a function to be called whenever a handler has failed to process a notification after
+//exhausting all of its retries.
+func (c *EventsubClient) OnDeadLetter(handler func(DeadLetter)) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	c.deadLetterHandlers = append(c.deadLetterHandlers, handler)
+}
+
+//OnHandlerError registers a function to be called whenever an attempt by a handler to process a notification fails,
+//including attempts which will be retried.
+func (c *EventsubClient) OnHandlerError(handler func(HandlerError)) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	c.handlerErrorHandlers = append(c.handlerErrorHandlers, handler)
+}
+
+//Handler returns an http.Handler which receives webhook notifications for this client, for use with NewHandlerClient.
+//Returns nil if the client is not using the webhook transport.
+func (c *EventsubClient) Handler() http.Handler {
+	if listener, ok := c.listener.(*webhooklistener.Listener); ok {
+		return listener.Handler()
+	}
+	return nil
+}
+
+//OnRevocation registers a function to be called whenever twitch revokes one of this client's subscriptions, after which no
+//more notifications will be recieved for it. The reason for the revocation is given by the subscription's Status field.
+func (c *EventsubClient) OnRevocation(handler func(*messages.Subscription)) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	c.revocationHandlers = append(c.revocationHandlers, handler)
+}
+
+//OnInvalidToken registers a function to be called if the hourly validation of the app access token, or of the user
+//access token held by opts.UserClient, finds that twitch no longer accepts it. An invalid app access token usually means
+//the client secret has been changed, and the client discards it and requests a new one before the function is called.
+//An invalid user access token can only be replaced by the user authorizing the application again.
+func (c *EventsubClient) OnInvalidToken(handler func(error)) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	c.invalidTokenHandlers = append(c.invalidTokenHandlers, handler)
+}
+
+func (c *EventsubClient) dispatchInvalidToken(err error) {
+	c.handlersLock.RLock()
+	handlers := c.invalidTokenHandlers
+	c.handlersLock.RUnlock()
+	for _, handler := range handlers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					c.log.Errorf("Invalid token handler panicked with %v\n%s", r, debug.Stack())
+				}
+			}()
+			handler(err)
+		}()
 	}
-	return &client, nil
-}
-
-//RegisterHandler adds a handler function to the handlers slice
-func (c *EventsubClient) RegisterHandler(handler interface{}) {
-	switch v := handler.(type) {
-	case func(*messages.Subscription, *messages.ChannelUpdateEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelUpdateHandler(v))
-	case func(*messages.Subscription, *messages.ChannelFollowEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelFollowHandler(v))
-	case func(*messages.Subscription, *messages.ChannelSubscribeEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelSubscribeHandler(v))
-	case func(*messages.Subscription, *messages.ChannelCheerEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelCheerHandler(v))
-	case func(*messages.Subscription, *messages.ChannelRaidEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelRaidHandler(v))
-	case func(*messages.Subscription, *messages.ChannelBanEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelBanHandler(v))
-	case func(*messages.Subscription, *messages.ChannelUnbanEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelUnbanHandler(v))
-	case func(*messages.Subscription, *messages.ChannelPointsCustomRewardAddEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelPointsCustomRewardAddHandler(v))
-	case func(*messages.Subscription, *messages.ChannelPointsCustomRewardUpdateEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelPointsCustomRewardUpdateHandler(v))
-	case func(*messages.Subscription, *messages.ChannelPointsCustomRewardRemoveEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelPointsCustomRewardRemoveHandler(v))
-	case func(*messages.Subscription, *messages.ChannelPointsCustomRewardRedemptionAddEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelPointsCustomRewardRedemptionAddHandler(v))
-	case func(*messages.Subscription, *messages.ChannelPointsCustomRewardRedemptionUpdateEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelPointsCustomRewardRedemptionUpdateHandler(v))
-	case func(*messages.Subscription, *messages.ChannelHypeTrainBeginEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelHypeTrainBeginHandler(v))
-	case func(*messages.Subscription, *messages.ChannelHypeTrainProgressEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelHypeTrainProgressHandler(v))
-	case func(*messages.Subscription, *messages.ChannelHypeTrainEndEvent):
-		c.handlers = append(c.handlers, webhooklistener.ChannelHypeTrainEndHandler(v))
-	case func(*messages.Subscription, *messages.StreamOnlineEvent):
-		c.handlers = append(c.handlers, webhooklistener.StreamOnlineHandler(v))
-	case func(*messages.Subscription, *messages.StreamOfflineEvent):
-		c.handlers = append(c.handlers, webhooklistener.StreamOfflineHandler(v))
-	case func(*messages.Subscription, *messages.UserAuthorizationRevokeEvent):
-		c.handlers = append(c.handlers, webhooklistener.UserAuthorizationRevokeHandler(v))
-	case func(*messages.Subscription, *messages.UserUpdateEvent):
-		c.handlers = append(c.handlers, webhooklistener.UserUpdateHandler(v))
-	}
-}
-
-//CreateSubscription creates a new EventSub subscription for the provided event condition
+}
+
+//CreateSubscription creates a new EventSub subscription for the provided event condition. If an identical
+//subscription already exists, the returned error satisfies restclient.IsConflict.
 func (c *EventsubClient) CreateSubscription(condition interface{}) (*messages.SubscriptionRequestStatus, error) {
-	return c.restClient.CreateSubscription(condition, c.transportOpts)
+	return c.CreateSubscriptionContext(context.Background(), condition)
+}
+
+//CreateSubscriptionContext is CreateSubscription, making the request using ctx
+func (c *EventsubClient) CreateSubscriptionContext(ctx context.Context, condition interface{}) (*messages.SubscriptionRequestStatus, error) {
+	c.transportLock.RLock()
+	transport := c.transportOpts
+	c.transportLock.RUnlock()
+
+	status, err := c.subscriptionClient.CreateSubscriptionContext(ctx, condition, transport)
+	if err == nil && status != nil && transport.Method == messages.TransportWebsocket {
+		//Keep track of websocket subscriptions so they can be recreated if the session is lost
+		c.transportLock.Lock()
+		for _, sub := range status.Data {
+			c.sessionSubscriptions[sub.ID] = condition
+		}
+		c.transportLock.Unlock()
+	}
+	return status, err
 }
 
 //Subscriptions returns a list of EventSub subscriptions registered to this client which match the provided filters
 func (c *EventsubClient) Subscriptions(filters restclient.SubscriptionsParams) chan restclient.SubscriptionResult {
-	return c.restClient.Subscriptions(&filters)
+	return c.subscriptionClient.Subscriptions(&filters)
+}
+
+//SubscriptionsContext is Subscriptions, making the requests using ctx. Cancelling ctx closes the channel.
+func (c *EventsubClient) SubscriptionsContext(ctx context.Context, filters restclient.SubscriptionsParams) chan restclient.SubscriptionResult {
+	return c.subscriptionClient.SubscriptionsContext(ctx, &filters)
+}
+
+//SubscriptionsPaginator returns a Paginator over the EventSub subscriptions registered to this client which match the
+//provided filters
+func (c *EventsubClient) SubscriptionsPaginator(ctx context.Context, filters restclient.SubscriptionsParams, opts restclient.PaginatorOpts) *restclient.Paginator[messages.Subscription] {
+	return c.subscriptionClient.SubscriptionsPaginator(ctx, &filters, opts)
 }
 
 //DeleteSubscription unsubscribes from the EventSub subscription corresponding to the provided ID
 func (c *EventsubClient) DeleteSubscription(subscriptionID string) error {
-	return c.restClient.DeleteSubscription(subscriptionID)
+	return c.DeleteSubscriptionContext(context.Background(), subscriptionID)
+}
+
+//DeleteSubscriptionContext is DeleteSubscription, making the request using ctx
+func (c *EventsubClient) DeleteSubscriptionContext(ctx context.Context, subscriptionID string) error {
+	err := c.subscriptionClient.DeleteSubscriptionContext(ctx, subscriptionID)
+	if err == nil {
+		c.transportLock.Lock()
+		delete(c.sessionSubscriptions, subscriptionID)
+		c.transportLock.Unlock()
+	}
+	return err
 }
 
 //ClearSubscriptions unsubscribes from all EventSub subscriptions
 func (c *EventsubClient) ClearSubscriptions() error {
-	for res := range c.Subscriptions(restclient.SubscriptionsParams{}) {
-		if res.Err != nil {
-			return res.Err
-		}
-		c.DeleteSubscription(res.Subscription.ID)
+	return c.ClearSubscriptionsContext(context.Background())
+}
+
+//ClearSubscriptionsContext is ClearSubscriptions, making the requests using ctx
+func (c *EventsubClient) ClearSubscriptionsContext(ctx context.Context) error {
+	subs := c.SubscriptionsPaginator(ctx, restclient.SubscriptionsParams{}, restclient.PaginatorOpts{})
+	defer subs.Close()
+	for subs.Next() {
+		c.DeleteSubscriptionContext(ctx, subs.Item().ID)
 	}
-	return nil
+	return subs.Err()
+}
+
+//NewTenantClient returns a client which makes requests on behalf of the broadcasters whose tokens are held in flow's
+//TokenStore, falling back to this client's app access token where allowed
+func (c *EventsubClient) NewTenantClient(flow *restclient.AuthCodeFlow) (*restclient.TenantClient, error) {
+	return restclient.NewTenantClient(&c.restClient, flow)
 }
 
 //GetUsers returns a list of users who correspond to the provided user IDs or names
@@ -152,27 +534,41 @@ func (c *EventsubClient) GetUsers(ids, names []string) ([]restclient.TwitchUser,
 	return c.restClient.GetUsers(ids, names)
 }
 
+//GetUsersContext is GetUsers, making the request using ctx. Passing the context given to a handler links the request
+//to the handler's span when tracing is enabled.
+func (c *EventsubClient) GetUsersContext(ctx context.Context, ids, names []string) ([]restclient.TwitchUser, error) {
+	return c.restClient.GetUsersContext(ctx, ids, names)
+}
+
 //GetStreams takes a set of query options and returns a slice of matching twitchstreams
 func (c *EventsubClient) GetStreams(filters restclient.GetStreamsOpts) ([]restclient.TwitchStream, error) {
-	var streams []restclient.TwitchStream
-	for res := range c.restClient.GetStreamsIter(filters) {
-		if res.Err != nil {
-			return nil, res.Err
-		}
-		streams = append(streams, *res.Stream)
-	}
-	return streams, nil
+	return c.GetStreamsContext(context.Background(), filters)
+}
+
+//GetStreamsContext is GetStreams, making the requests using ctx
+func (c *EventsubClient) GetStreamsContext(ctx context.Context, filters restclient.GetStreamsOpts) ([]restclient.TwitchStream, error) {
+	return c.restClient.GetStreamsContext(ctx, filters)
+}
+
+//GetStreamsPaginator returns a Paginator over the streams which match the provided options
+func (c *EventsubClient) GetStreamsPaginator(ctx context.Context, filters restclient.GetStreamsOpts, opts restclient.PaginatorOpts) *restclient.Paginator[restclient.TwitchStream] {
+	return c.restClient.GetStreamsPaginator(ctx, filters, opts)
 }
 
 var broadcasterURLRegex = regexp.MustCompile(`(?:https?://)?(?:(?:www|go|m)\.)?twitch\.tv/(?P<username>[a-zA-Z0-9_]{4,25})`)
 
 //GetBroadcaster looks up a twitch user by either their name or channel url.
 func (c *EventsubClient) GetBroadcaster(urlOrName string) (*restclient.TwitchUser, error) {
+	return c.GetBroadcasterContext(context.Background(), urlOrName)
+}
+
+//GetBroadcasterContext is GetBroadcaster, making the request using ctx
+func (c *EventsubClient) GetBroadcasterContext(ctx context.Context, urlOrName string) (*restclient.TwitchUser, error) {
 	matches := broadcasterURLRegex.FindStringSubmatch(urlOrName)
 	switch {
 	case matches == nil:
 		//Regex did not match, so assume we have a username directly
-		users, err := c.GetUsers([]string{}, []string{urlOrName})
+		users, err := c.GetUsersContext(ctx, []string{}, []string{urlOrName})
 		if err != nil {
 			return nil, fmt.Errorf("%v does not appear to be a twitch url, so assuming it is a username; fetching user data failed due to %v", urlOrName, err)
 		}
@@ -180,7 +576,7 @@ func (c *EventsubClient) GetBroadcaster(urlOrName string) (*restclient.TwitchUse
 	case matches[1] != "":
 		//Regex matches, so we have a url
 		username := matches[1]
-		users, err := c.GetUsers([]string{}, []string{username})
+		users, err := c.GetUsersContext(ctx, []string{}, []string{username})
 		if err != nil {
 			return nil, fmt.Errorf("extracted username %v from the provided twitch url; fetching user data failed due to %v", username, err)
 		}
@@ -190,25 +586,232 @@ func (c *EventsubClient) GetBroadcaster(urlOrName string) (*restclient.TwitchUse
 	}
 }
 
+//dispatchMessages moves notifications from the listener into the dispatch queue, starting workers to handle them
+//and closing the queue once the listener has shut down.
 func (c *EventsubClient) dispatchMessages() {
-	for {
+	defer close(c.dispatchDone)
+	for i := 0; i < c.workers; i++ {
+		c.runningWG.Add(1)
+		go c.runWorker()
+	}
+	defer c.queue.close()
+	c.replayJournal()
+
+	var reorder *reorderBuffer
+	if c.reorderWindow > 0 {
+		reorder = &reorderBuffer{window: c.reorderWindow}
+	}
+	releaseTimer := time.NewTimer(0)
+	defer releaseTimer.Stop()
+	var releaseC <-chan time.Time
+
+	notifications := c.listener.NotificationsChannel()
+	revocations := c.listener.RevocationsChannel()
+	for notifications != nil || revocations != nil {
 		select {
-		case msg, open := <-c.listener.NotificationsChannel():
+		case msg, open := <-notifications:
+			if open && reorder != nil {
+				reorder.add(msg, time.Now())
+			} else if open {
+				c.log.Debugf("Queueing message %v", msg)
+				c.queue.push(msg)
+			} else {
+				notifications = nil
+			}
+		case <-releaseC:
+			releaseC = nil
+		case sub, open := <-revocations:
 			if open {
-				logrus.Debugf("Dispatching message %v", msg)
-				c.dispatchMessage(msg)
+				c.log.Debugf("Dispatching revocation of subscription %v", sub.ID)
+				c.dispatchRevocation(sub)
 			} else {
-				logrus.Info("Stopping message dispatch due to closed channel")
-				return
+				revocations = nil
+			}
+		}
+
+		if reorder != nil {
+			for _, msg := range reorder.release(time.Now()) {
+				c.queue.push(msg)
+			}
+			if next, ok := reorder.nextRelease(); ok && releaseC == nil {
+				if !releaseTimer.Stop() {
+					select {
+					case <-releaseTimer.C:
+					default:
+					}
+				}
+				releaseTimer.Reset(time.Until(next))
+				releaseC = releaseTimer.C
 			}
 		}
 	}
+	if reorder != nil {
+		for _, msg := range reorder.flush() {
+			c.queue.push(msg)
+		}
+	}
+	c.log.Info("Stopping message dispatch due to closed channel")
+}
+
+//replayJournal queues any notifications which were journalled but not fully handled before the client last stopped
+func (c *EventsubClient) replayJournal() {
+	if c.journal == nil {
+		return
+	}
+	pending, err := c.journal.Pending()
+	if err != nil {
+		c.log.Errorf("Failed to read pending notifications from journal due to error %v", err)
+		return
+	}
+	if len(pending) > 0 {
+		c.log.Infof("Redispatching %v notifications from the journal", len(pending))
+	}
+	for _, msg := range pending {
+		c.queue.push(msg)
+	}
+}
+
+func (c *EventsubClient) runWorker() {
+	defer c.runningWG.Done()
+	//Notifications are claimed by the ordered dispatcher as they are popped, so that two workers cannot race to
+	//dispatch notifications sharing a key out of order
+	var claim func(messages.EventNotificationMessage) bool
+	if c.ordered != nil {
+		claim = c.ordered.claim
+	}
+	for {
+		msg, task, ok := c.queue.pop(claim)
+		if !ok {
+			return
+		}
+		if task != nil {
+			task()
+			continue
+		}
+		c.log.Debugf("Dispatching message %v", msg)
+		c.dispatchMessage(msg)
+	}
 }
 
 func (c *EventsubClient) dispatchMessage(message messages.EventNotificationMessage) {
+	c.handlersLock.RLock()
+	handlers := c.handlers
+	middleware := c.middleware
+	c.handlersLock.RUnlock()
+
+	//pending counts the handlers which have not yet succeeded or been given up on, plus one for the dispatch itself, so
+	//that the notification is only completed once any retries have finished
+	pending := int32(1)
+	var abandoned int32
+	finish := func(wasAbandoned bool) {
+		if wasAbandoned {
+			atomic.StoreInt32(&abandoned, 1)
+		}
+		if atomic.AddInt32(&pending, -1) == 0 {
+			c.completeMessage(message, atomic.LoadInt32(&abandoned) == 1)
+			c.releaseMessage(message)
+		}
+	}
+	dispatch := func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		handlers := matchingHandlers(handlers, msg.Subscription.Type)
+		atomic.AddInt32(&pending, int32(len(handlers)))
+		var wg sync.WaitGroup
+		var errLock sync.Mutex
+		failed := 0
+		var lastErr error
+		//Each handler runs in its own goroutine so that a slow handler does not hold up the others
+		for _, handler := range handlers {
+			wg.Add(1)
+			go func(handler registeredHandler) {
+				defer wg.Done()
+				err := c.runHandler(ctx, handler, *msg, finish)
+				if err != nil {
+					errLock.Lock()
+					failed++
+					lastErr = err
+					errLock.Unlock()
+				}
+			}(handler)
+		}
+		wg.Wait()
+		if failed > 0 {
+			return fmt.Errorf("%v handlers failed, most recently with error %w", failed, lastErr)
+		}
+		return nil
+	}
+	ctx := logging.NewContext(c.handlerCtx, c.log.WithFields(logging.MessageFields(&message)))
+	if message.SpanContext.IsValid() {
+		ctx = tracing.ContextWithSpanContext(ctx, message.SpanContext)
+	}
+	err := chainMiddleware(middleware, dispatch)(ctx, &message)
+	if err != nil {
+		c.log.Debugf("Dispatch of message %v completed with error %v", message.MessageID, err)
+	}
+	finish(false)
+}
+
+//matchingHandlers returns the handlers which accept notifications of the given subscription type, so that no attempt
+//is recorded for handlers which would ignore the notification
+func matchingHandlers(handlers []registeredHandler, subscriptionType string) []registeredHandler {
+	matching := make([]registeredHandler, 0, len(handlers))
+	for _, h := range handlers {
+		if handlerType := h.handler.Type(); handlerType == "" || handlerType == subscriptionType {
+			matching = append(matching, h)
+		}
+	}
+	return matching
+}
+
+//completeMessage is called once every handler has finished with a notification, including any retries. abandoned is
+//set if any handler was given up on because the client is closing.
+func (c *EventsubClient) completeMessage(message messages.EventNotificationMessage, abandoned bool) {
+	if c.journal == nil || message.MessageID == "" {
+		return
+	}
+	//A notification whose handling was cut short by Close is left in the journal so that it is dispatched again on the
+	//next start
+	if abandoned || c.handlerCtx.Err() != nil {
+		c.log.Infof("Leaving notification %v in the journal as its handling was interrupted by the client closing", message.MessageID)
+		return
+	}
+	err := c.journal.Done(message.MessageID)
+	if err != nil {
+		c.log.Warnf("Failed to mark notification %v as done in journal due to error %v", message.MessageID, err)
+	}
+}
+
+//releaseMessage lets the next notification sharing an ordering key be dispatched once every handler has finished with
+//message. It is queued as a task, as this may be called from Close whilst abandoning retries.
+func (c *EventsubClient) releaseMessage(message messages.EventNotificationMessage) {
+	if c.ordered == nil {
+		return
+	}
+	if next, ok := c.ordered.release(message); ok {
+		c.queue.pushTask(func() {
+			c.log.Debugf("Dispatching message %v", next)
+			c.dispatchMessage(next)
+		})
+	}
+}
+
+func (c *EventsubClient) dispatchRevocation(subscription messages.Subscription) {
+	//Revoked subscriptions should not be recreated if the websocket session is lost
+	c.transportLock.Lock()
+	delete(c.sessionSubscriptions, subscription.ID)
+	c.transportLock.Unlock()
+
 	c.handlersLock.RLock()
 	defer c.handlersLock.RUnlock()
-	for _, handler := range c.handlers {
-		go handler.Handle(message)
+	for _, handler := range c.revocationHandlers {
+		c.runningWG.Add(1)
+		go func(handler func(*messages.Subscription)) {
+			defer c.runningWG.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					c.log.Errorf("Revocation handler panicked with %v\n%s", r, debug.Stack())
+				}
+			}()
+			handler(&subscription)
+		}(handler)
 	}
 }
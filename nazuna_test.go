@@ -0,0 +1,455 @@
+package nazuna
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/messages"
+	"github.com/callummance/nazuna/restclient"
+	"github.com/callummance/nazuna/tokenstore"
+	"github.com/callummance/nazuna/tracing"
+	"github.com/callummance/nazuna/webhooklistener"
+	"github.com/gorilla/websocket"
+	"golang.org/x/oauth2"
+)
+
+const testWebhookSecret = "webhook-secret"
+
+const testOnlineBody = `{"subscription":{"id":"sub","type":"stream.online","version":"1","status":"enabled"},"event":{"broadcaster_user_id":"1234","type":"live"}}`
+
+//redirectTransport sends every request to target, whatever host it was addressed to
+type redirectTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return t.base.RoundTrip(req)
+}
+
+//fakeTwitch stands in for the twitch OAuth server and Helix API, receiving every request sent through
+//http.DefaultTransport until the test ends. App access tokens are issued as the client ID followed by "-token", and
+//Get Users returns a user for the requested ID.
+type fakeTwitch struct {
+	lock              sync.Mutex
+	rejectCredentials bool
+	tokenRequests     int
+	//validated holds the Authorization header of each validation request
+	validated []string
+	//subscribed holds the transport of each subscription created
+	subscribed []messages.TransportOpts
+}
+
+func newFakeTwitch(t *testing.T) *fakeTwitch {
+	f := &fakeTwitch{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		f.tokenRequests++
+		reject := f.rejectCredentials
+		f.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if reject {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"status":403,"message":"invalid client secret"}`))
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"%v-token","token_type":"bearer","expires_in":3600}`, r.FormValue("client_id"))
+	})
+	mux.HandleFunc("/oauth2/validate", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		f.validated = append(f.validated, r.Header.Get("Authorization"))
+		f.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"client_id":"client","scopes":[],"expires_in":3600}`))
+	})
+	mux.HandleFunc("/helix/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"data":[{"id":"%v","login":"nazuna"}]}`, r.URL.Query().Get("id"))
+	})
+	mux.HandleFunc("/helix/eventsub/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		var sub messages.Subscription
+		json.NewDecoder(r.Body).Decode(&sub)
+		f.lock.Lock()
+		f.subscribed = append(f.subscribed, sub.Transport)
+		id := len(f.subscribed)
+		f.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"data":[{"id":"sub%v","type":"%v","version":"1","status":"enabled"}],"total":%v,"limit":10000}`, id, sub.Type, id)
+	})
+	server := httptest.NewServer(mux)
+	target, _ := url.Parse(server.URL)
+	original := http.DefaultTransport
+	http.DefaultTransport = redirectTransport{target: target, base: server.Client().Transport}
+	t.Cleanup(func() {
+		http.DefaultTransport = original
+		server.Close()
+	})
+	return f
+}
+
+//newTestClient creates a client using the webhook transport without starting a server, closing it when the test ends
+func newTestClient(t *testing.T, opts NazunaOpts) *EventsubClient {
+	t.Helper()
+	opts.ClientID = "client"
+	opts.ClientSecret = "client-secret"
+	opts.Secret = testWebhookSecret
+	opts.ServerHostname = "https://example.com"
+	opts.WebhookPath = "/webhook"
+	c, err := NewHandlerClient(opts)
+	if err != nil {
+		t.Fatalf("NewHandlerClient() error = %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c.Close(ctx)
+	})
+	return c
+}
+
+//signWebhook adds the headers twitch sends with a webhook message to req, signed with testWebhookSecret
+func signWebhook(req *http.Request, msgType, msgID, body string) {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(msgID + timestamp + body))
+	req.Header.Set("Twitch-Eventsub-Message-Type", msgType)
+	req.Header.Set("Twitch-Eventsub-Message-Id", msgID)
+	req.Header.Set("Twitch-Eventsub-Message-Timestamp", timestamp)
+	req.Header.Set("Twitch-Eventsub-Message-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestHandlerMountedOnExistingServer(t *testing.T) {
+	newFakeTwitch(t)
+	c := newTestClient(t, NazunaOpts{})
+	handled := make(chan string, 1)
+	c.RegisterHandler(webhooklistener.NotificationHandler(func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		handled <- msg.MessageID
+		return nil
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", c.Handler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/webhook", strings.NewReader(testOnlineBody))
+	signWebhook(req, "notification", "n1", testOnlineBody)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("failed to deliver notification: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("server responded %v, want 200", resp.StatusCode)
+	}
+	select {
+	case id := <-handled:
+		if id != "n1" {
+			t.Errorf("handler was passed %v, want n1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler was not called")
+	}
+}
+
+func TestNewHandlerClientRejectsWebsocket(t *testing.T) {
+	twitch := newFakeTwitch(t)
+	_, err := NewHandlerClient(NazunaOpts{ClientID: "client", ClientSecret: "client-secret", Transport: messages.TransportWebsocket})
+	if err == nil {
+		t.Fatal("NewHandlerClient() error = nil for the websocket transport")
+	}
+	if twitch.tokenRequests != 0 {
+		t.Errorf("%v tokens were requested, want the transport to be rejected first", twitch.tokenRequests)
+	}
+}
+
+func testNotification(id string) messages.EventNotificationMessage {
+	msg := messages.EventNotificationMessage{
+		Subscription: messages.Subscription{ID: "sub", Type: messages.SubscriptionStreamOnline},
+		Event:        &messages.StreamOnlineEvent{BroadcasterUID: "1234"},
+	}
+	msg.MessageID = id
+	return msg
+}
+
+//pushNotification passes a notification to the client as though its listener had received it
+func pushNotification(t *testing.T, c *EventsubClient, msg messages.EventNotificationMessage) {
+	t.Helper()
+	select {
+	case c.listener.NotificationsChannel() <- msg:
+	case <-time.After(time.Second):
+		t.Fatal("client did not accept the notification")
+	}
+}
+
+func TestCloseWaitsForHandlers(t *testing.T) {
+	newFakeTwitch(t)
+	c := newTestClient(t, NazunaOpts{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c.RegisterHandler(webhooklistener.NotificationHandler(func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		close(started)
+		<-release
+		return nil
+	}))
+	pushNotification(t, c, testNotification("a"))
+	<-started
+
+	closed := make(chan error)
+	go func() { closed <- c.Close(context.Background()) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close() = %v whilst a handler was running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, open := <-c.listener.NotificationsChannel(); open {
+		t.Error("notifications channel is still open after Close began")
+	}
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close() did not return once the handler had finished")
+	}
+}
+
+func TestCloseDeadline(t *testing.T) {
+	newFakeTwitch(t)
+	c := newTestClient(t, NazunaOpts{})
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	c.RegisterHandler(webhooklistener.NotificationHandler(func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		close(started)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	}))
+	pushNotification(t, c, testNotification("a"))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("handler context error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not cancelled at the deadline")
+	}
+}
+
+func TestRevocationReachesHandlers(t *testing.T) {
+	newFakeTwitch(t)
+	c := newTestClient(t, NazunaOpts{})
+	//Subscriptions are only remembered for the websocket transport, but revocations are handled in the same way
+	c.transportLock.Lock()
+	c.sessionSubscriptions = map[string]interface{}{"sub": "revoked", "other": "kept"}
+	c.transportLock.Unlock()
+	revoked := make(chan *messages.Subscription, 1)
+	c.OnRevocation(func(sub *messages.Subscription) { revoked <- sub })
+
+	body := `{"subscription":{"id":"sub","type":"stream.online","version":"1","status":"authorization_revoked"}}`
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(body))
+	signWebhook(req, "revocation", "r1", body)
+	rec := httptest.NewRecorder()
+	c.Handler().ServeHTTP(rec, req)
+	if rec.Code < 200 || rec.Code > 299 {
+		t.Errorf("revocation responded %v, want a 2xx status", rec.Code)
+	}
+	select {
+	case sub := <-revoked:
+		if sub.ID != "sub" || sub.Status != "authorization_revoked" {
+			t.Errorf("OnRevocation was passed %+v, want subscription sub with status authorization_revoked", sub)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnRevocation handler was not called")
+	}
+	c.transportLock.RLock()
+	defer c.transportLock.RUnlock()
+	if _, ok := c.sessionSubscriptions["sub"]; ok {
+		t.Error("revoked subscription would be recreated for a new session")
+	}
+	if _, ok := c.sessionSubscriptions["other"]; !ok {
+		t.Error("subscription which was not revoked was forgotten")
+	}
+}
+
+func TestNewClientRejectsCredentials(t *testing.T) {
+	twitch := newFakeTwitch(t)
+	twitch.rejectCredentials = true
+	_, err := NewClient(NazunaOpts{ClientID: "client", ClientSecret: "wrong", ListenOn: "127.0.0.1:0", WebhookPath: "/webhook"})
+	var credErr *restclient.CredentialsError
+	if !errors.As(err, &credErr) || credErr.Message != "invalid client secret" {
+		t.Errorf("NewClient() error = %v, want a *restclient.CredentialsError", err)
+	}
+}
+
+func TestClientValidatesUserToken(t *testing.T) {
+	twitch := newFakeTwitch(t)
+	store := tokenstore.NewMemoryStore()
+	store.Put("1234", tokenstore.NewToken(&oauth2.Token{AccessToken: "user-token", Expiry: time.Now().Add(time.Hour)}))
+	flow := restclient.NewAuthCodeFlow(restclient.AuthCodeConfig{ClientID: "client", ClientSecret: "client-secret", TokenStore: store}, logging.Default())
+	userClient, err := flow.UserClient("1234")
+	if err != nil {
+		t.Fatalf("UserClient() error = %v", err)
+	}
+	newTestClient(t, NazunaOpts{UserClient: userClient})
+
+	want := map[string]bool{"OAuth client-token": true, "OAuth user-token": true}
+	deadline := time.Now().Add(time.Second)
+	for {
+		twitch.lock.Lock()
+		validated := map[string]bool{}
+		for _, auth := range twitch.validated {
+			validated[auth] = true
+		}
+		twitch.lock.Unlock()
+		if reflect.DeepEqual(validated, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("validated tokens %v, want %v", validated, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTracingParentage(t *testing.T) {
+	newFakeTwitch(t)
+	tracer := tracing.NewMemoryTracer()
+	c := newTestClient(t, NazunaOpts{Tracer: tracer})
+	c.RegisterHandler(webhooklistener.NotificationHandler(func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		_, err := c.GetUsersContext(ctx, []string{"1234"}, nil)
+		return err
+	}))
+
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(testOnlineBody))
+	signWebhook(req, "notification", "n1", testOnlineBody)
+	c.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := map[string]tracing.SpanData{}
+	deadline := time.Now().Add(time.Second)
+	for len(spans) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		for _, span := range tracer.Spans() {
+			spans[span.Name] = span
+		}
+	}
+	webhook, handler, helix := spans["eventsub.webhook"], spans["eventsub.handler"], spans["helix GET /helix/users"]
+	if !webhook.SpanContext.IsValid() || !handler.SpanContext.IsValid() || !helix.SpanContext.IsValid() {
+		t.Fatalf("recorded spans %v, want the webhook, handler and Helix request spans", spans)
+	}
+	if handler.Parent != webhook.SpanContext.SpanID || handler.SpanContext.TraceID != webhook.SpanContext.TraceID {
+		t.Errorf("handler span has parent %v, want the webhook span %v", handler.Parent, webhook.SpanContext.SpanID)
+	}
+	if helix.Parent != handler.SpanContext.SpanID || helix.SpanContext.TraceID != webhook.SpanContext.TraceID {
+		t.Errorf("Helix request span has parent %v, want the handler span %v", helix.Parent, handler.SpanContext.SpanID)
+	}
+}
+
+func TestResubscribeOnNewSession(t *testing.T) {
+	twitch := newFakeTwitch(t)
+	//Stand in for the EventSub WebSocket server, welcoming the first connection to session s1 and the next to s2
+	conns := make(chan *websocket.Conn, 2)
+	upgrader := websocket.Upgrader{}
+	var sessions int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade connection: %v", err)
+			return
+		}
+		sessions++
+		welcome := fmt.Sprintf(`{"metadata":{"message_id":"w%[1]v","message_type":"session_welcome","message_timestamp":"%[2]v"},"payload":{"session":{"id":"s%[1]v","status":"connected","keepalive_timeout_seconds":10}}}`,
+			sessions, time.Now().UTC().Format(time.RFC3339Nano))
+		conn.WriteMessage(websocket.TextMessage, []byte(welcome))
+		conns <- conn
+	}))
+	defer server.Close()
+
+	store := tokenstore.NewMemoryStore()
+	store.Put("1234", tokenstore.NewToken(&oauth2.Token{AccessToken: "user-token", Expiry: time.Now().Add(time.Hour)}))
+	flow := restclient.NewAuthCodeFlow(restclient.AuthCodeConfig{ClientID: "client", ClientSecret: "client-secret", TokenStore: store}, logging.Default())
+	userClient, err := flow.UserClient("1234")
+	if err != nil {
+		t.Fatalf("UserClient() error = %v", err)
+	}
+	c, err := NewClient(NazunaOpts{
+		ClientID:     "client",
+		ClientSecret: "client-secret",
+		Transport:    messages.TransportWebsocket,
+		WebsocketURL: "ws" + strings.TrimPrefix(server.URL, "http"),
+		UserClient:   userClient,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c.Close(ctx)
+	}()
+	first := <-conns
+	defer first.Close()
+
+	if _, err := c.CreateSubscription(messages.ConditionStreamOnline{BroadcasterUID: "1234"}); err != nil {
+		t.Fatalf("CreateSubscription() error = %v", err)
+	}
+	//Losing the connection loses the session, along with its subscriptions
+	first.Close()
+	select {
+	case second := <-conns:
+		defer second.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener did not reconnect")
+	}
+
+	want := []messages.TransportOpts{
+		{Method: messages.TransportWebsocket, SessionID: "s1"},
+		{Method: messages.TransportWebsocket, SessionID: "s2"},
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		twitch.lock.Lock()
+		subscribed := append([]messages.TransportOpts(nil), twitch.subscribed...)
+		twitch.lock.Unlock()
+		if reflect.DeepEqual(subscribed, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriptions were created with transports %+v, want %+v", subscribed, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.transportLock.RLock()
+	defer c.transportLock.RUnlock()
+	if _, ok := c.sessionSubscriptions["sub2"]; len(c.sessionSubscriptions) != 1 || !ok {
+		t.Errorf("remembered subscriptions %v, want only the recreated sub2", c.sessionSubscriptions)
+	}
+}
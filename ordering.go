@@ -0,0 +1,148 @@
+package nazuna
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/callummance/nazuna/messages"
+)
+
+//OrderingOpts configures ordered dispatch, in which notifications sharing a key are passed to handlers one at a time
+//in the order they were recieved, whilst notifications with different keys are still handled in parallel. A
+//notification is not passed to handlers until every handler has finished with the one before it, including any retries.
+type OrderingOpts struct {
+	//Enabled turns on ordered dispatch
+	Enabled bool
+	//Key picks the key notifications are serialized by, defaulting to the ID of the broadcaster the event belongs to.
+	//Notifications with an empty key are not serialized.
+	Key func(msg *messages.EventNotificationMessage) string
+	//ReorderWindow, if set, holds each notification back for this long so that any which twitch sent earlier but
+	//which arrived later can be dispatched first, sorting by the message timestamp. It is ignored unless Enabled is set.
+	ReorderWindow time.Duration
+}
+
+//defaultOrderKey serializes notifications by broadcaster
+func defaultOrderKey(msg *messages.EventNotificationMessage) string {
+	return msg.BroadcasterID()
+}
+
+//orderedDispatcher ensures that only one notification with each key is being dispatched at a time
+type orderedDispatcher struct {
+	lock sync.Mutex
+	key  func(msg *messages.EventNotificationMessage) string
+	//active contains an entry for each key currently being dispatched, holding the notifications waiting behind it
+	active map[string][]messages.EventNotificationMessage
+}
+
+func newOrderedDispatcher(opts OrderingOpts) *orderedDispatcher {
+	key := opts.Key
+	if key == nil {
+		key = defaultOrderKey
+	}
+	return &orderedDispatcher{
+		key:    key,
+		active: make(map[string][]messages.EventNotificationMessage),
+	}
+}
+
+//claim is called by the dispatch queue as msg is popped, whilst still holding the queue's lock, so that notifications
+//with the same key are claimed in the order they were queued. Returns true if the caller should dispatch msg, or false
+//if another notification with the same key is still being handled, in which case msg waits until that notification is
+//released.
+func (o *orderedDispatcher) claim(msg messages.EventNotificationMessage) bool {
+	key := o.key(&msg)
+	if key == "" {
+		return true
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if waiting, busy := o.active[key]; busy {
+		o.active[key] = append(waiting, msg)
+		return false
+	}
+	o.active[key] = nil
+	return true
+}
+
+//release is called once every handler has finished with a claimed notification, including any retries. It returns
+//the next notification waiting behind it, which has been claimed on behalf of the caller, or false if there is none.
+func (o *orderedDispatcher) release(msg messages.EventNotificationMessage) (messages.EventNotificationMessage, bool) {
+	key := o.key(&msg)
+	if key == "" {
+		return messages.EventNotificationMessage{}, false
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	waiting := o.active[key]
+	if len(waiting) == 0 {
+		delete(o.active, key)
+		return messages.EventNotificationMessage{}, false
+	}
+	o.active[key] = waiting[1:]
+	return waiting[0], true
+}
+
+type bufferedNotification struct {
+	msg       messages.EventNotificationMessage
+	releaseAt time.Time
+}
+
+//reorderBuffer holds notifications back for a fixed window, releasing them sorted by message timestamp.
+//It is only used from the dispatchMessages goroutine so needs no locking.
+type reorderBuffer struct {
+	window time.Duration
+	items  []bufferedNotification
+}
+
+//add buffers a notification, keeping the buffer sorted by message timestamp
+func (b *reorderBuffer) add(msg messages.EventNotificationMessage, now time.Time) {
+	i := sort.Search(len(b.items), func(i int) bool {
+		return b.items[i].msg.MessageTimestamp.After(msg.MessageTimestamp)
+	})
+	b.items = append(b.items, bufferedNotification{})
+	copy(b.items[i+1:], b.items[i:])
+	b.items[i] = bufferedNotification{msg: msg, releaseAt: now.Add(b.window)}
+}
+
+//release removes the notifications which are ready to be dispatched. Once any notification's window has passed, it and
+//every notification with an earlier timestamp are released.
+func (b *reorderBuffer) release(now time.Time) []messages.EventNotificationMessage {
+	last := -1
+	for i, item := range b.items {
+		if !item.releaseAt.After(now) {
+			last = i
+		}
+	}
+	return b.take(last + 1)
+}
+
+//flush removes every buffered notification
+func (b *reorderBuffer) flush() []messages.EventNotificationMessage {
+	return b.take(len(b.items))
+}
+
+func (b *reorderBuffer) take(n int) []messages.EventNotificationMessage {
+	released := make([]messages.EventNotificationMessage, n)
+	for i := range released {
+		released[i] = b.items[i].msg
+	}
+	b.items = b.items[n:]
+	return released
+}
+
+//nextRelease returns the earliest time at which a buffered notification's window will pass, or false if the buffer is empty
+func (b *reorderBuffer) nextRelease() (time.Time, bool) {
+	if len(b.items) == 0 {
+		return time.Time{}, false
+	}
+	next := b.items[0].releaseAt
+	for _, item := range b.items[1:] {
+		if item.releaseAt.Before(next) {
+			next = item.releaseAt
+		}
+	}
+	return next, true
+}
@@ -0,0 +1,264 @@
+package nazuna
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/messages"
+	"github.com/callummance/nazuna/webhooklistener"
+)
+
+//broadcasterNotification creates a notification with the given message ID for an event belonging to broadcaster
+func broadcasterNotification(id, broadcaster string) messages.EventNotificationMessage {
+	msg := testNotification(id)
+	msg.Event = &messages.StreamOnlineEvent{BroadcasterUID: broadcaster}
+	return msg
+}
+
+func TestOrderedDispatcher(t *testing.T) {
+	type op struct {
+		action      string
+		id          string
+		broadcaster string
+		//want is the result of a claim, or the ID of the notification returned by a release
+		want interface{}
+	}
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{
+			name: "different keys are claimed independently",
+			ops: []op{
+				{action: "claim", id: "a1", broadcaster: "a", want: true},
+				{action: "claim", id: "b1", broadcaster: "b", want: true},
+			},
+		},
+		{
+			name: "same key waits and is released in order",
+			ops: []op{
+				{action: "claim", id: "a1", broadcaster: "a", want: true},
+				{action: "claim", id: "a2", broadcaster: "a", want: false},
+				{action: "claim", id: "a3", broadcaster: "a", want: false},
+				{action: "release", id: "a1", broadcaster: "a", want: "a2"},
+				{action: "release", id: "a2", broadcaster: "a", want: "a3"},
+				{action: "release", id: "a3", broadcaster: "a", want: ""},
+				{action: "claim", id: "a4", broadcaster: "a", want: true},
+			},
+		},
+		{
+			name: "empty keys are not serialized",
+			ops: []op{
+				{action: "claim", id: "x1", want: true},
+				{action: "claim", id: "x2", want: true},
+				{action: "release", id: "x1", want: ""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOrderedDispatcher(OrderingOpts{Enabled: true})
+			for i, op := range tt.ops {
+				msg := broadcasterNotification(op.id, op.broadcaster)
+				var got interface{}
+				if op.action == "claim" {
+					got = o.claim(msg)
+				} else {
+					next, _ := o.release(msg)
+					got = next.MessageID
+				}
+				if got != op.want {
+					t.Errorf("op %v: %v(%v) = %v, want %v", i, op.action, op.id, got, op.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	start := time.Now()
+	sent := func(id string, offset time.Duration) messages.EventNotificationMessage {
+		msg := testNotification(id)
+		msg.MessageTimestamp = start.Add(offset)
+		return msg
+	}
+	ids := func(msgs []messages.EventNotificationMessage) []string {
+		var ids []string
+		for _, msg := range msgs {
+			ids = append(ids, msg.MessageID)
+		}
+		return ids
+	}
+	b := &reorderBuffer{window: time.Second}
+	if _, ok := b.nextRelease(); ok {
+		t.Error("nextRelease() of an empty buffer = true")
+	}
+	b.add(sent("b", 2*time.Second), start)
+	b.add(sent("a", time.Second), start.Add(500*time.Millisecond))
+	b.add(sent("c", 3*time.Second), start.Add(600*time.Millisecond))
+
+	if next, _ := b.nextRelease(); !next.Equal(start.Add(time.Second)) {
+		t.Errorf("nextRelease() = %v after start, want 1s", next.Sub(start))
+	}
+	if got := b.release(start.Add(900 * time.Millisecond)); len(got) != 0 {
+		t.Errorf("release() before any window passed = %v, want nothing", ids(got))
+	}
+	//b's window has passed, so a is released with it as it was sent earlier
+	if got, want := ids(b.release(start.Add(time.Second))), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("release() = %v, want %v", got, want)
+	}
+	b.add(sent("d", 2500*time.Millisecond), start.Add(time.Second))
+	if got, want := ids(b.flush()), []string{"d", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("flush() = %v, want %v", got, want)
+	}
+}
+
+//orderRecorder is a handler recording the order in which it was passed notifications for each broadcaster, and the
+//most notifications for any one broadcaster which it was handling at once
+type orderRecorder struct {
+	lock       sync.Mutex
+	handled    map[string][]string
+	running    map[string]int
+	maxRunning int
+	done       chan string
+	//before, if set, is called with each notification before it is recorded, and may fail it
+	before func(ctx context.Context, msg *messages.EventNotificationMessage) error
+}
+
+func newOrderRecorder() *orderRecorder {
+	return &orderRecorder{
+		handled: make(map[string][]string),
+		running: make(map[string]int),
+		done:    make(chan string, 100),
+	}
+}
+
+func (r *orderRecorder) handle(ctx context.Context, msg *messages.EventNotificationMessage) error {
+	key := msg.BroadcasterID()
+	r.lock.Lock()
+	r.running[key]++
+	if r.running[key] > r.maxRunning {
+		r.maxRunning = r.running[key]
+	}
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		r.running[key]--
+		r.lock.Unlock()
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	if r.before != nil {
+		if err := r.before(ctx, msg); err != nil {
+			return err
+		}
+	}
+	r.lock.Lock()
+	r.handled[key] = append(r.handled[key], msg.MessageID)
+	r.lock.Unlock()
+	r.done <- msg.MessageID
+	return nil
+}
+
+//wait waits for n notifications to be handled successfully
+func (r *orderRecorder) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %v of %v notifications were handled", i, n)
+		}
+	}
+}
+
+func TestOrderedDispatch(t *testing.T) {
+	newFakeTwitch(t)
+	c := newTestClient(t, NazunaOpts{Ordering: OrderingOpts{Enabled: true}, Queue: QueueOpts{Workers: 4}})
+	recorder := newOrderRecorder()
+	//a1 is held until b1 has been handled, which can only happen if different keys are dispatched in parallel
+	bHandled := make(chan struct{})
+	recorder.before = func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		switch msg.MessageID {
+		case "a1":
+			select {
+			case <-bHandled:
+			case <-time.After(time.Second):
+				t.Error("b1 was not handled whilst a1 was running")
+			}
+		case "b1":
+			close(bHandled)
+		}
+		return nil
+	}
+	c.RegisterHandler(webhooklistener.NotificationHandler(recorder.handle))
+
+	for _, id := range []string{"a1", "a2", "a3", "a4"} {
+		pushNotification(t, c, broadcasterNotification(id, "a"))
+	}
+	pushNotification(t, c, broadcasterNotification("b1", "b"))
+	recorder.wait(t, 5)
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if want := []string{"a1", "a2", "a3", "a4"}; !reflect.DeepEqual(recorder.handled["a"], want) {
+		t.Errorf("broadcaster a's notifications were handled in order %v, want %v", recorder.handled["a"], want)
+	}
+	if recorder.maxRunning != 1 {
+		t.Errorf("%v notifications for one broadcaster were handled at once, want 1", recorder.maxRunning)
+	}
+}
+
+func TestOrderedDispatchWaitsForRetries(t *testing.T) {
+	newFakeTwitch(t)
+	c := newTestClient(t, NazunaOpts{Ordering: OrderingOpts{Enabled: true}, Queue: QueueOpts{Workers: 4}})
+	recorder := newOrderRecorder()
+	var failOnce sync.Once
+	recorder.before = func(ctx context.Context, msg *messages.EventNotificationMessage) error {
+		var err error
+		if msg.MessageID == "a1" {
+			failOnce.Do(func() { err = errors.New("try again") })
+		}
+		return err
+	}
+	c.RegisterHandlerWithOpts(webhooklistener.NotificationHandler(recorder.handle), HandlerOpts{
+		MaxRetries:     1,
+		InitialBackoff: 50 * time.Millisecond,
+	})
+
+	pushNotification(t, c, broadcasterNotification("a1", "a"))
+	pushNotification(t, c, broadcasterNotification("a2", "a"))
+	recorder.wait(t, 2)
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if want := []string{"a1", "a2"}; !reflect.DeepEqual(recorder.handled["a"], want) {
+		t.Errorf("notifications were handled in order %v, want a2 to wait for a1's retry: %v", recorder.handled["a"], want)
+	}
+}
+
+func TestReorderWindow(t *testing.T) {
+	newFakeTwitch(t)
+	c := newTestClient(t, NazunaOpts{Ordering: OrderingOpts{Enabled: true, ReorderWindow: 50 * time.Millisecond}})
+	recorder := newOrderRecorder()
+	c.RegisterHandler(webhooklistener.NotificationHandler(recorder.handle))
+
+	//Twitch sent a1 first, but it arrives last
+	start := time.Now()
+	for i, id := range []string{"a3", "a2", "a1"} {
+		msg := broadcasterNotification(id, "a")
+		msg.MessageTimestamp = start.Add(time.Duration(3-i) * time.Second)
+		pushNotification(t, c, msg)
+	}
+	recorder.wait(t, 3)
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if want := []string{"a1", "a2", "a3"}; !reflect.DeepEqual(recorder.handled["a"], want) {
+		t.Errorf("notifications were handled in order %v, want %v", recorder.handled["a"], want)
+	}
+}
@@ -0,0 +1,370 @@
+package nazuna
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/messages"
+)
+
+const (
+	defaultQueueSize    = 1024
+	defaultQueueWorkers = 8
+)
+
+//OverflowPolicy decides what happens to notifications which arrive whilst the dispatch queue is full
+type OverflowPolicy int
+
+const (
+	//OverflowBlock waits for space in the queue, which delays the response to twitch. This is the default, as twitch
+	//retries notifications which are not acknowledged in time, whereas dropped notifications are lost.
+	OverflowBlock OverflowPolicy = iota
+	//OverflowDropOldest discards the oldest queued notification to make room for the new one. It never delays the
+	//response to twitch, but discarded notifications have already been acknowledged so will not be delivered again.
+	OverflowDropOldest
+	//OverflowSpillToDisk appends notifications to a file, from which they are read back once the queue has drained
+	OverflowSpillToDisk
+)
+
+//QueueOpts configures the queue which notifications wait in before being passed to handlers
+type QueueOpts struct {
+	//Size is the number of notifications which can be held in memory, defaulting to 1024
+	Size int
+	//Workers is the number of notifications which can be handled concurrently, defaulting to 8. Retries of failed
+	//handlers are run by the same workers.
+	Workers int
+	//Overflow selects the behaviour when the queue is full, defaulting to OverflowBlock
+	Overflow OverflowPolicy
+	//SpillPath is the file used by OverflowSpillToDisk. Notifications left in it by a previous run are dispatched on startup.
+	SpillPath string
+	//MaxPendingRetries limits the number of failed handlers which can be waiting for their backoff to pass before being
+	//retried, defaulting to Size. Once the limit is reached, a failed handler waits out its backoff on the worker which
+	//ran it, holding up the queue until retries drain.
+	MaxPendingRetries int
+}
+
+//QueueStats contains counters describing the state of the dispatch queue
+type QueueStats struct {
+	//Depth is the number of notifications waiting in memory
+	Depth int
+	//Spilled is the number of notifications currently waiting on disk
+	Spilled int
+	//Dropped is the total number of notifications which have been discarded due to the queue being full
+	Dropped uint64
+	//Retrying is the number of failed handlers waiting for their backoff to pass before being retried
+	Retrying int
+}
+
+//scheduleResult reports what became of a retry passed to schedule
+type scheduleResult int
+
+const (
+	//retryScheduled means the retry will be run by a worker once its backoff has passed
+	retryScheduled scheduleResult = iota
+	//retryLimited means MaxPendingRetries retries are already waiting, so the caller must wait out the backoff itself
+	retryLimited
+	//retryRejected means the queue has stopped accepting retries because the client is closing
+	retryRejected
+)
+
+//dispatchQueue is a bounded FIFO queue of notifications waiting to be handled. It also holds tasks, such as retries
+//whose backoff has passed, which are run by the workers ahead of any queued notifications.
+type dispatchQueue struct {
+	lock     sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	items    []messages.EventNotificationMessage
+	tasks    []func()
+	size     int
+	overflow OverflowPolicy
+	spill    *spillFile
+	dropped  uint64
+	closed   bool
+	log      *logging.Entry
+
+	//retries holds the timer of each retry waiting for its backoff to pass, along with the function which gives up on it
+	retries    map[*time.Timer]func()
+	maxRetries int
+	//abandoning counts retries which have been removed by abandonRetries but are still being given up on
+	abandoning int
+	//rejectRetries is set once retries are no longer accepted
+	rejectRetries bool
+}
+
+func newDispatchQueue(opts QueueOpts, log *logging.Entry) (*dispatchQueue, error) {
+	q := &dispatchQueue{
+		size:       opts.Size,
+		overflow:   opts.Overflow,
+		log:        log,
+		retries:    make(map[*time.Timer]func()),
+		maxRetries: opts.MaxPendingRetries,
+	}
+	if q.size <= 0 {
+		q.size = defaultQueueSize
+	}
+	if q.maxRetries <= 0 {
+		q.maxRetries = q.size
+	}
+	q.notEmpty = sync.NewCond(&q.lock)
+	q.notFull = sync.NewCond(&q.lock)
+
+	switch opts.Overflow {
+	case OverflowBlock, OverflowDropOldest:
+	case OverflowSpillToDisk:
+		if opts.SpillPath == "" {
+			return nil, fmt.Errorf("a SpillPath must be provided to use OverflowSpillToDisk")
+		}
+		spill, err := openSpillFile(opts.SpillPath, log)
+		if err != nil {
+			return nil, err
+		}
+		q.spill = spill
+	default:
+		return nil, fmt.Errorf("overflow policy %v is not supported", opts.Overflow)
+	}
+	return q, nil
+}
+
+//push adds a notification to the back of the queue, applying the overflow policy if it is full
+func (q *dispatchQueue) push(msg messages.EventNotificationMessage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	full := len(q.items) >= q.size
+	switch q.overflow {
+	case OverflowBlock:
+		for len(q.items) >= q.size && !q.closed {
+			q.notFull.Wait()
+		}
+	case OverflowDropOldest:
+		if full {
+			q.log.Warnf("Dispatch queue is full; dropping notification for subscription %v", q.items[0].Subscription.ID)
+			q.items = q.items[1:]
+			q.dropped++
+		}
+	case OverflowSpillToDisk:
+		//Once anything has been spilled, later notifications must follow it to keep them in order
+		if full || q.spill.pending > 0 {
+			err := q.spill.write(msg)
+			if err != nil {
+				q.log.Errorf("Failed to spill notification to disk due to error %v; dropping it", err)
+				q.dropped++
+				return
+			}
+			q.notEmpty.Signal()
+			return
+		}
+	}
+	q.items = append(q.items, msg)
+	q.notEmpty.Signal()
+}
+
+//pushTask adds a task to be run by the next free worker, ahead of any queued notifications. Tasks are accepted even
+//after the queue has been closed, as they finish work which was already in progress.
+func (q *dispatchQueue) pushTask(task func()) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.tasks = append(q.tasks, task)
+	q.notEmpty.Signal()
+}
+
+//schedule pushes task once delay has passed, unless abandonRetries is called first, in which case abandon is called
+//instead. The task is not scheduled if MaxPendingRetries retries are already waiting or the queue has stopped accepting
+//retries.
+func (q *dispatchQueue) schedule(delay time.Duration, task, abandon func()) scheduleResult {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.rejectRetries {
+		return retryRejected
+	}
+	if len(q.retries) >= q.maxRetries {
+		return retryLimited
+	}
+	//The timer cannot fire before it has been added to retries, as its callback must first take the lock
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		if _, ok := q.retries[timer]; !ok {
+			//Already abandoned
+			return
+		}
+		delete(q.retries, timer)
+		q.tasks = append(q.tasks, task)
+		q.notEmpty.Signal()
+	})
+	q.retries[timer] = abandon
+	return retryScheduled
+}
+
+//abandonRetries stops the queue from accepting retries and gives up on every retry still waiting for its backoff
+func (q *dispatchQueue) abandonRetries() {
+	q.lock.Lock()
+	q.rejectRetries = true
+	retries := q.retries
+	q.retries = make(map[*time.Timer]func())
+	//Workers are kept running until the retries have been given up on, as that may queue more tasks
+	q.abandoning += len(retries)
+	q.lock.Unlock()
+
+	for timer, abandon := range retries {
+		timer.Stop()
+		abandon()
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.abandoning -= len(retries)
+	q.notEmpty.Broadcast()
+}
+
+//pop removes the task or notification at the front of the queue, waiting for one to arrive if the queue is empty.
+//If claim is not nil it is called with each notification before the lock is released, and notifications for which it
+//returns false are taken over by claim rather than returned. Returns false once the queue has been closed and emptied
+//and no retries are waiting.
+func (q *dispatchQueue) pop(claim func(messages.EventNotificationMessage) bool) (messages.EventNotificationMessage, func(), bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		if len(q.tasks) > 0 {
+			task := q.tasks[0]
+			q.tasks = q.tasks[1:]
+			return messages.EventNotificationMessage{}, task, true
+		}
+		if len(q.items) > 0 {
+			msg := q.items[0]
+			q.items = q.items[1:]
+			q.notFull.Signal()
+			if claim != nil && !claim(msg) {
+				continue
+			}
+			return msg, nil, true
+		}
+		if q.spill != nil && q.spill.pending > 0 {
+			msg, err := q.spill.read()
+			if err != nil {
+				q.log.Errorf("Failed to read spilled notification due to error %v; skipping it", err)
+				q.dropped++
+				continue
+			}
+			if claim != nil && !claim(*msg) {
+				continue
+			}
+			return *msg, nil, true
+		}
+		if q.closed && len(q.retries) == 0 && q.abandoning == 0 {
+			return messages.EventNotificationMessage{}, nil, false
+		}
+		q.notEmpty.Wait()
+	}
+}
+
+//close stops the queue from accepting new notifications; those already queued can still be popped
+func (q *dispatchQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+func (q *dispatchQueue) stats() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := QueueStats{
+		Depth:    len(q.items),
+		Dropped:  q.dropped,
+		Retrying: len(q.retries),
+	}
+	if q.spill != nil {
+		stats.Spilled = q.spill.pending
+	}
+	return stats
+}
+
+//spillFile stores notifications as lines of JSON, which are read back in the order they were written
+type spillFile struct {
+	writer  *os.File
+	file    *os.File
+	reader  *bufio.Reader
+	pending int
+	log     *logging.Entry
+}
+
+func openSpillFile(path string, log *logging.Entry) (*spillFile, error) {
+	writer, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	s := &spillFile{
+		writer: writer,
+		file:   file,
+		reader: bufio.NewReader(file),
+		log:    log,
+	}
+
+	//Count notifications left over from a previous run so they are dispatched
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		s.pending++
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+	if s.pending > 0 {
+		s.log.Infof("Found %v spilled notifications from a previous run", s.pending)
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spillFile) write(msg messages.EventNotificationMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.writer.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	s.pending++
+	return nil
+}
+
+func (s *spillFile) read() (*messages.EventNotificationMessage, error) {
+	line, err := s.reader.ReadBytes('\n')
+	s.pending--
+	if s.pending == 0 {
+		//Everything has been read back, so start the file again from empty
+		s.reset()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return messages.DecodeNotification(line, "")
+}
+
+func (s *spillFile) reset() {
+	err := s.writer.Truncate(0)
+	if err != nil {
+		s.log.Warnf("Failed to truncate spill file due to error %v", err)
+	}
+	s.file.Seek(0, 0)
+	s.reader.Reset(s.file)
+}
@@ -0,0 +1,295 @@
+package nazuna
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/messages"
+)
+
+//popAll pops every notification left in a closed queue, returning their message IDs
+func popAll(t *testing.T, q *dispatchQueue) []string {
+	t.Helper()
+	var ids []string
+	for {
+		msg, _, ok := q.pop(nil)
+		if !ok {
+			return ids
+		}
+		ids = append(ids, msg.MessageID)
+	}
+}
+
+func TestDispatchQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow OverflowPolicy
+		size     int
+		push     []string
+		want     []string
+		stats    QueueStats
+	}{
+		{
+			name:     "drop oldest keeps the newest notifications",
+			overflow: OverflowDropOldest,
+			size:     2,
+			push:     []string{"a", "b", "c", "d"},
+			want:     []string{"c", "d"},
+			stats:    QueueStats{Depth: 2, Dropped: 2},
+		},
+		{
+			name:  "block is the default",
+			size:  2,
+			push:  []string{"a", "b"},
+			want:  []string{"a", "b"},
+			stats: QueueStats{Depth: 2},
+		},
+		{
+			name:     "spill to disk keeps every notification in order",
+			overflow: OverflowSpillToDisk,
+			size:     2,
+			push:     []string{"a", "b", "c", "d", "e"},
+			want:     []string{"a", "b", "c", "d", "e"},
+			stats:    QueueStats{Depth: 2, Spilled: 3},
+		},
+		{
+			name:     "block accepts notifications which fit",
+			overflow: OverflowBlock,
+			size:     3,
+			push:     []string{"a", "b", "c"},
+			want:     []string{"a", "b", "c"},
+			stats:    QueueStats{Depth: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := newDispatchQueue(QueueOpts{
+				Size:      tt.size,
+				Overflow:  tt.overflow,
+				SpillPath: filepath.Join(t.TempDir(), "spill"),
+			}, nil)
+			if err != nil {
+				t.Fatalf("newDispatchQueue() error = %v", err)
+			}
+			for _, id := range tt.push {
+				q.push(testNotification(id))
+			}
+			if stats := q.stats(); stats != tt.stats {
+				t.Errorf("stats() = %+v, want %+v", stats, tt.stats)
+			}
+			q.close()
+			if got := popAll(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("popped %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatchQueueBlocksUntilPopped(t *testing.T) {
+	//OverflowBlock is the default
+	q, err := newDispatchQueue(QueueOpts{Size: 1}, nil)
+	if err != nil {
+		t.Fatalf("newDispatchQueue() error = %v", err)
+	}
+	q.push(testNotification("a"))
+	pushed := make(chan struct{})
+	go func() {
+		q.push(testNotification("b"))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push returned whilst the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if msg, _, _ := q.pop(nil); msg.MessageID != "a" {
+		t.Errorf("pop() = %v, want a", msg.MessageID)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("push did not return once there was space")
+	}
+	q.close()
+	if got := popAll(t, q); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("popped %v, want [b]", got)
+	}
+}
+
+func TestDispatchQueueReplaysSpillFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spill")
+	opts := QueueOpts{Size: 1, Overflow: OverflowSpillToDisk, SpillPath: path}
+	q, err := newDispatchQueue(opts, nil)
+	if err != nil {
+		t.Fatalf("newDispatchQueue() error = %v", err)
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		q.push(testNotification(id))
+	}
+	//Only the notification in memory is lost when the process stops
+	q.close()
+
+	restarted, err := newDispatchQueue(opts, nil)
+	if err != nil {
+		t.Fatalf("newDispatchQueue() after restart error = %v", err)
+	}
+	if stats := restarted.stats(); stats.Spilled != 3 {
+		t.Errorf("stats().Spilled = %v after restart, want 3", stats.Spilled)
+	}
+	restarted.close()
+	want := []string{"b", "c", "d"}
+	if got := popAll(t, restarted); !reflect.DeepEqual(got, want) {
+		t.Errorf("popped %v after restart, want %v", got, want)
+	}
+	msg, _, ok := restarted.pop(nil)
+	if ok {
+		t.Errorf("pop() = %v after draining the spill file, want nothing", msg.MessageID)
+	}
+}
+
+func TestSpillFileKeepsMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spill")
+	q, err := newDispatchQueue(QueueOpts{Size: 1, Overflow: OverflowSpillToDisk, SpillPath: path}, nil)
+	if err != nil {
+		t.Fatalf("newDispatchQueue() error = %v", err)
+	}
+	body := `{"subscription":{"id":"sub","type":"stream.online","version":"1"},"event":{"broadcaster_user_id":"1234"}}`
+	decoded, err := messages.DecodeNotification([]byte(body), "")
+	if err != nil {
+		t.Fatalf("DecodeNotification() error = %v", err)
+	}
+	decoded.Metadata = messages.Metadata{
+		MessageID:           "b",
+		MessageTimestamp:    time.Date(2022, 5, 6, 7, 8, 9, 0, time.UTC),
+		MessageRetry:        1,
+		SubscriptionVersion: "1",
+	}
+	q.push(testNotification("a"))
+	q.push(*decoded)
+	if stats := q.stats(); stats.Spilled != 1 {
+		t.Fatalf("stats().Spilled = %v, want the second notification on disk", stats.Spilled)
+	}
+	q.close()
+	q.pop(nil)
+	got, _, ok := q.pop(nil)
+	if !ok {
+		t.Fatal("pop() returned nothing, want the spilled notification")
+	}
+	if !reflect.DeepEqual(got.Metadata, decoded.Metadata) {
+		t.Errorf("spilled Metadata = %+v, want %+v", got.Metadata, decoded.Metadata)
+	}
+	if string(got.Raw) != body {
+		t.Errorf("spilled Raw = %s, want %s", got.Raw, body)
+	}
+	if event, ok := got.Event.(*messages.StreamOnlineEvent); !ok || event.BroadcasterUID != "1234" {
+		t.Errorf("spilled Event = %#v, want the decoded event", got.Event)
+	}
+}
+
+func TestDispatchQueueClaim(t *testing.T) {
+	q, err := newDispatchQueue(QueueOpts{}, nil)
+	if err != nil {
+		t.Fatalf("newDispatchQueue() error = %v", err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		q.push(testNotification(id))
+	}
+	q.close()
+	var claimed []string
+	claim := func(msg messages.EventNotificationMessage) bool {
+		claimed = append(claimed, msg.MessageID)
+		return msg.MessageID != "b"
+	}
+	var got []string
+	for {
+		msg, _, ok := q.pop(claim)
+		if !ok {
+			break
+		}
+		got = append(got, msg.MessageID)
+	}
+	if want := []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("popped %v, want %v", got, want)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(claimed, want) {
+		t.Errorf("claimed %v, want %v", claimed, want)
+	}
+}
+
+func TestDispatchQueueRetries(t *testing.T) {
+	q, err := newDispatchQueue(QueueOpts{Size: 4, MaxPendingRetries: 2}, nil)
+	if err != nil {
+		t.Fatalf("newDispatchQueue() error = %v", err)
+	}
+	q.push(testNotification("a"))
+	var ran []string
+	task := func(name string) func() { return func() { ran = append(ran, name) } }
+	abandoned := 0
+	abandon := func() { abandoned++ }
+
+	if got := q.schedule(10*time.Millisecond, task("retry"), abandon); got != retryScheduled {
+		t.Fatalf("schedule() = %v, want retryScheduled", got)
+	}
+	if got := q.schedule(time.Hour, task("late"), abandon); got != retryScheduled {
+		t.Fatalf("schedule() = %v, want retryScheduled", got)
+	}
+	if got := q.schedule(time.Millisecond, task("limited"), abandon); got != retryLimited {
+		t.Errorf("schedule() past MaxPendingRetries = %v, want retryLimited", got)
+	}
+	if stats := q.stats(); stats.Retrying != 2 {
+		t.Errorf("stats().Retrying = %v, want 2", stats.Retrying)
+	}
+
+	//Due retries are popped ahead of queued notifications
+	time.Sleep(20 * time.Millisecond)
+	_, next, _ := q.pop(nil)
+	if next == nil {
+		t.Fatal("pop() returned a notification, want the due retry")
+	}
+	next()
+	if msg, _, _ := q.pop(nil); msg.MessageID != "a" {
+		t.Errorf("pop() = %v, want a", msg.MessageID)
+	}
+
+	//Closing the queue leaves workers running until the remaining retry has been abandoned
+	q.close()
+	popped := make(chan bool)
+	go func() {
+		_, _, ok := q.pop(nil)
+		popped <- ok
+	}()
+	select {
+	case <-popped:
+		t.Fatal("pop() returned whilst a retry was waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.abandonRetries()
+	if ok := <-popped; ok {
+		t.Error("pop() = true after abandoning retries, want the queue to be drained")
+	}
+	if got := q.schedule(time.Millisecond, task("rejected"), abandon); got != retryRejected {
+		t.Errorf("schedule() after abandoning retries = %v, want retryRejected", got)
+	}
+	if !reflect.DeepEqual(ran, []string{"retry"}) || abandoned != 1 {
+		t.Errorf("ran %v and abandoned %v retries, want [retry] and 1", ran, abandoned)
+	}
+}
+
+func TestNewDispatchQueueErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts QueueOpts
+	}{
+		{name: "spill without a path", opts: QueueOpts{Overflow: OverflowSpillToDisk}},
+		{name: "unknown policy", opts: QueueOpts{Overflow: OverflowPolicy(99)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newDispatchQueue(tt.opts, nil); err == nil {
+				t.Error("newDispatchQueue() error = nil, want an error")
+			}
+		})
+	}
+}
@@ -2,9 +2,13 @@ package restclient
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"sync"
 
-	"github.com/sirupsen/logrus"
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/tokenstore"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 	"golang.org/x/oauth2/endpoints"
 )
@@ -33,18 +37,149 @@ const (
 	ScopeUserReadEmail            = "user:read:email"
 )
 
-func getClientCredentials(clientID, clientSecret string, scopes []string) *http.Client {
-	ctx := context.Background()
+//getClientCredentials returns a source of app access tokens, starting from the token held in opts.TokenStore if it
+//is still valid
+func getClientCredentials(opts ClientOpts, log *logging.Entry) *cachingTokenSource {
+	ctx := transportContext(opts.Transport)
+	tokenURL := opts.TokenURL
+	if tokenURL == "" {
+		tokenURL = endpoints.Twitch.TokenURL
+	}
 	conf := &clientcredentials.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		TokenURL:     endpoints.Twitch.TokenURL,
-		Scopes:       scopes,
+		ClientID:     opts.ClientID,
+		ClientSecret: opts.ClientSecret,
+		TokenURL:     tokenURL,
+		Scopes:       opts.Scopes,
+		AuthStyle:    oauth2.AuthStyleInParams,
+	}
+
+	log.Redactor().AddSecret(opts.ClientSecret)
+	var source oauth2.TokenSource = redactingTokenSource{
+		source:   clientCredentialsSource{ctx: ctx, conf: conf},
+		redactor: log.Redactor(),
+	}
+	var initial *oauth2.Token
+	if opts.TokenStore != nil {
+		initial = loadToken(opts.TokenStore, tokenstore.AppKey, log)
+		source = persistingTokenSource{
+			source: source,
+			store:  opts.TokenStore,
+			key:    tokenstore.AppKey,
+			log:    log,
+		}
+	}
+	return &cachingTokenSource{source: source, tok: initial}
+}
+
+//clientCredentialsSource requests a new app access token each time it is called. Unlike the source returned by
+//conf.TokenSource it does not cache tokens itself, so that cachingTokenSource can discard them.
+type clientCredentialsSource struct {
+	ctx  context.Context
+	conf *clientcredentials.Config
+}
+
+func (s clientCredentialsSource) Token() (*oauth2.Token, error) {
+	return s.conf.Token(s.ctx)
+}
+
+//cachingTokenSource reuses each token from source until it expires, as oauth2.ReuseTokenSource does, but the cached
+//token can also be discarded if twitch reports that it is no longer valid
+type cachingTokenSource struct {
+	lock   sync.Mutex
+	source oauth2.TokenSource
+	tok    *oauth2.Token
+}
+
+func (s *cachingTokenSource) Token() (*oauth2.Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tok.Valid() {
+		return s.tok, nil
+	}
+	tok, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+//reset discards the cached token, so that the next call to Token requests a new one
+func (s *cachingTokenSource) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tok = nil
+}
+
+//transportContext returns a context which makes the oauth2 package send its requests using transport, or using
+//http.DefaultClient if transport is nil
+func transportContext(transport http.RoundTripper) context.Context {
+	ctx := context.Background()
+	if transport != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	}
+	return ctx
+}
+
+//userTokenSource returns a TokenSource which starts from tok and refreshes it using conf once it expires. Refresh
+//requests are sent using the HTTP client carried by ctx, if any.
+func userTokenSource(ctx context.Context, conf *oauth2.Config, tok *oauth2.Token, log *logging.Entry) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(tok, redactingTokenSource{
+		source:   conf.TokenSource(ctx, tok),
+		redactor: log.Redactor(),
+	})
+}
+
+//loadToken returns the token held in store under key, or nil if there is none
+func loadToken(store tokenstore.Store, key string, log *logging.Entry) *oauth2.Token {
+	tok, err := store.Get(key)
+	if errors.Is(err, tokenstore.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		log.Warnf("Failed to load %v token from store due to error %v", key, err)
+		return nil
+	}
+	log.Redactor().AddSecret(tok.AccessToken, tok.RefreshToken)
+	return tok.OAuth2()
+}
+
+//persistingTokenSource saves each token it issues to a store, so that it can be reused after a restart
+type persistingTokenSource struct {
+	source oauth2.TokenSource
+	store  tokenstore.Store
+	key    string
+	log    *logging.Entry
+}
+
+func (s persistingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	stored := tokenstore.NewToken(tok)
+	if len(stored.Scopes) == 0 {
+		//Keep the scopes recorded when the token was first granted if the refresh response does not repeat them
+		if old, err := s.store.Get(s.key); err == nil {
+			stored.Scopes = old.Scopes
+		}
 	}
+	if err := s.store.Put(s.key, stored); err != nil {
+		//The token is still usable, it just will not survive a restart
+		s.log.Warnf("Failed to save %v token to store due to error %v", s.key, err)
+	}
+	return tok, nil
+}
 
-	tok, _ := conf.Token(ctx)
-	logrus.Debugf("Using token %#v", tok)
+//redactingTokenSource registers each token it issues with a redactor, so that tokens never appear in logs
+type redactingTokenSource struct {
+	source   oauth2.TokenSource
+	redactor *logging.Redactor
+}
 
-	client := conf.Client(ctx)
-	return client
+func (s redactingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.source.Token()
+	if tok != nil {
+		s.redactor.AddSecret(tok.AccessToken, tok.RefreshToken)
+	}
+	return tok, err
 }
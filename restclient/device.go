@@ -0,0 +1,274 @@
+package restclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/callummance/nazuna/logging"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+const (
+	deviceCodeGrantType   = "urn:ietf:params:oauth:grant-type:device_code"
+	defaultDevicePoll     = 5 * time.Second
+	deviceSlowDownBackoff = 5 * time.Second
+)
+
+//ErrDeviceCodeExpired is returned when the user does not enter the device code before it expires
+var ErrDeviceCodeExpired = errors.New("device code expired before authorization was completed")
+
+//DeviceCodeConfig configures a DeviceCodeFlow
+type DeviceCodeConfig struct {
+	ClientID string
+	//ClientSecret may be left empty for applications registered as public clients
+	ClientSecret string
+	//Scopes are the scopes requested from the user
+	Scopes []string
+	//TokenURL is the token endpoint, defaulting to twitch's. The device endpoint is found alongside it, so it may be
+	//replaced to test against a mock server.
+	TokenURL string
+	//Transport sends the flow's requests, including those made by clients it creates, defaulting to
+	//http.DefaultTransport. It may be wrapped using Metrics.InstrumentTransport or tracing.InstrumentTransport so that
+	//requests made while authorizing are recorded.
+	Transport http.RoundTripper
+}
+
+//DeviceCode is the code which the user must enter to authorize the application
+type DeviceCode struct {
+	//UserCode is the code the user should enter
+	UserCode string
+	//VerificationURI is the page at which the user should enter the code. For twitch it already includes the code.
+	VerificationURI string
+	//Expiry is the time after which the code can no longer be used
+	Expiry time.Time
+	//Interval is how often the token endpoint is polled while waiting for the user
+	Interval time.Duration
+
+	deviceCode string
+}
+
+//DeviceCodeFlow obtains user access tokens using the OAuth device authorization grant, for tools which cannot receive
+//a redirect from the user's browser
+type DeviceCodeFlow struct {
+	conf *oauth2.Config
+	//transport is the transport given in the config, which may be nil
+	transport  http.RoundTripper
+	httpClient *http.Client
+	log        *logging.Entry
+}
+
+//NewDeviceCodeFlow creates a DeviceCodeFlow which logs to log. The client secret and every token it issues are
+//registered with log's redactor.
+func NewDeviceCodeFlow(config DeviceCodeConfig, log *logging.Entry) *DeviceCodeFlow {
+	tokenURL := config.TokenURL
+	if tokenURL == "" {
+		tokenURL = endpoints.Twitch.TokenURL
+	}
+	transport := config.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	log.Redactor().AddSecret(config.ClientSecret)
+	return &DeviceCodeFlow{
+		conf: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				TokenURL:  tokenURL,
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+			Scopes: config.Scopes,
+		},
+		transport:  config.Transport,
+		httpClient: &http.Client{Transport: transport},
+		log:        log,
+	}
+}
+
+//deviceErrorResponse is the body of an error response from the device or token endpoints. Twitch puts the error code
+//in the message field, whereas other servers follow RFC 8628 and use the error field.
+type deviceErrorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+	Message     string `json:"message"`
+}
+
+func (r deviceErrorResponse) code() string {
+	if r.Error != "" {
+		return r.Error
+	}
+	return r.Message
+}
+
+//post sends a form to the OAuth server, returning the response body if it succeeded
+func (f *DeviceCodeFlow) post(ctx context.Context, endpoint string, form url.Values) ([]byte, *deviceErrorResponse, error) {
+	form.Set("client_id", f.conf.ClientID)
+	if f.conf.ClientSecret != "" {
+		form.Set("client_secret", f.conf.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return body, nil, nil
+	}
+	var errResp deviceErrorResponse
+	if json.Unmarshal(body, &errResp) != nil || errResp.code() == "" {
+		return nil, nil, fmt.Errorf("got non-OK response %v from %v: %s", resp.Status, endpoint, body)
+	}
+	return nil, &errResp, nil
+}
+
+//RequestCode asks twitch for a device code, which the user must then enter at the verification URI
+func (f *DeviceCodeFlow) RequestCode(ctx context.Context) (*DeviceCode, error) {
+	body, errResp, err := f.post(ctx, oauthEndpoint(f.conf.Endpoint.TokenURL, "device"), url.Values{
+		"scopes": []string{strings.Join(f.conf.Scopes, " ")},
+	})
+	if err == nil && errResp != nil {
+		err = &AuthorizationError{ErrorCode: errResp.code(), Description: errResp.Description}
+	}
+	if err != nil {
+		f.log.Warnf("Failed to request device code due to error %v", err)
+		return nil, err
+	}
+	var result struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURI string `json:"verification_uri"`
+		ExpiresIn       int64  `json:"expires_in"`
+		Interval        int64  `json:"interval"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		f.log.Warnf("Failed to decode device code response due to error %v", err)
+		return nil, err
+	}
+	f.log.Redactor().AddSecret(result.DeviceCode)
+	interval := time.Duration(result.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDevicePoll
+	}
+	return &DeviceCode{
+		UserCode:        result.UserCode,
+		VerificationURI: result.VerificationURI,
+		Expiry:          time.Now().Add(time.Duration(result.ExpiresIn) * time.Second),
+		Interval:        interval,
+		deviceCode:      result.DeviceCode,
+	}, nil
+}
+
+//Poll waits for the user to enter code, polling the token endpoint until they do, they deny access, the code expires or
+//ctx is done. If the user denies access the error is an *AuthorizationError.
+func (f *DeviceCodeFlow) Poll(ctx context.Context, code *DeviceCode) (*oauth2.Token, error) {
+	interval := code.Interval
+	for {
+		wait := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return nil, ctx.Err()
+		case <-wait.C:
+		}
+		if time.Now().After(code.Expiry) {
+			return nil, ErrDeviceCodeExpired
+		}
+
+		body, errResp, err := f.post(ctx, f.conf.Endpoint.TokenURL, url.Values{
+			"device_code": []string{code.deviceCode},
+			"grant_type":  []string{deviceCodeGrantType},
+			"scopes":      []string{strings.Join(f.conf.Scopes, " ")},
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			//Network errors are retried at the next interval, as the user may still be entering the code
+			f.log.Warnf("Failed to poll for device authorization due to error %v", err)
+			continue
+		}
+		if errResp != nil {
+			switch errResp.code() {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += deviceSlowDownBackoff
+				f.log.Debugf("Polling for device authorization too quickly, slowing down to every %v", interval)
+				continue
+			case "expired_token", "invalid device code":
+				return nil, ErrDeviceCodeExpired
+			}
+			err := &AuthorizationError{ErrorCode: errResp.code(), Description: errResp.Description}
+			f.log.Infof("Device authorization failed: %v", err)
+			return nil, err
+		}
+		return f.decodeToken(body)
+	}
+}
+
+func (f *DeviceCodeFlow) decodeToken(body []byte) (*oauth2.Token, error) {
+	var result struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	tok := &oauth2.Token{
+		AccessToken:  result.AccessToken,
+		RefreshToken: result.RefreshToken,
+		TokenType:    result.TokenType,
+	}
+	if result.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	}
+	f.log.Redactor().AddSecret(tok.AccessToken, tok.RefreshToken)
+	//Keep the raw response so that the granted scopes can be read with tok.Extra("scope")
+	return tok.WithExtra(raw), nil
+}
+
+//Authorize runs the whole flow, requesting a device code, passing it to present so that it can be shown to the user,
+//and then waiting for the user to enter it
+func (f *DeviceCodeFlow) Authorize(ctx context.Context, present func(*DeviceCode)) (*oauth2.Token, error) {
+	code, err := f.RequestCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	present(code)
+	return f.Poll(ctx, code)
+}
+
+//TokenSource returns a TokenSource which starts from tok and refreshes it using its refresh token once it expires
+func (f *DeviceCodeFlow) TokenSource(tok *oauth2.Token) oauth2.TokenSource {
+	return userTokenSource(transportContext(f.transport), f.conf, tok, f.log)
+}
+
+//Client returns a REST client which makes requests on behalf of the user who was issued tok, refreshing the token
+//automatically when it expires
+func (f *DeviceCodeFlow) Client(tok *oauth2.Token) *Client {
+	f.log.Redactor().AddSecret(tok.AccessToken, tok.RefreshToken)
+	return newClient(f.conf.ClientID, f.conf.Endpoint.TokenURL, f.TokenSource(tok), f.transport, f.log)
+}
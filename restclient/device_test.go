@@ -0,0 +1,252 @@
+package restclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+//deviceServer is a mock OAuth server whose token endpoint gives the next response in its script for each poll,
+//repeating the last one once the script runs out
+type deviceServer struct {
+	*httptest.Server
+	lock   sync.Mutex
+	script []deviceResponse
+	polls  int
+}
+
+type deviceResponse struct {
+	status int
+	body   string
+}
+
+var (
+	pending   = deviceResponse{http.StatusBadRequest, `{"status":400,"message":"authorization_pending"}`}
+	slowDown  = deviceResponse{http.StatusBadRequest, `{"error":"slow_down"}`}
+	issued    = deviceResponse{http.StatusOK, `{"access_token":"user-token","refresh_token":"refresh","token_type":"bearer","expires_in":3600,"scope":["user:read:email"]}`}
+	expired   = deviceResponse{http.StatusBadRequest, `{"error":"expired_token"}`}
+	twitchBad = deviceResponse{http.StatusBadRequest, `{"status":400,"message":"invalid device code"}`}
+	denied    = deviceResponse{http.StatusBadRequest, `{"error":"access_denied","error_description":"the user denied access"}`}
+	broken    = deviceResponse{http.StatusInternalServerError, `not json`}
+)
+
+func newDeviceServer(t *testing.T, script ...deviceResponse) *deviceServer {
+	s := &deviceServer{script: script}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/device", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "client" || r.FormValue("scopes") != "user:read:email" {
+			http.Error(w, `{"status":400,"message":"invalid client"}`, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"device_code":"device","user_code":"ABCD","verification_uri":"https://example.com/activate?code=ABCD","expires_in":1800,"interval":5}`))
+	})
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("device_code") != "device" || r.FormValue("grant_type") != deviceCodeGrantType {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		s.lock.Lock()
+		resp := s.script[0]
+		if len(s.script) > 1 {
+			s.script = s.script[1:]
+		}
+		s.polls++
+		s.lock.Unlock()
+		w.WriteHeader(resp.status)
+		w.Write([]byte(resp.body))
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *deviceServer) pollCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.polls
+}
+
+func (s *deviceServer) flow() *DeviceCodeFlow {
+	return NewDeviceCodeFlow(DeviceCodeConfig{
+		ClientID: "client",
+		Scopes:   []string{"user:read:email"},
+		TokenURL: s.URL + "/oauth2/token",
+	}, nil)
+}
+
+func TestDeviceCodeFlowRequestCode(t *testing.T) {
+	server := newDeviceServer(t, pending)
+	code, err := server.flow().RequestCode(context.Background())
+	if err != nil {
+		t.Fatalf("RequestCode() error = %v", err)
+	}
+	if code.UserCode != "ABCD" || code.VerificationURI != "https://example.com/activate?code=ABCD" {
+		t.Errorf("RequestCode() = %+v, want the issued code", code)
+	}
+	if code.Interval != 5*time.Second {
+		t.Errorf("RequestCode().Interval = %v, want 5s", code.Interval)
+	}
+	if until := time.Until(code.Expiry); until < 29*time.Minute || until > 30*time.Minute {
+		t.Errorf("RequestCode().Expiry is %v away, want 30m", until)
+	}
+
+	//Errors from the device endpoint are reported as authorization errors
+	flow := NewDeviceCodeFlow(DeviceCodeConfig{ClientID: "other", TokenURL: server.URL + "/oauth2/token"}, nil)
+	var authErr *AuthorizationError
+	if _, err := flow.RequestCode(context.Background()); !errors.As(err, &authErr) || authErr.ErrorCode != "invalid client" {
+		t.Errorf("RequestCode() error = %v, want an AuthorizationError", err)
+	}
+}
+
+func TestDeviceCodeFlowPoll(t *testing.T) {
+	tests := []struct {
+		name   string
+		script []deviceResponse
+		//expired makes the code expire before the first poll
+		expired bool
+		wantErr error
+		//wantAuthErr is the code of the AuthorizationError which should be returned, if any
+		wantAuthErr string
+		wantPolls   int
+	}{
+		{
+			name:      "token is issued",
+			script:    []deviceResponse{issued},
+			wantPolls: 1,
+		},
+		{
+			name:      "polls until the user authorizes",
+			script:    []deviceResponse{pending, pending, issued},
+			wantPolls: 3,
+		},
+		{
+			name:      "server errors are retried",
+			script:    []deviceResponse{broken, issued},
+			wantPolls: 2,
+		},
+		{
+			name:      "expired token",
+			script:    []deviceResponse{pending, expired},
+			wantErr:   ErrDeviceCodeExpired,
+			wantPolls: 2,
+		},
+		{
+			name:      "twitch reports an invalid device code once it expires",
+			script:    []deviceResponse{twitchBad},
+			wantErr:   ErrDeviceCodeExpired,
+			wantPolls: 1,
+		},
+		{
+			name:      "expired codes are not polled",
+			script:    []deviceResponse{issued},
+			expired:   true,
+			wantErr:   ErrDeviceCodeExpired,
+			wantPolls: 0,
+		},
+		{
+			name:        "user denies access",
+			script:      []deviceResponse{pending, denied},
+			wantAuthErr: "access_denied",
+			wantPolls:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newDeviceServer(t, tt.script...)
+			expiry := time.Now().Add(time.Minute)
+			if tt.expired {
+				expiry = time.Now()
+			}
+			code := &DeviceCode{Interval: 10 * time.Millisecond, Expiry: expiry, deviceCode: "device"}
+			tok, err := server.flow().Poll(context.Background(), code)
+			if tt.wantAuthErr != "" {
+				var authErr *AuthorizationError
+				if !errors.As(err, &authErr) || authErr.ErrorCode != tt.wantAuthErr {
+					t.Errorf("Poll() error = %v, want an AuthorizationError with code %v", err, tt.wantAuthErr)
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Poll() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if tok.AccessToken != "user-token" || tok.RefreshToken != "refresh" || tok.Expiry.IsZero() {
+					t.Errorf("Poll() = %+v, want the issued token", tok)
+				}
+				if scopes, ok := tok.Extra("scope").([]interface{}); !ok || len(scopes) != 1 {
+					t.Errorf("Poll().Extra(scope) = %v, want the granted scopes", tok.Extra("scope"))
+				}
+			}
+			if polls := server.pollCount(); polls != tt.wantPolls {
+				t.Errorf("token endpoint was polled %v times, want %v", polls, tt.wantPolls)
+			}
+		})
+	}
+}
+
+func TestDeviceCodeFlowSlowDown(t *testing.T) {
+	server := newDeviceServer(t, slowDown, issued)
+	code := &DeviceCode{Interval: 10 * time.Millisecond, Expiry: time.Now().Add(time.Minute), deviceCode: "device"}
+	//After slow_down the interval grows by several seconds, so the context ends before the next poll
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := server.flow().Poll(ctx, code); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Poll() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if polls := server.pollCount(); polls != 1 {
+		t.Errorf("token endpoint was polled %v times, want 1 before slowing down", polls)
+	}
+}
+
+func TestDeviceCodeFlowPollCancel(t *testing.T) {
+	server := newDeviceServer(t, pending)
+	code := &DeviceCode{Interval: 10 * time.Millisecond, Expiry: time.Now().Add(time.Minute), deviceCode: "device"}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := server.flow().Poll(ctx, code); !errors.Is(err, context.Canceled) {
+		t.Errorf("Poll() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+//recordingTransport records the path of each request it sends
+type recordingTransport struct {
+	lock  sync.Mutex
+	paths []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	t.paths = append(t.paths, req.URL.Path)
+	t.lock.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDeviceCodeFlowTransport(t *testing.T) {
+	server := newDeviceServer(t, issued)
+	transport := &recordingTransport{}
+	flow := NewDeviceCodeFlow(DeviceCodeConfig{
+		ClientID:  "client",
+		Scopes:    []string{"user:read:email"},
+		TokenURL:  server.URL + "/oauth2/token",
+		Transport: transport,
+	}, nil)
+	code, err := flow.RequestCode(context.Background())
+	if err != nil {
+		t.Fatalf("RequestCode() error = %v", err)
+	}
+	code.Interval = 10 * time.Millisecond
+	tok, err := flow.Poll(context.Background(), code)
+	if err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+	//The mock server has no validation endpoint, but the request should still be sent through the transport
+	flow.Client(tok).ValidateToken(context.Background())
+
+	want := []string{"/oauth2/device", "/oauth2/token", "/oauth2/validate"}
+	if !reflect.DeepEqual(transport.paths, want) {
+		t.Errorf("transport sent requests to %v, want %v", transport.paths, want)
+	}
+}
@@ -0,0 +1,118 @@
+package restclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//maxErrorBodySize limits how much of an error response is read when decoding it
+const maxErrorBodySize = 64 * 1024
+
+//RateLimit describes the rate limit bucket reported in the headers of a Helix response
+type RateLimit struct {
+	//Limit is the number of points the bucket holds when full
+	Limit int
+	//Remaining is the number of points left in the bucket
+	Remaining int
+	//Reset is the time at which the bucket will be refilled
+	Reset time.Time
+}
+
+//parseRateLimit reads the Ratelimit-* headers of a response, returning false if they are missing
+func parseRateLimit(header http.Header) (RateLimit, bool) {
+	limit, err := strconv.Atoi(header.Get("Ratelimit-Limit"))
+	if err != nil {
+		return RateLimit{}, false
+	}
+	remaining, err := strconv.Atoi(header.Get("Ratelimit-Remaining"))
+	if err != nil {
+		return RateLimit{}, false
+	}
+	reset, err := strconv.ParseInt(header.Get("Ratelimit-Reset"), 10, 64)
+	if err != nil {
+		return RateLimit{}, false
+	}
+	return RateLimit{Limit: limit, Remaining: remaining, Reset: time.Unix(reset, 0)}, true
+}
+
+//APIError is returned when the Helix API, or the twitch OAuth server, responds with an unsuccessful status code
+type APIError struct {
+	//StatusCode is the HTTP status code of the response
+	StatusCode int
+	//ErrorName and Message are the error and message fields of the response body, which may be empty
+	ErrorName string
+	Message   string
+	//Method and URL identify the request which failed
+	Method string
+	URL    string
+	//RateLimit is the rate limit reported by the response, which is the zero value if it was not present
+	RateLimit RateLimit
+}
+
+//newAPIError builds an APIError from an unsuccessful response, consuming its body
+func newAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+	}
+	if resp.Request != nil {
+		apiErr.Method = resp.Request.Method
+		apiErr.URL = resp.Request.URL.String()
+	}
+	apiErr.RateLimit, _ = parseRateLimit(resp.Header)
+
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if json.Unmarshal(raw, &body) == nil {
+		apiErr.ErrorName = body.Error
+		apiErr.Message = body.Message
+	} else {
+		apiErr.Message = string(raw)
+	}
+	if apiErr.ErrorName == "" {
+		apiErr.ErrorName = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("twitch request %v %v failed with status %v %v", e.Method, e.URL, e.StatusCode, e.ErrorName)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+//hasStatus reports whether err is, or wraps, an APIError with the given status code
+func hasStatus(err error, statusCode int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == statusCode
+}
+
+//IsNotFound reports whether err was caused by a 404 Not Found response
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+//IsUnauthorized reports whether err was caused by a 401 Unauthorized response, usually due to an invalid token
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+//IsConflict reports whether err was caused by a 409 Conflict response, such as when creating a subscription which
+//already exists
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+//IsRateLimited reports whether err was caused by a 429 Too Many Requests response
+func IsRateLimited(err error) bool {
+	return hasStatus(err, http.StatusTooManyRequests)
+}
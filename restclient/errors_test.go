@@ -0,0 +1,141 @@
+package restclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/messages"
+)
+
+func TestNewAPIError(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://api.twitch.tv/helix/eventsub/subscriptions", nil)
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		body   string
+		want   APIError
+	}{
+		{
+			name:   "JSON body",
+			status: http.StatusBadRequest,
+			body:   `{"error":"Bad Request","status":400,"message":"invalid transport"}`,
+			want:   APIError{StatusCode: http.StatusBadRequest, ErrorName: "Bad Request", Message: "invalid transport"},
+		},
+		{
+			name:   "plain body",
+			status: http.StatusBadGateway,
+			body:   "upstream unavailable",
+			want:   APIError{StatusCode: http.StatusBadGateway, ErrorName: "Bad Gateway", Message: "upstream unavailable"},
+		},
+		{
+			name:   "rate limit headers",
+			status: http.StatusTooManyRequests,
+			header: http.Header{"Ratelimit-Limit": {"800"}, "Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"1650000000"}},
+			body:   `{"error":"Too Many Requests","status":429,"message":""}`,
+			want: APIError{
+				StatusCode: http.StatusTooManyRequests,
+				ErrorName:  "Too Many Requests",
+				RateLimit:  RateLimit{Limit: 800, Remaining: 0, Reset: time.Unix(1650000000, 0)},
+			},
+		},
+		{
+			name:   "incomplete rate limit headers are ignored",
+			status: http.StatusNotFound,
+			header: http.Header{"Ratelimit-Limit": {"800"}},
+			want:   APIError{StatusCode: http.StatusNotFound, ErrorName: "Not Found"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			got := newAPIError(&http.Response{
+				StatusCode: tt.status,
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+				Request:    req,
+			})
+			tt.want.Method = "POST"
+			tt.want.URL = req.URL.String()
+			if *got != tt.want {
+				t.Errorf("newAPIError() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorStatusPredicates(t *testing.T) {
+	predicates := map[string]struct {
+		is     func(error) bool
+		status int
+	}{
+		"IsNotFound":     {IsNotFound, http.StatusNotFound},
+		"IsUnauthorized": {IsUnauthorized, http.StatusUnauthorized},
+		"IsConflict":     {IsConflict, http.StatusConflict},
+		"IsRateLimited":  {IsRateLimited, http.StatusTooManyRequests},
+	}
+	statuses := []int{http.StatusNotFound, http.StatusUnauthorized, http.StatusConflict, http.StatusTooManyRequests}
+	for name, p := range predicates {
+		for _, status := range statuses {
+			err := fmt.Errorf("failed to create subscription: %w", &APIError{StatusCode: status})
+			if got := p.is(err); got != (status == p.status) {
+				t.Errorf("%v() of a wrapped %v error = %v, want %v", name, status, got, status == p.status)
+			}
+		}
+		if p.is(errors.New("connection refused")) || p.is(nil) {
+			t.Errorf("%v() = true for an error without a status", name)
+		}
+	}
+}
+
+//redirectTransport sends every request to target, whatever host it was addressed to
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCreateSubscriptionConflict(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/helix/eventsub/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"Conflict","status":409,"message":"subscription already exists"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	c, err := NewClient(ClientOpts{ClientID: "client", ClientSecret: "secret", TokenURL: server.URL + "/oauth2/token", Transport: redirectTransport{target}})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	_, err = c.CreateSubscriptionContext(context.Background(), messages.ConditionStreamOnline{BroadcasterUID: "1234"}, messages.TransportOpts{})
+	if !IsConflict(err) {
+		t.Fatalf("CreateSubscriptionContext() error = %v, want one satisfying IsConflict", err)
+	}
+	var apiErr *APIError
+	errors.As(err, &apiErr)
+	if apiErr.Method != "POST" || !strings.HasSuffix(apiErr.URL, "/helix/eventsub/subscriptions") || apiErr.Message != "subscription already exists" {
+		t.Errorf("CreateSubscriptionContext() error = %+v, want the request and twitch's message", apiErr)
+	}
+}
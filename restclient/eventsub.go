@@ -2,19 +2,25 @@ package restclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 
 	"github.com/callummance/nazuna/messages"
-	"github.com/sirupsen/logrus"
 )
 
 const subscriptionEndpoint = apiBaseURL + "/eventsub/subscriptions"
 
+//CreateSubscription requests a new EventSub subscription. If an identical subscription already exists, the returned
+//error satisfies IsConflict.
 func (c *Client) CreateSubscription(condition interface{}, transport messages.TransportOpts) (*messages.SubscriptionRequestStatus, error) {
+	return c.CreateSubscriptionContext(context.Background(), condition, transport)
+}
+
+//CreateSubscriptionContext is CreateSubscription, making the request using ctx
+func (c *Client) CreateSubscriptionContext(ctx context.Context, condition interface{}, transport messages.TransportOpts) (*messages.SubscriptionRequestStatus, error) {
 	var reqBody messages.Subscription
 	switch t := condition.(type) {
 	case messages.ConditionChannelUpdate:
@@ -54,7 +60,7 @@ func (c *Client) CreateSubscription(condition interface{}, transport messages.Tr
 	case messages.ConditionUserUpdate:
 		reqBody.Type = messages.SubscriptionUserUpdate
 	default:
-		logrus.Warnf("CreateSubscription call was provided with a condition of unrecognized type")
+		c.log.Warnf("CreateSubscription call was provided with a condition of unrecognized type")
 		return nil, fmt.Errorf("type %v supplied to CreateSubscription is not a valid condition", t)
 	}
 	reqBody.Version = "1"
@@ -63,16 +69,16 @@ func (c *Client) CreateSubscription(condition interface{}, transport messages.Tr
 
 	//Marshal request body
 	bodyBytes, err := json.Marshal(reqBody)
-	logrus.Debugf("Sending request for new eventsub subscription with body %q", reqBody)
+	c.log.Debugf("Sending request for new eventsub subscription with body %q", reqBody)
 	if err != nil {
-		logrus.Warnf("Failed to marshal CreateSubscription request body due to error %v", err)
+		c.log.Warnf("Failed to marshal CreateSubscription request body due to error %v", err)
 		return nil, err
 	}
-	logrus.Tracef("Submitting CreateSubscription request with body %s", bodyBytes)
+	c.log.Tracef("Submitting CreateSubscription request with body %s", bodyBytes)
 	//Send POST request
-	req, err := http.NewRequest("POST", subscriptionEndpoint, bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", subscriptionEndpoint, bytes.NewBuffer(bodyBytes))
 	if err != nil {
-		logrus.Warnf("Failed to make CreateSubscription request due to error %v", err)
+		c.log.Warnf("Failed to make CreateSubscription request due to error %v", err)
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
@@ -80,24 +86,22 @@ func (c *Client) CreateSubscription(condition interface{}, transport messages.Tr
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		logrus.Warnf("Failed to make CreateSubscription request due to error %v", err)
+		c.log.Warnf("Failed to make CreateSubscription request due to error %v", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 	//Decode response
 	var result messages.SubscriptionRequestStatus
-	if resp.StatusCode == http.StatusConflict {
-		//Quietly ignore duplicate subscriptions
-		return nil, nil
-	} else if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
-		dump, _ := httputil.DumpResponse(resp, true)
-		logrus.Infof("Got non-OK response %s to subscription creation request", dump)
-		return nil, fmt.Errorf("got non-OK response %s to subscription creation request", dump)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		//A 409 Conflict means the subscription already exists, which callers can detect using IsConflict
+		apiErr := newAPIError(resp)
+		c.log.Infof("Got non-OK response to subscription creation request: %v", apiErr)
+		return nil, apiErr
 	}
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
-		logrus.Warnf("Failed to decode response to CreateSubscription request due to error %v", err)
-		logrus.Tracef("response: %v", resp)
+		c.log.Warnf("Failed to decode response to CreateSubscription request due to error %v", err)
+		c.log.Tracef("response: %v", resp)
 		return nil, err
 	}
 	return &result, nil
@@ -118,13 +122,13 @@ func (p SubscriptionsParams) insertToValues(initialValues *url.Values) {
 	}
 }
 
-func (c *Client) getSubscriptionsPage(params *SubscriptionsParams, pagination *pagination) (*subscriptionsPage, error) {
-	logrus.Debugf("Requesting page of subscriptions with filters %#v from api.", params)
+func (c *Client) getSubscriptionsPage(ctx context.Context, params *SubscriptionsParams, pagination *pagination) (*subscriptionsPage, error) {
+	c.log.Debugf("Requesting page of subscriptions with filters %#v from api.", params)
 	//Build query URL
 	var query url.Values
 	url, err := url.Parse(subscriptionEndpoint)
 	if err != nil {
-		logrus.Errorf("Failed to parse subscription endpoint with error %v", err)
+		c.log.Errorf("Failed to parse subscription endpoint with error %v", err)
 		return nil, err
 	}
 	if params != nil {
@@ -136,17 +140,17 @@ func (c *Client) getSubscriptionsPage(params *SubscriptionsParams, pagination *p
 	url.RawQuery = query.Encode()
 
 	//Send GET request
-	req, err := http.NewRequest("GET", url.String(), http.NoBody)
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), http.NoBody)
 	if err != nil {
-		logrus.Warnf("Failed to make Subscriptions request due to error %v", err)
+		c.log.Warnf("Failed to make Subscriptions request due to error %v", err)
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Client-ID", c.clientID)
-	logrus.Tracef("Sending request %#v to retrieve subscriptions", req)
+	c.log.Tracef("Sending request %#v to retrieve subscriptions", req)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		logrus.Warnf("Failed to make Subscriptions request due to error %v", err)
+		c.log.Warnf("Failed to make Subscriptions request due to error %v", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -154,14 +158,14 @@ func (c *Client) getSubscriptionsPage(params *SubscriptionsParams, pagination *p
 	//Decode response
 	var result subscriptionsPage
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
-		dump, _ := httputil.DumpResponse(resp, true)
-		logrus.Infof("Got non-OK response %s to subscription list request", dump)
-		return nil, fmt.Errorf("got non-OK response %s to subscription list request", dump)
+		apiErr := newAPIError(resp)
+		c.log.Infof("Got non-OK response to subscription list request: %v", apiErr)
+		return nil, apiErr
 	}
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
-		logrus.Warnf("Failed to decode response to subscriptions list request due to error %v", err)
-		logrus.Tracef("response: %v", resp)
+		c.log.Warnf("Failed to decode response to subscriptions list request due to error %v", err)
+		c.log.Tracef("response: %v", resp)
 		return nil, err
 	}
 	return &result, nil
@@ -174,87 +178,84 @@ type SubscriptionResult struct {
 
 //Subscriptions returns a channel which will be populated with all Eventsub subscriptions owned by the current app
 func (c *Client) Subscriptions(filters *SubscriptionsParams) chan SubscriptionResult {
+	return c.SubscriptionsContext(context.Background(), filters)
+}
+
+//SubscriptionsContext is Subscriptions, making the requests using ctx. Cancelling ctx aborts any request in flight and
+//closes the channel, so callers which stop reading early should cancel it to release the goroutine filling the channel.
+func (c *Client) SubscriptionsContext(ctx context.Context, filters *SubscriptionsParams) chan SubscriptionResult {
 	ch := make(chan SubscriptionResult)
-	go func(c *Client) {
-		var currentPage subscriptionsPage
-		initialPageFetched := false
-		lastLoc := 0
-		for {
-			if lastLoc+1 < len(currentPage.Data) {
-				//We still have subscriptions from the previously fetched page
-				lastLoc++
-				ch <- SubscriptionResult{
-					Subscription: &currentPage.Data[lastLoc],
-					Err:          nil,
-				}
-			} else if currentPage.Pagination.Cursor == "" && initialPageFetched {
-				//Run out of subscriptions fetched and no pagination data, so we must be done
-				close(ch)
+	p := c.SubscriptionsPaginator(ctx, filters, PaginatorOpts{})
+	go func() {
+		defer close(ch)
+		defer p.Close()
+		for p.Next() {
+			sub := p.Item()
+			select {
+			case ch <- SubscriptionResult{Subscription: &sub}:
+			case <-ctx.Done():
 				return
-			} else {
-				//Need to fetch more members
-				pagination := pagination{
-					After: currentPage.Pagination.Cursor,
-				}
-				nextPage, err := c.getSubscriptionsPage(filters, &pagination)
-				if err != nil {
-					logrus.Warnf("Failed to fetch page of subscriptions from API due to error %v", err)
-					ch <- SubscriptionResult{
-						Subscription: nil,
-						Err:          err,
-					}
-				}
-				//If new page is empty, we must also be done
-				if len(nextPage.Data) == 0 {
-					close(ch)
-					return
-				}
-				initialPageFetched = true
-				currentPage = *nextPage
-				lastLoc = 0
-				ch <- SubscriptionResult{
-					Subscription: &currentPage.Data[0],
-					Err:          nil,
-				}
 			}
 		}
-	}(c)
+		if err := p.Err(); err != nil && ctx.Err() == nil {
+			c.log.Warnf("Failed to fetch page of subscriptions from API due to error %v", err)
+			select {
+			case ch <- SubscriptionResult{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
 	return ch
 }
 
+//SubscriptionsPaginator returns a Paginator over the Eventsub subscriptions owned by the current app which match the
+//provided filters. The subscriptions endpoint does not accept a page size, so opts.PageSize is ignored; the total
+//number of matching subscriptions and their cost are available from the paginator's Page method.
+func (c *Client) SubscriptionsPaginator(ctx context.Context, filters *SubscriptionsParams, opts PaginatorOpts) *Paginator[messages.Subscription] {
+	return newPaginator(ctx, opts, func(ctx context.Context, pagination *pagination) (*subscriptionsPage, error) {
+		pagination.First = 0
+		return c.getSubscriptionsPage(ctx, filters, pagination)
+	})
+}
+
 //DeleteSubscription attempts to delete a previously-created EventSub subscription from the twitch API
 func (c *Client) DeleteSubscription(subscriptionID string) error {
-	logrus.Debugf("Requested deletion of subscription with ID %v.", subscriptionID)
+	return c.DeleteSubscriptionContext(context.Background(), subscriptionID)
+}
+
+//DeleteSubscriptionContext is DeleteSubscription, making the request using ctx
+func (c *Client) DeleteSubscriptionContext(ctx context.Context, subscriptionID string) error {
+	c.log.Debugf("Requested deletion of subscription with ID %v.", subscriptionID)
 	//Build query URL
 	url, err := url.Parse(subscriptionEndpoint)
 	query := url.Query()
 	if err != nil {
-		logrus.Errorf("Failed to parse subscription endpoint with error %v", err)
+		c.log.Errorf("Failed to parse subscription endpoint with error %v", err)
 		return err
 	}
 	query.Set("id", subscriptionID)
 	url.RawQuery = query.Encode()
 
 	//Send DELETE request
-	req, err := http.NewRequest("DELETE", url.String(), http.NoBody)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url.String(), http.NoBody)
 	if err != nil {
-		logrus.Warnf("Failed to make delete subscription request due to error %v", err)
+		c.log.Warnf("Failed to make delete subscription request due to error %v", err)
 		return err
 	}
 	req.Header.Add("Client-ID", c.clientID)
-	logrus.Tracef("Sending request %#v to delete subscriptions", req)
+	c.log.Tracef("Sending request %#v to delete subscriptions", req)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		logrus.Warnf("Failed to make delete subscription request due to error %v", err)
+		c.log.Warnf("Failed to make delete subscription request due to error %v", err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	//Decode response
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		dump, _ := httputil.DumpResponse(resp, true)
-		logrus.Infof("Got non-OK response %s to subscription list request", dump)
-		return fmt.Errorf("got non-OK response %s to subscription list request", dump)
+		apiErr := newAPIError(resp)
+		c.log.Infof("Got non-OK response to subscription deletion request: %v", apiErr)
+		return apiErr
 	}
 	return nil
 }
@@ -0,0 +1,178 @@
+package restclient
+
+import (
+	"context"
+)
+
+//maxPageSize is the largest page which Helix list endpoints will return
+const maxPageSize = 100
+
+//Page is a single page of results from a Helix list endpoint
+type Page[T any] struct {
+	Data []T `json:"data"`
+	//Total, TotalCost and MaxTotalCost are only reported by some endpoints, such as the EventSub subscriptions list,
+	//and are zero otherwise
+	Total        int              `json:"total"`
+	TotalCost    int              `json:"total_cost"`
+	MaxTotalCost int              `json:"max_total_cost"`
+	Pagination   paginationCursor `json:"pagination"`
+}
+
+//PaginatorOpts controls which results a Paginator returns
+type PaginatorOpts struct {
+	//PageSize is the number of results requested in each page, up to 100. If unset, the endpoint's default is used.
+	//Endpoints which do not accept a page size ignore it.
+	PageSize int
+	//MaxItems stops the paginator after this many results have been returned. If unset, every result is returned.
+	MaxItems int
+	//Cursor is the cursor from which to start, as returned by PageInfo. If unset, results start from the first page.
+	Cursor string
+	//Backward requests the pages before Cursor rather than those after it. Results within each page remain in the
+	//order returned by twitch.
+	Backward bool
+}
+
+//PageInfo describes the most recent page fetched by a Paginator
+type PageInfo struct {
+	Total        int
+	TotalCost    int
+	MaxTotalCost int
+	//Cursor can be passed in PaginatorOpts to resume from the end of this page, and is empty on the last page
+	Cursor string
+}
+
+type pageFetcher[T any] func(ctx context.Context, pagination *pagination) (*Page[T], error)
+
+//Paginator iterates over the results of a Helix list endpoint, fetching further pages as they are needed. Pages are
+//fetched on the caller's goroutine, so a Paginator which is abandoned holds no resources, though calling Close
+//aborts any request which is in flight from another goroutine.
+//
+//	p := client.SubscriptionsPaginator(ctx, nil, restclient.PaginatorOpts{})
+//	defer p.Close()
+//	for p.Next() {
+//		sub := p.Item()
+//		...
+//	}
+//	if err := p.Err(); err != nil {
+//		...
+//	}
+type Paginator[T any] struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	fetch  pageFetcher[T]
+	opts   PaginatorOpts
+
+	page     *Page[T]
+	next     int
+	returned int
+	item     T
+	err      error
+}
+
+func newPaginator[T any](ctx context.Context, opts PaginatorOpts, fetch pageFetcher[T]) *Paginator[T] {
+	ctx, cancel := context.WithCancel(ctx)
+	if opts.PageSize > maxPageSize {
+		opts.PageSize = maxPageSize
+	}
+	return &Paginator[T]{
+		ctx:    ctx,
+		cancel: cancel,
+		fetch:  fetch,
+		opts:   opts,
+	}
+}
+
+//Next advances to the next result, which is then available from Item. It returns false once there are no more
+//results, the limit set by MaxItems has been reached, a request fails or the paginator is closed.
+func (p *Paginator[T]) Next() bool {
+	if p.err != nil {
+		return false
+	}
+	if p.opts.MaxItems > 0 && p.returned >= p.opts.MaxItems {
+		return false
+	}
+	for p.page == nil || p.next >= len(p.page.Data) {
+		if p.page != nil && (p.page.Pagination.Cursor == "" || len(p.page.Data) == 0) {
+			//Twitch gives no cursor on the last page, but an empty page also means there is nothing left
+			return false
+		}
+		if !p.fetchPage() {
+			return false
+		}
+	}
+	p.item = p.page.Data[p.next]
+	p.next++
+	p.returned++
+	return true
+}
+
+func (p *Paginator[T]) fetchPage() bool {
+	if err := p.ctx.Err(); err != nil {
+		p.err = err
+		return false
+	}
+	cursor := p.opts.Cursor
+	if p.page != nil {
+		cursor = p.page.Pagination.Cursor
+	}
+	pagination := pagination{First: p.opts.PageSize}
+	if p.opts.Backward {
+		pagination.Before = cursor
+	} else {
+		pagination.After = cursor
+	}
+	if p.opts.MaxItems > 0 {
+		//Avoid fetching more results than will be returned
+		remaining := p.opts.MaxItems - p.returned
+		if remaining < maxPageSize && (pagination.First == 0 || remaining < pagination.First) {
+			pagination.First = remaining
+		}
+	}
+
+	page, err := p.fetch(p.ctx, &pagination)
+	if err != nil {
+		p.err = err
+		return false
+	}
+	p.page = page
+	p.next = 0
+	return len(page.Data) > 0
+}
+
+//Item returns the result reached by the last call to Next
+func (p *Paginator[T]) Item() T {
+	return p.item
+}
+
+//Err returns the error which stopped the paginator, if any
+func (p *Paginator[T]) Err() error {
+	return p.err
+}
+
+//Page describes the most recently fetched page. It is the zero value until the first call to Next.
+func (p *Paginator[T]) Page() PageInfo {
+	if p.page == nil {
+		return PageInfo{}
+	}
+	return PageInfo{
+		Total:        p.page.Total,
+		TotalCost:    p.page.TotalCost,
+		MaxTotalCost: p.page.MaxTotalCost,
+		Cursor:       p.page.Pagination.Cursor,
+	}
+}
+
+//Close stops the paginator, aborting any request which is in flight. It is safe to call more than once.
+func (p *Paginator[T]) Close() {
+	p.cancel()
+}
+
+//All returns every remaining result, stopping at the first error
+func (p *Paginator[T]) All() ([]T, error) {
+	defer p.Close()
+	var items []T
+	for p.Next() {
+		items = append(items, p.Item())
+	}
+	return items, p.Err()
+}
@@ -0,0 +1,213 @@
+package restclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+//fakeList serves pages of the integers from 0 up to size, using the index of the next result as the cursor. It
+//records the pagination of each request it recieves.
+type fakeList struct {
+	size        int
+	defaultPage int
+	//failAt makes the request starting at this index fail, if it is not zero
+	failAt   int
+	requests []pagination
+}
+
+var errFakeList = errors.New("fake list failure")
+
+func (l *fakeList) fetch(ctx context.Context, pagination *pagination) (*Page[int], error) {
+	l.requests = append(l.requests, *pagination)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	first := pagination.First
+	if first == 0 {
+		first = l.defaultPage
+	}
+	start, end := 0, 0
+	switch {
+	case pagination.Before != "":
+		end, _ = strconv.Atoi(pagination.Before)
+		start = end - first
+		if start < 0 {
+			start = 0
+		}
+	default:
+		start, _ = strconv.Atoi(pagination.After)
+		end = start + first
+		if end > l.size {
+			end = l.size
+		}
+	}
+	if l.failAt != 0 && start == l.failAt {
+		return nil, errFakeList
+	}
+	page := &Page[int]{Total: l.size}
+	for i := start; i < end; i++ {
+		page.Data = append(page.Data, i)
+	}
+	if pagination.Before != "" && start > 0 {
+		page.Pagination.Cursor = strconv.Itoa(start)
+	} else if pagination.Before == "" && end < l.size {
+		page.Pagination.Cursor = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
+func TestPaginator(t *testing.T) {
+	tests := []struct {
+		name string
+		list fakeList
+		opts PaginatorOpts
+		want []int
+		//wantFirst is the page size requested by each request
+		wantFirst []int
+		wantErr   error
+	}{
+		{
+			name:      "follows the cursor to the last page",
+			list:      fakeList{size: 5, defaultPage: 2},
+			want:      []int{0, 1, 2, 3, 4},
+			wantFirst: []int{0, 0, 0},
+		},
+		{
+			name:      "empty list",
+			list:      fakeList{size: 0, defaultPage: 2},
+			wantFirst: []int{0},
+		},
+		{
+			name:      "page size is requested",
+			list:      fakeList{size: 5, defaultPage: 2},
+			opts:      PaginatorOpts{PageSize: 3},
+			want:      []int{0, 1, 2, 3, 4},
+			wantFirst: []int{3, 3},
+		},
+		{
+			name:      "page size is capped",
+			list:      fakeList{size: 150, defaultPage: 20},
+			opts:      PaginatorOpts{PageSize: 500},
+			want:      intRange(0, 150),
+			wantFirst: []int{100, 100},
+		},
+		{
+			name:      "max items stops early",
+			list:      fakeList{size: 10, defaultPage: 2},
+			opts:      PaginatorOpts{MaxItems: 3},
+			want:      []int{0, 1, 2},
+			wantFirst: []int{3},
+		},
+		{
+			name:      "max items limits the last page requested",
+			list:      fakeList{size: 10, defaultPage: 2},
+			opts:      PaginatorOpts{PageSize: 4, MaxItems: 6},
+			want:      []int{0, 1, 2, 3, 4, 5},
+			wantFirst: []int{4, 2},
+		},
+		{
+			name:      "max items is only requested once it fits in a page",
+			list:      fakeList{size: 150, defaultPage: 20},
+			opts:      PaginatorOpts{MaxItems: 120},
+			want:      intRange(0, 120),
+			wantFirst: []int{0, 0, 80},
+		},
+		{
+			name:      "starts from the cursor",
+			list:      fakeList{size: 5, defaultPage: 2},
+			opts:      PaginatorOpts{Cursor: "3"},
+			want:      []int{3, 4},
+			wantFirst: []int{0},
+		},
+		{
+			name:      "backward pages come before the cursor",
+			list:      fakeList{size: 10, defaultPage: 2},
+			opts:      PaginatorOpts{Cursor: "5", Backward: true},
+			want:      []int{3, 4, 1, 2, 0},
+			wantFirst: []int{0, 0, 0},
+		},
+		{
+			name:      "errors stop the paginator",
+			list:      fakeList{size: 10, defaultPage: 2, failAt: 4},
+			want:      []int{0, 1, 2, 3},
+			wantFirst: []int{0, 0, 0},
+			wantErr:   errFakeList,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := tt.list
+			p := newPaginator(context.Background(), tt.opts, list.fetch)
+			got, err := p.All()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("All() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("All() = %v, want %v", got, tt.want)
+			}
+			var first []int
+			for _, req := range list.requests {
+				first = append(first, req.First)
+			}
+			if !reflect.DeepEqual(first, tt.wantFirst) {
+				t.Errorf("requested page sizes %v, want %v", first, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestPaginatorPageInfo(t *testing.T) {
+	list := fakeList{size: 5, defaultPage: 2}
+	p := newPaginator(context.Background(), PaginatorOpts{}, list.fetch)
+	defer p.Close()
+	if info := p.Page(); info != (PageInfo{}) {
+		t.Errorf("Page() before Next = %+v, want the zero value", info)
+	}
+	p.Next()
+	if info, want := p.Page(), (PageInfo{Total: 5, Cursor: "2"}); info != want {
+		t.Errorf("Page() = %+v, want %+v", info, want)
+	}
+
+	//The cursor from one paginator resumes in another after the last page it fetched
+	resumed := newPaginator(context.Background(), PaginatorOpts{Cursor: p.Page().Cursor}, list.fetch)
+	if got, _ := resumed.All(); !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Errorf("resumed paginator returned %v, want [2 3 4]", got)
+	}
+}
+
+func TestPaginatorClose(t *testing.T) {
+	list := fakeList{size: 10, defaultPage: 2}
+	p := newPaginator(context.Background(), PaginatorOpts{}, list.fetch)
+	var got []int
+	for p.Next() {
+		got = append(got, p.Item())
+		if len(got) == 3 {
+			p.Close()
+			p.Close()
+		}
+	}
+	//The rest of the current page is still returned, but no more pages are fetched
+	if want := []int{0, 1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("returned %v, want %v", got, want)
+	}
+	if err := p.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Err() = %v, want %v", err, context.Canceled)
+	}
+	if len(list.requests) != 2 {
+		t.Errorf("made %v requests, want 2", len(list.requests))
+	}
+	if p.Next() {
+		t.Error("Next() = true after Close")
+	}
+}
+
+func intRange(start, end int) []int {
+	var ints []int
+	for i := start; i < end; i++ {
+		ints = append(ints, i)
+	}
+	return ints
+}
@@ -0,0 +1,286 @@
+package restclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/metrics"
+)
+
+const (
+	defaultRateLimit       = 800
+	defaultRefillInterval  = time.Minute
+	defaultMaxRetries      = 3
+	defaultInitialBackoff  = 500 * time.Millisecond
+	defaultMaxBackoff      = 30 * time.Second
+	maxDrainedResponseSize = 4096
+)
+
+//RateLimitOpts configures how the client paces its requests to the Helix API and retries those which fail. The zero
+//value uses the defaults for an app access token.
+type RateLimitOpts struct {
+	//Disabled stops requests from being paced by the client, though failed requests are still retried
+	Disabled bool
+	//Limit is the number of requests which may be made in each RefillInterval, defaulting to 800. It is replaced by the
+	//Ratelimit-Limit header once the first response has been received.
+	Limit int
+	//RefillInterval is the time taken for an empty bucket to refill, defaulting to one minute
+	RefillInterval time.Duration
+	//MaxRetries is the number of times a request is retried after a 429, a 5xx or a network error, defaulting to 3. Set
+	//it to a negative value to disable retries.
+	MaxRetries int
+	//InitialBackoff is the delay before the first retry, defaulting to 500ms. It doubles after each retry, and a random
+	//jitter is applied.
+	InitialBackoff time.Duration
+	//MaxBackoff limits the delay between retries, defaulting to 30 seconds
+	MaxBackoff time.Duration
+}
+
+func (o RateLimitOpts) withDefaults() RateLimitOpts {
+	if o.Limit <= 0 {
+		o.Limit = defaultRateLimit
+	}
+	if o.RefillInterval <= 0 {
+		o.RefillInterval = defaultRefillInterval
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = defaultMaxRetries
+	} else if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = defaultInitialBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = defaultMaxBackoff
+	}
+	return o
+}
+
+//tokenBucket tracks the points remaining in the Helix rate limit bucket. Tokens refill continuously at Limit per
+//RefillInterval and the estimate is corrected using the headers of each response.
+type tokenBucket struct {
+	lock   sync.Mutex
+	opts   RateLimitOpts
+	limit  float64
+	tokens float64
+	last   time.Time
+	//exhaustedUntil is set when twitch reports that the bucket is empty, and is the time at which it will be refilled
+	exhaustedUntil time.Time
+}
+
+func newTokenBucket(opts RateLimitOpts) *tokenBucket {
+	return &tokenBucket{
+		opts:   opts,
+		limit:  float64(opts.Limit),
+		tokens: float64(opts.Limit),
+		last:   time.Now(),
+	}
+}
+
+//refill must be called with the lock held
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last)
+	b.last = now
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += b.limit * float64(elapsed) / float64(b.opts.RefillInterval)
+	if b.tokens > b.limit {
+		b.tokens = b.limit
+	}
+}
+
+//reserve takes a token from the bucket, returning how long the caller must wait before using it. The token may be
+//returned with cancel if the caller gives up before then.
+func (b *tokenBucket) reserve() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.refill(now)
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens * float64(b.opts.RefillInterval) / b.limit)
+	}
+	if wait := b.exhaustedUntil.Sub(now); wait > delay {
+		delay = wait
+	}
+	return delay
+}
+
+func (b *tokenBucket) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens++
+}
+
+//wait blocks until a token is available or ctx is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	delay := b.reserve()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
+
+//update corrects the bucket using the rate limit reported by twitch. The reported number of remaining points only ever
+//lowers the local estimate, as requests still in flight will already have taken their tokens.
+func (b *tokenBucket) update(rl RateLimit) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(time.Now())
+	if rl.Limit > 0 {
+		b.limit = float64(rl.Limit)
+	}
+	if remaining := float64(rl.Remaining); remaining < b.tokens {
+		b.tokens = remaining
+	}
+	if rl.Remaining <= 0 {
+		b.exhaustedUntil = rl.Reset
+	} else {
+		b.exhaustedUntil = time.Time{}
+	}
+}
+
+//rateLimiter is an http.RoundTripper which paces requests using a tokenBucket and retries those which fail
+type rateLimiter struct {
+	base http.RoundTripper
+	log  *logging.Entry
+
+	lock    sync.RWMutex
+	opts    RateLimitOpts
+	bucket  *tokenBucket
+	metrics *metrics.Metrics
+}
+
+func newRateLimiter(base http.RoundTripper, opts RateLimitOpts, log *logging.Entry) *rateLimiter {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	l := &rateLimiter{
+		base: base,
+		log:  log,
+	}
+	l.configure(opts)
+	return l
+}
+
+func (l *rateLimiter) configure(opts RateLimitOpts) {
+	opts = opts.withDefaults()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.opts = opts
+	l.bucket = newTokenBucket(opts)
+}
+
+//setMetrics makes the limiter count the requests it retries in m. Retries happen beneath the transports which record
+//each request, so are otherwise invisible to the metrics.
+func (l *rateLimiter) setMetrics(m *metrics.Metrics) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.metrics = m
+}
+
+func (l *rateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	l.lock.RLock()
+	opts, bucket, m := l.opts, l.bucket, l.metrics
+	l.lock.RUnlock()
+
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if !opts.Disabled {
+			if err := bucket.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		attemptReq := req
+		if attempt > 0 {
+			attemptReq = req.Clone(ctx)
+			if req.Body != nil && req.Body != http.NoBody {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				attemptReq.Body = body
+			}
+		}
+
+		resp, err := l.base.RoundTrip(attemptReq)
+		var rl RateLimit
+		if err == nil {
+			var ok bool
+			if rl, ok = parseRateLimit(resp.Header); ok {
+				bucket.update(rl)
+			}
+		}
+
+		if attempt >= opts.MaxRetries || !l.retryable(req, resp, err) {
+			return resp, err
+		}
+		delay := backoff(opts, attempt)
+		if err != nil {
+			m.ObserveHelixRetry(req.Method, req.URL.Path, 0)
+			l.log.Infof("Helix request %v %v failed due to error %v, retrying in %v", req.Method, req.URL, err, delay)
+		} else {
+			m.ObserveHelixRetry(req.Method, req.URL.Path, resp.StatusCode)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				//Wait for the bucket to be refilled rather than retrying straight into another 429
+				if wait := time.Until(rl.Reset); wait > delay {
+					delay = wait
+				}
+			}
+			l.log.Infof("Helix request %v %v got response %v, retrying in %v", req.Method, req.URL, resp.Status, delay)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainedResponseSize))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//retryable reports whether a failed request should be attempted again
+func (l *rateLimiter) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		//The body has already been consumed and cannot be sent again
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+//backoff returns the delay before the given retry, using exponential backoff with jitter
+func backoff(opts RateLimitOpts, attempt int) time.Duration {
+	delay := opts.InitialBackoff
+	for i := 0; i < attempt && delay < opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > opts.MaxBackoff {
+		delay = opts.MaxBackoff
+	}
+	//Use between half and all of the delay, so that clients which failed together do not retry together
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,287 @@
+package restclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/metrics"
+)
+
+//testResponse is a response given by a scriptedServer
+type testResponse struct {
+	status int
+	//remaining and reset, if reset is not zero, are sent as the Ratelimit-* headers
+	remaining int
+	reset     time.Time
+}
+
+//scriptedServer responds to each request with the next response in the script, repeating the last one once the
+//script runs out. It records the body of each request it recieves.
+type scriptedServer struct {
+	*httptest.Server
+	lock   sync.Mutex
+	script []testResponse
+	bodies []string
+}
+
+func newScriptedServer(t *testing.T, script ...testResponse) *scriptedServer {
+	s := &scriptedServer{script: script}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.lock.Lock()
+		resp := s.script[0]
+		if len(s.script) > 1 {
+			s.script = s.script[1:]
+		}
+		s.bodies = append(s.bodies, string(body))
+		s.lock.Unlock()
+		if !resp.reset.IsZero() {
+			w.Header().Set("Ratelimit-Limit", "800")
+			w.Header().Set("Ratelimit-Remaining", strconv.Itoa(resp.remaining))
+			w.Header().Set("Ratelimit-Reset", strconv.FormatInt(resp.reset.Unix(), 10))
+		}
+		w.WriteHeader(resp.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *scriptedServer) requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+//fastRetries retries quickly so that tests do not wait for the default backoff
+var fastRetries = RateLimitOpts{InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+func TestRateLimiterRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       RateLimitOpts
+		script     []testResponse
+		wantStatus int
+		wantTries  int
+	}{
+		{
+			name:       "success is not retried",
+			opts:       fastRetries,
+			script:     []testResponse{{status: http.StatusOK}},
+			wantStatus: http.StatusOK,
+			wantTries:  1,
+		},
+		{
+			name:       "server errors are retried",
+			opts:       fastRetries,
+			script:     []testResponse{{status: http.StatusBadGateway}, {status: http.StatusServiceUnavailable}, {status: http.StatusOK}},
+			wantStatus: http.StatusOK,
+			wantTries:  3,
+		},
+		{
+			name:       "too many requests is retried",
+			opts:       fastRetries,
+			script:     []testResponse{{status: http.StatusTooManyRequests}, {status: http.StatusOK}},
+			wantStatus: http.StatusOK,
+			wantTries:  2,
+		},
+		{
+			name:       "client errors are not retried",
+			opts:       fastRetries,
+			script:     []testResponse{{status: http.StatusBadRequest}, {status: http.StatusOK}},
+			wantStatus: http.StatusBadRequest,
+			wantTries:  1,
+		},
+		{
+			name:       "the last response is returned once retries run out",
+			opts:       RateLimitOpts{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			script:     []testResponse{{status: http.StatusInternalServerError}},
+			wantStatus: http.StatusInternalServerError,
+			wantTries:  3,
+		},
+		{
+			name:       "negative max retries disables retrying",
+			opts:       RateLimitOpts{MaxRetries: -1},
+			script:     []testResponse{{status: http.StatusInternalServerError}, {status: http.StatusOK}},
+			wantStatus: http.StatusInternalServerError,
+			wantTries:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newScriptedServer(t, tt.script...)
+			limiter := newRateLimiter(http.DefaultTransport, tt.opts, nil)
+			req, _ := http.NewRequest("POST", server.URL, bytes.NewReader([]byte("body")))
+			resp, err := limiter.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("RoundTrip() status = %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+			bodies := server.requests()
+			if len(bodies) != tt.wantTries {
+				t.Errorf("server recieved %v requests, want %v", len(bodies), tt.wantTries)
+			}
+			for i, body := range bodies {
+				if body != "body" {
+					t.Errorf("request %v had body %q, want the original body to be replayed", i, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterHonoursReset(t *testing.T) {
+	//Ratelimit-Reset has a resolution of one second, so the reset is at least a second away
+	reset := time.Now().Add(2 * time.Second)
+	server := newScriptedServer(t,
+		testResponse{status: http.StatusTooManyRequests, remaining: 0, reset: reset},
+		testResponse{status: http.StatusOK},
+	)
+	limiter := newRateLimiter(http.DefaultTransport, fastRetries, nil)
+	start := time.Now()
+	req, _ := http.NewRequest("GET", server.URL, http.NoBody)
+	resp, err := limiter.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("RoundTrip() status = %v, want 200", resp.StatusCode)
+	}
+	if elapsed, want := time.Since(start), time.Unix(reset.Unix(), 0).Sub(start); elapsed < want-50*time.Millisecond {
+		t.Errorf("retried after %v, want to wait until the bucket reset after %v", elapsed, want)
+	}
+}
+
+func TestRateLimiterCancelWhileExhausted(t *testing.T) {
+	server := newScriptedServer(t, testResponse{status: http.StatusOK, remaining: 0, reset: time.Now().Add(time.Hour)})
+	limiter := newRateLimiter(http.DefaultTransport, fastRetries, nil)
+	req, _ := http.NewRequest("GET", server.URL, http.NoBody)
+	resp, err := limiter.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+
+	//The bucket is now empty until the reset, so the next request waits until its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, "GET", server.URL, http.NoBody)
+	if _, err := limiter.RoundTrip(req); err != context.DeadlineExceeded {
+		t.Errorf("RoundTrip() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := len(server.requests()); n != 1 {
+		t.Errorf("server recieved %v requests, want the second to be held back", n)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	opts := RateLimitOpts{Limit: 10, RefillInterval: time.Second}.withDefaults()
+	tests := []struct {
+		name string
+		//take is the number of tokens reserved before the one which is checked
+		take   int
+		update *RateLimit
+		//wantMin and wantMax bound the delay before the checked token can be used
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{name: "full bucket", take: 0, wantMax: 0},
+		{name: "last token", take: 9, wantMax: 0},
+		{name: "empty bucket waits for a refill", take: 10, wantMin: 90 * time.Millisecond, wantMax: 100 * time.Millisecond},
+		{
+			name:    "reported remaining points lower the estimate",
+			update:  &RateLimit{Limit: 10, Remaining: 0, Reset: time.Now().Add(-time.Second)},
+			wantMin: 90 * time.Millisecond,
+			wantMax: 100 * time.Millisecond,
+		},
+		{
+			name:    "an exhausted bucket waits for the reset",
+			update:  &RateLimit{Limit: 10, Remaining: 0, Reset: time.Now().Add(5 * time.Second)},
+			wantMin: 4 * time.Second,
+			wantMax: 5 * time.Second,
+		},
+		{
+			name:    "reported remaining points do not raise the estimate",
+			take:    10,
+			update:  &RateLimit{Limit: 10, Remaining: 10, Reset: time.Now().Add(time.Second)},
+			wantMin: 90 * time.Millisecond,
+			wantMax: 100 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newTokenBucket(opts)
+			for i := 0; i < tt.take; i++ {
+				bucket.reserve()
+			}
+			if tt.update != nil {
+				bucket.update(*tt.update)
+			}
+			if delay := bucket.reserve(); delay < tt.wantMin || delay > tt.wantMax {
+				t.Errorf("reserve() = %v, want between %v and %v", delay, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	opts := RateLimitOpts{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}.withDefaults()
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 0, max: 100 * time.Millisecond},
+		{attempt: 1, max: 200 * time.Millisecond},
+		{attempt: 3, max: 800 * time.Millisecond},
+		{attempt: 4, max: time.Second},
+		{attempt: 20, max: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if delay := backoff(opts, tt.attempt); delay < tt.max/2 || delay > tt.max {
+					t.Fatalf("backoff() = %v, want between %v and %v", delay, tt.max/2, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterCountsRetries(t *testing.T) {
+	server := newScriptedServer(t,
+		testResponse{status: http.StatusTooManyRequests},
+		testResponse{status: http.StatusBadGateway},
+		testResponse{status: http.StatusOK},
+	)
+	m := metrics.New()
+	limiter := newRateLimiter(http.DefaultTransport, fastRetries, nil)
+	limiter.setMetrics(m)
+	req, _ := http.NewRequest("GET", server.URL+"/helix/users", http.NoBody)
+	resp, err := limiter.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+
+	var scrape bytes.Buffer
+	m.Registry.WriteTo(&scrape)
+	for _, want := range []string{
+		`nazuna_helix_retries_total{method="GET",path="/helix/users",code="429"} 1`,
+		`nazuna_helix_retries_total{method="GET",path="/helix/users",code="502"} 1`,
+	} {
+		if !strings.Contains(scrape.String(), want) {
+			t.Errorf("metrics do not contain %v:\n%s", want, scrape.String())
+		}
+	}
+}
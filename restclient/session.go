@@ -1,20 +1,138 @@
 package restclient
 
 import (
+	"fmt"
 	"net/http"
+
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/metrics"
+	"github.com/callummance/nazuna/tokenstore"
+	"github.com/callummance/nazuna/tracing"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
 )
 
 const apiBaseURL = "https://api.twitch.tv/helix"
 
 type Client struct {
 	httpClient *http.Client
-	clientID   string
+	//oauthClient makes requests to the OAuth server, which carry the token themselves rather than having it added
+	oauthClient *http.Client
+	clientID    string
+	tokens      oauth2.TokenSource
+	tokenURL    string
+	limiter     *rateLimiter
+	log         *logging.Entry
+}
+
+//ClientOpts configures a Client which makes requests using an app access token
+type ClientOpts struct {
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	//TokenURL is the endpoint from which app access tokens are requested, defaulting to twitch's
+	TokenURL string
+	//TokenStore, if set, holds the app access token under tokenstore.AppKey so that it can be reused after a restart
+	//rather than a new one being requested every time
+	TokenStore tokenstore.Store
+	//Logger receives the client's logs, defaulting to logging.Default(). The client secret and every access token
+	//issued to the client are registered with its redactor.
+	Logger *logging.Entry
+	//Transport sends the client's requests, including those made to obtain tokens, defaulting to
+	//http.DefaultTransport. It may be replaced to test against a mock server.
+	Transport http.RoundTripper
+}
+
+//NewClient creates a client which makes requests using an app access token, returning an error if no token could be
+//obtained. If twitch rejects the client ID or secret, the error is a *CredentialsError.
+func NewClient(opts ClientOpts) (*Client, error) {
+	log := opts.Logger
+	if log == nil {
+		log = logging.Default()
+	}
+	if opts.TokenURL == "" {
+		opts.TokenURL = endpoints.Twitch.TokenURL
+	}
+	source := getClientCredentials(opts, log)
+	if _, err := source.Token(); err != nil {
+		log.Errorf("Failed to obtain app access token due to error %v", err)
+		if credErr := credentialsError(err); credErr != nil {
+			return nil, credErr
+		}
+		return nil, fmt.Errorf("failed to obtain app access token: %w", err)
+	}
+	return newClient(opts.ClientID, opts.TokenURL, source, opts.Transport, log), nil
 }
 
 func InitClient(clientID, clientSecret string, scopes []string) *Client {
-	httpClient := getClientCredentials(clientID, clientSecret, scopes)
-	return &Client{
-		httpClient: httpClient,
-		clientID:   clientID,
+	return InitClientWithLogger(clientID, clientSecret, scopes, logging.Default())
+}
+
+//InitClientWithLogger creates a client which logs to log. The client secret and every access token issued to the
+//client are registered with log's redactor. If no token can be obtained the error is logged, and requests will fail
+//until one can be; use NewClient to handle the error instead.
+func InitClientWithLogger(clientID, clientSecret string, scopes []string, log *logging.Entry) *Client {
+	source := getClientCredentials(ClientOpts{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       scopes,
+	}, log)
+	if _, err := source.Token(); err != nil {
+		log.Errorf("Failed to obtain app access token due to error %v", err)
+	}
+	return newClient(clientID, endpoints.Twitch.TokenURL, source, nil, log)
+}
+
+//newClient creates a client which authenticates its requests with tokens from source, which were issued by the OAuth
+//server at tokenURL. Requests are sent using base, or http.DefaultTransport if it is nil.
+func newClient(clientID, tokenURL string, source oauth2.TokenSource, base http.RoundTripper, log *logging.Entry) *Client {
+	if base == nil {
+		base = http.DefaultTransport
 	}
+	limiter := newRateLimiter(base, RateLimitOpts{}, log)
+	c := &Client{
+		clientID: clientID,
+		tokens:   source,
+		tokenURL: tokenURL,
+		limiter:  limiter,
+		log:      log,
+	}
+	c.setTransport(limiter)
+	return c
+}
+
+//setTransport makes the client send its requests using transport, which is shared by requests to the OAuth server so
+//that they are paced and instrumented in the same way. The access token is added to requests to the Helix API.
+func (c *Client) setTransport(transport http.RoundTripper) {
+	c.oauthClient = &http.Client{Transport: transport}
+	c.httpClient = &http.Client{Transport: &oauth2.Transport{Source: c.tokens, Base: transport}}
+}
+
+//resetToken discards the client's cached app access token so that a new one is requested, returning false if the
+//client does not use an app access token
+func (c *Client) resetToken() bool {
+	source, ok := c.tokens.(*cachingTokenSource)
+	if ok {
+		source.reset()
+	}
+	return ok
+}
+
+//SetRateLimit replaces the limits used to pace requests to the Helix API and the policy for retrying those which fail.
+//Every endpoint shares a single bucket, as twitch applies the limit to the client's token rather than per endpoint.
+func (c *Client) SetRateLimit(opts RateLimitOpts) {
+	c.limiter.configure(opts)
+}
+
+//SetMetrics makes the client record every request it makes to the Helix API and the OAuth server in m, along with
+//each retry of a request which failed
+func (c *Client) SetMetrics(m *metrics.Metrics) {
+	c.limiter.setMetrics(m)
+	c.setTransport(m.InstrumentTransport(c.oauthClient.Transport))
+}
+
+//SetTracer makes the client start a span for every request it makes to the Helix API, as a child of the span carried
+//by the context passed to the request
+func (c *Client) SetTracer(tracer tracing.Tracer) {
+	c.setTransport(tracing.InstrumentTransport(tracer, c.oauthClient.Transport))
 }
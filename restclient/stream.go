@@ -1,15 +1,13 @@
 package restclient
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"time"
 
 	"github.com/google/go-querystring/query"
-	"github.com/sirupsen/logrus"
 )
 
 const streamsEndpoint = apiBaseURL + "/streams"
@@ -41,16 +39,21 @@ type GetStreamsOpts struct {
 }
 
 func (c *Client) GetStreamsPage(opts GetStreamsOpts, pagination *pagination) (*streamsPage, error) {
-	logrus.Debugf("Requesting page of streams with filters %#v from api.", opts)
+	return c.GetStreamsPageContext(context.Background(), opts, pagination)
+}
+
+//GetStreamsPageContext is GetStreamsPage, making the request using ctx
+func (c *Client) GetStreamsPageContext(ctx context.Context, opts GetStreamsOpts, pagination *pagination) (*streamsPage, error) {
+	c.log.Debugf("Requesting page of streams with filters %#v from api.", opts)
 	//Build query URL
 	url, err := url.Parse(streamsEndpoint)
 	if err != nil {
-		logrus.Errorf("Failed to parse streams endpoint with error %v", err)
+		c.log.Errorf("Failed to parse streams endpoint with error %v", err)
 		return nil, err
 	}
 	vals, err := query.Values(opts)
 	if err != nil {
-		logrus.Errorf("Failed to encode stream options into querystring with error %v", err)
+		c.log.Errorf("Failed to encode stream options into querystring with error %v", err)
 		return nil, err
 	}
 	if pagination != nil {
@@ -59,17 +62,17 @@ func (c *Client) GetStreamsPage(opts GetStreamsOpts, pagination *pagination) (*s
 	url.RawQuery = vals.Encode()
 
 	//Send GET request
-	req, err := http.NewRequest("GET", url.String(), http.NoBody)
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), http.NoBody)
 	if err != nil {
-		logrus.Warnf("Failed to make Streams request due to error %v", err)
+		c.log.Warnf("Failed to make Streams request due to error %v", err)
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Client-ID", c.clientID)
-	logrus.Tracef("Sending request %#v to url %v retrieve streams", req, req.URL.String())
+	c.log.Tracef("Sending request %#v to url %v retrieve streams", req, req.URL.String())
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		logrus.Warnf("Failed to make Streams request due to error %v", err)
+		c.log.Warnf("Failed to make Streams request due to error %v", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -77,19 +80,45 @@ func (c *Client) GetStreamsPage(opts GetStreamsOpts, pagination *pagination) (*s
 	//Decode response
 	var result streamsPage
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
-		dump, _ := httputil.DumpResponse(resp, true)
-		logrus.Infof("Got non-OK response %s to streams list request", dump)
-		return nil, fmt.Errorf("got non-OK response %s to streams list request", dump)
+		apiErr := newAPIError(resp)
+		c.log.Infof("Got non-OK response to streams list request: %v", apiErr)
+		return nil, apiErr
 	}
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
-		logrus.Warnf("Failed to decode response to streams list request due to error %v", err)
-		logrus.Tracef("response: %v", resp)
+		c.log.Warnf("Failed to decode response to streams list request due to error %v", err)
+		c.log.Tracef("response: %v", resp)
 		return nil, err
 	}
 	return &result, nil
 }
 
+//GetStreamsContext fetches every page of streams matching the provided options, making the requests using ctx
+func (c *Client) GetStreamsContext(ctx context.Context, opts GetStreamsOpts) ([]TwitchStream, error) {
+	return c.GetStreamsPaginator(ctx, opts, PaginatorOpts{}).All()
+}
+
+//GetStreamsPaginator returns a Paginator over the streams which match the provided options. If opts sets After,
+//Before or First, they are used in place of unset PaginatorOpts fields.
+func (c *Client) GetStreamsPaginator(ctx context.Context, opts GetStreamsOpts, paginatorOpts PaginatorOpts) *Paginator[TwitchStream] {
+	if paginatorOpts.PageSize == 0 {
+		paginatorOpts.PageSize = opts.First
+	}
+	if paginatorOpts.Cursor == "" {
+		if opts.Before != "" {
+			paginatorOpts.Cursor = opts.Before
+			paginatorOpts.Backward = true
+		} else {
+			paginatorOpts.Cursor = opts.After
+		}
+	}
+	//Pagination is controlled by the paginator from here on
+	opts.After, opts.Before, opts.First = "", "", 0
+	return newPaginator(ctx, paginatorOpts, func(ctx context.Context, pagination *pagination) (*streamsPage, error) {
+		return c.GetStreamsPageContext(ctx, opts, pagination)
+	})
+}
+
 type StreamResult struct {
 	Stream *TwitchStream
 	Err    error
@@ -97,50 +126,33 @@ type StreamResult struct {
 
 //GetStreamsIter returns a channel which will be populated with data on streams which match the provided options
 func (c *Client) GetStreamsIter(opts GetStreamsOpts) chan StreamResult {
+	return c.GetStreamsIterContext(context.Background(), opts)
+}
+
+//GetStreamsIterContext is GetStreamsIter, making the requests using ctx. Cancelling ctx aborts any request in flight
+//and closes the channel, so callers which stop reading early should cancel it to release the goroutine filling the
+//channel.
+func (c *Client) GetStreamsIterContext(ctx context.Context, opts GetStreamsOpts) chan StreamResult {
 	ch := make(chan StreamResult)
-	go func(c *Client) {
-		var currentPage streamsPage
-		initialPageFetched := false
-		lastLoc := 0
-		for {
-			if lastLoc+1 < len(currentPage.Data) {
-				//We still have streams from the previously fetched page
-				lastLoc++
-				ch <- StreamResult{
-					Stream: &currentPage.Data[lastLoc],
-					Err:    nil,
-				}
-			} else if currentPage.Pagination.Cursor == "" && initialPageFetched {
-				//Run out of streams fetched and no pagination data, so we must be done
-				close(ch)
+	p := c.GetStreamsPaginator(ctx, opts, PaginatorOpts{})
+	go func() {
+		defer close(ch)
+		defer p.Close()
+		for p.Next() {
+			stream := p.Item()
+			select {
+			case ch <- StreamResult{Stream: &stream}:
+			case <-ctx.Done():
 				return
-			} else {
-				//Need to fetch more streams
-				pagination := pagination{
-					After: currentPage.Pagination.Cursor,
-				}
-				nextPage, err := c.GetStreamsPage(opts, &pagination)
-				if err != nil {
-					logrus.Warnf("Failed to fetch page of streams from API due to error %v", err)
-					ch <- StreamResult{
-						Stream: nil,
-						Err:    err,
-					}
-				}
-				//If new page is empty, we must also be done
-				if len(nextPage.Data) == 0 {
-					close(ch)
-					return
-				}
-				initialPageFetched = true
-				currentPage = *nextPage
-				lastLoc = 0
-				ch <- StreamResult{
-					Stream: &currentPage.Data[0],
-					Err:    nil,
-				}
 			}
 		}
-	}(c)
+		if err := p.Err(); err != nil && ctx.Err() == nil {
+			c.log.Warnf("Failed to fetch page of streams from API due to error %v", err)
+			select {
+			case ch <- StreamResult{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
 	return ch
 }
@@ -0,0 +1,240 @@
+package restclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/callummance/nazuna/tokenstore"
+)
+
+//ErrMissingScopes is returned when a broadcaster has not granted the scopes needed for a request
+var ErrMissingScopes = errors.New("broadcaster has not granted the required scopes")
+
+//TenantClient makes Helix requests on behalf of many broadcasters, each using the user token they granted the
+//application, which is looked up in the TokenStore of an AuthCodeFlow. Requests which do not need a user token can
+//fall back to the app access token.
+type TenantClient struct {
+	app   *Client
+	flow  *AuthCodeFlow
+	store tokenstore.Store
+
+	lock    sync.Mutex
+	clients map[string]tenant
+}
+
+type tenant struct {
+	client *Client
+	//accessToken is the stored token the client was created from, used to notice when the stored token is replaced
+	accessToken string
+}
+
+//NewTenantClient creates a TenantClient which uses app for requests made with the app access token and the tokens
+//held in flow's TokenStore for requests made on behalf of broadcasters
+func NewTenantClient(app *Client, flow *AuthCodeFlow) (*TenantClient, error) {
+	if flow.store == nil {
+		return nil, errors.New("the auth code flow has no token store")
+	}
+	return &TenantClient{
+		app:     app,
+		flow:    flow,
+		store:   flow.store,
+		clients: make(map[string]tenant),
+	}, nil
+}
+
+//App returns the client which uses the app access token
+func (t *TenantClient) App() *Client {
+	return t.app
+}
+
+//As returns a client which makes requests as the given broadcaster, using the token they granted. If they have not
+//granted a token the error satisfies errors.Is(err, tokenstore.ErrNotFound), and if their token lacks any of scopes it
+//satisfies errors.Is(err, ErrMissingScopes).
+func (t *TenantClient) As(broadcasterID string, scopes ...string) (*Client, error) {
+	tok, err := t.store.Get(broadcasterID)
+	if err != nil {
+		return nil, err
+	}
+	if missing := missingScopes(tok.Scopes, scopes); len(missing) > 0 {
+		return nil, fmt.Errorf("%w: broadcaster %v is missing %v", ErrMissingScopes, broadcasterID, missing)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	//Reuse the existing client unless the stored token has changed, such as after the broadcaster authorized the
+	//application again. Clients refresh their own tokens, so this also replaces a client once after each refresh.
+	if cached, ok := t.clients[broadcasterID]; ok && cached.accessToken == tok.AccessToken {
+		return cached.client, nil
+	}
+	client, err := t.flow.UserClient(broadcasterID)
+	if err != nil {
+		return nil, err
+	}
+	t.clients[broadcasterID] = tenant{client: client, accessToken: tok.AccessToken}
+	return client, nil
+}
+
+//AsOrApp returns a client which makes requests as the given broadcaster if they have granted a token with all of
+//scopes, and otherwise the client which uses the app access token. It should only be used for requests which twitch
+//accepts with either kind of token.
+func (t *TenantClient) AsOrApp(broadcasterID string, scopes ...string) *Client {
+	client, err := t.As(broadcasterID, scopes...)
+	if err != nil {
+		if !errors.Is(err, tokenstore.ErrNotFound) && !errors.Is(err, ErrMissingScopes) {
+			t.flow.log.Warnf("Falling back to the app access token for broadcaster %v due to error %v", broadcasterID, err)
+		}
+		return t.app
+	}
+	return client
+}
+
+//Remove forgets the token granted by a broadcaster, such as after they revoke the application's access
+func (t *TenantClient) Remove(broadcasterID string) error {
+	t.lock.Lock()
+	delete(t.clients, broadcasterID)
+	t.lock.Unlock()
+	return t.store.Delete(broadcasterID)
+}
+
+//Revoke revokes the token granted by a broadcaster and forgets it, for use when they stop using the application
+func (t *TenantClient) Revoke(ctx context.Context, broadcasterID string) error {
+	client, err := t.As(broadcasterID)
+	if err != nil {
+		return err
+	}
+	//A token which twitch already considers invalid does not need revoking
+	if err := client.RevokeToken(ctx); err != nil && !IsUnauthorized(err) {
+		return err
+	}
+	return t.Remove(broadcasterID)
+}
+
+//RunValidator validates the token granted by every broadcaster straight away and then each interval until ctx is done,
+//as twitch requires, calling onInvalid for each token which is no longer valid. The TokenStore must implement
+//tokenstore.Lister. Invalid tokens are not removed from the store, so onInvalid should call Remove if they will not be
+//used again.
+func (t *TenantClient) RunValidator(ctx context.Context, interval time.Duration, onInvalid func(broadcasterID string, err error)) {
+	if interval <= 0 {
+		interval = defaultValidationInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		t.validateAll(ctx, onInvalid)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//validateAll validates the token granted by every broadcaster once
+func (t *TenantClient) validateAll(ctx context.Context, onInvalid func(broadcasterID string, err error)) {
+	index, err := t.ScopeIndex()
+	if err != nil {
+		t.flow.log.Warnf("Failed to list broadcaster tokens for validation due to error %v", err)
+		return
+	}
+	for broadcasterID := range index {
+		client, err := t.As(broadcasterID)
+		if err == nil {
+			_, err = client.ValidateToken(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if IsUnauthorized(err) {
+			t.flow.log.Warnf("Token granted by broadcaster %v is no longer valid: %v", broadcasterID, err)
+			onInvalid(broadcasterID, err)
+		} else if err != nil {
+			t.flow.log.Warnf("Failed to validate token granted by broadcaster %v due to error %v", broadcasterID, err)
+		}
+	}
+}
+
+//Scopes returns the scopes granted by a broadcaster, or nil if they have not granted a token
+func (t *TenantClient) Scopes(broadcasterID string) ([]string, error) {
+	tok, err := t.store.Get(broadcasterID)
+	if errors.Is(err, tokenstore.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return tok.Scopes, nil
+}
+
+//HasScopes reports whether a broadcaster has granted a token with all of scopes
+func (t *TenantClient) HasScopes(broadcasterID string, scopes ...string) (bool, error) {
+	granted, err := t.Scopes(broadcasterID)
+	if err != nil || granted == nil {
+		return false, err
+	}
+	return len(missingScopes(granted, scopes)) == 0, nil
+}
+
+//ScopeIndex returns the scopes granted by every broadcaster with a stored token, keyed by broadcaster ID. The
+//TokenStore must implement tokenstore.Lister.
+func (t *TenantClient) ScopeIndex() (map[string][]string, error) {
+	lister, ok := t.store.(tokenstore.Lister)
+	if !ok {
+		return nil, errors.New("the token store cannot list its tokens")
+	}
+	keys, err := lister.Keys()
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string][]string, len(keys))
+	for _, key := range keys {
+		if key == tokenstore.AppKey {
+			continue
+		}
+		tok, err := t.store.Get(key)
+		if errors.Is(err, tokenstore.ErrNotFound) {
+			//Deleted since the keys were listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		index[key] = tok.Scopes
+	}
+	return index, nil
+}
+
+//BroadcastersWithScopes returns the IDs of every broadcaster who has granted a token with all of scopes, in order
+func (t *TenantClient) BroadcastersWithScopes(scopes ...string) ([]string, error) {
+	index, err := t.ScopeIndex()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id, granted := range index {
+		if len(missingScopes(granted, scopes)) == 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+//missingScopes returns the members of required which are not in granted
+func missingScopes(granted, required []string) []string {
+	var missing []string
+	for _, scope := range required {
+		found := false
+		for _, g := range granted {
+			if g == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
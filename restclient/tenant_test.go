@@ -0,0 +1,156 @@
+package restclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/tokenstore"
+	"golang.org/x/oauth2"
+)
+
+//storedToken creates an unexpired token granting scopes
+func storedToken(accessToken string, scopes ...string) *tokenstore.Token {
+	return &tokenstore.Token{
+		Token:  oauth2.Token{AccessToken: accessToken, Expiry: time.Now().Add(time.Hour)},
+		Scopes: scopes,
+	}
+}
+
+//newTestTenantClient creates a TenantClient backed by a memory store holding tokens for alice, who granted bits:read
+//and channel:read:subscriptions, and bob, who granted only bits:read. Alice's token is accepted by the server's
+//validation endpoint, but bob's is not.
+func newTestTenantClient(t *testing.T) (*TenantClient, tokenstore.Store) {
+	t.Helper()
+	server := newOAuthServer(t)
+	app := server.client(t)
+	store := tokenstore.NewMemoryStore()
+	store.Put(tokenstore.AppKey, storedToken("token1"))
+	store.Put("alice", storedToken("token1", ScopeReadBits, ScopeReadChannelSubscriptios))
+	store.Put("bob", storedToken("stale", ScopeReadBits))
+	flow := NewAuthCodeFlow(AuthCodeConfig{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{AuthURL: server.URL + "/oauth2/authorize", TokenURL: server.URL + "/oauth2/token"},
+		TokenStore:   store,
+	}, nil)
+	tenants, err := NewTenantClient(app, flow)
+	if err != nil {
+		t.Fatalf("NewTenantClient() error = %v", err)
+	}
+	return tenants, store
+}
+
+func TestTenantClientAs(t *testing.T) {
+	tests := []struct {
+		name        string
+		broadcaster string
+		scopes      []string
+		wantErr     error
+	}{
+		{name: "no scopes required", broadcaster: "bob"},
+		{name: "granted scopes", broadcaster: "alice", scopes: []string{ScopeReadBits, ScopeReadChannelSubscriptios}},
+		{name: "missing scopes", broadcaster: "bob", scopes: []string{ScopeReadBits, ScopeReadChannelSubscriptios}, wantErr: ErrMissingScopes},
+		{name: "no token", broadcaster: "carol", wantErr: tokenstore.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenants, _ := newTestTenantClient(t)
+			client, err := tenants.As(tt.broadcaster, tt.scopes...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("As() error = %v, want %v", err, tt.wantErr)
+			}
+			if (client != nil) != (tt.wantErr == nil) {
+				t.Errorf("As() = %v, want a client only when there is no error", client)
+			}
+
+			fallback := tenants.AsOrApp(tt.broadcaster, tt.scopes...)
+			if usedApp := fallback == tenants.App(); usedApp != (tt.wantErr != nil) {
+				t.Errorf("AsOrApp() used the app client: %v, want %v", usedApp, tt.wantErr != nil)
+			}
+		})
+	}
+}
+
+func TestTenantClientReplacesClientWhenTokenChanges(t *testing.T) {
+	tenants, store := newTestTenantClient(t)
+	first, err := tenants.As("alice")
+	if err != nil {
+		t.Fatalf("As() error = %v", err)
+	}
+	if again, _ := tenants.As("alice"); again != first {
+		t.Error("As() created a new client although the stored token had not changed")
+	}
+
+	store.Put("alice", storedToken("reauthorized"))
+	replaced, err := tenants.As("alice")
+	if err != nil {
+		t.Fatalf("As() error = %v", err)
+	}
+	if replaced == first {
+		t.Error("As() reused the client after the stored token was replaced")
+	}
+	if again, _ := tenants.As("alice"); again != replaced {
+		t.Error("As() created a new client although the stored token had not changed since it was replaced")
+	}
+}
+
+func TestTenantClientScopeIndex(t *testing.T) {
+	tenants, _ := newTestTenantClient(t)
+	index, err := tenants.ScopeIndex()
+	if err != nil {
+		t.Fatalf("ScopeIndex() error = %v", err)
+	}
+	want := map[string][]string{
+		"alice": {ScopeReadBits, ScopeReadChannelSubscriptios},
+		"bob":   {ScopeReadBits},
+	}
+	if !reflect.DeepEqual(index, want) {
+		t.Errorf("ScopeIndex() = %v, want %v without the app token", index, want)
+	}
+}
+
+func TestTenantClientBroadcastersWithScopes(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		want   []string
+	}{
+		{scopes: nil, want: []string{"alice", "bob"}},
+		{scopes: []string{ScopeReadBits}, want: []string{"alice", "bob"}},
+		{scopes: []string{ScopeReadBits, ScopeReadChannelSubscriptios}, want: []string{"alice"}},
+		{scopes: []string{ScopeUserEdit}, want: nil},
+	}
+	tenants, _ := newTestTenantClient(t)
+	for _, tt := range tests {
+		got, err := tenants.BroadcastersWithScopes(tt.scopes...)
+		if err != nil {
+			t.Fatalf("BroadcastersWithScopes(%v) error = %v", tt.scopes, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("BroadcastersWithScopes(%v) = %v, want %v", tt.scopes, got, tt.want)
+		}
+	}
+}
+
+func TestTenantClientValidatesEveryToken(t *testing.T) {
+	tenants, _ := newTestTenantClient(t)
+	var invalid []string
+	tenants.validateAll(context.Background(), func(broadcasterID string, err error) {
+		if !IsUnauthorized(err) {
+			t.Errorf("onInvalid(%v) was passed %v, want an error satisfying IsUnauthorized", broadcasterID, err)
+		}
+		invalid = append(invalid, broadcasterID)
+	})
+	if want := []string{"bob"}; !reflect.DeepEqual(invalid, want) {
+		t.Errorf("tokens for %v were reported invalid, want %v", invalid, want)
+	}
+}
+
+func TestNewTenantClientRequiresStore(t *testing.T) {
+	flow := NewAuthCodeFlow(AuthCodeConfig{ClientID: "client"}, nil)
+	if _, err := NewTenantClient(nil, flow); err == nil {
+		t.Error("NewTenantClient() error = nil for a flow without a token store")
+	}
+}
@@ -1,14 +1,12 @@
 package restclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
 const usersEndpoint = apiBaseURL + "/users"
@@ -33,14 +31,19 @@ type twitchGetUserResult struct {
 
 //GetUsers returns user data for up to 100 user IDs or names (https://dev.twitch.tv/docs/api/reference#get-users)
 func (c *Client) GetUsers(ids []string, logins []string) ([]TwitchUser, error) {
-	logrus.Debugf("Requesting users with ids %v and logins %v", ids, logins)
+	return c.GetUsersContext(context.Background(), ids, logins)
+}
+
+//GetUsersContext is GetUsers, making the request using ctx
+func (c *Client) GetUsersContext(ctx context.Context, ids []string, logins []string) ([]TwitchUser, error) {
+	c.log.Debugf("Requesting users with ids %v and logins %v", ids, logins)
 	if len(ids)+len(logins) > 100 {
 		return nil, fmt.Errorf("only a maximum of 100 users can be requested at a time")
 	}
 	//Build query URL
 	url, err := url.Parse(usersEndpoint)
 	if err != nil {
-		logrus.Errorf("Failed to parse subscription endpoint with error %v", err)
+		c.log.Errorf("Failed to parse subscription endpoint with error %v", err)
 		return nil, err
 	}
 	query := url.Query()
@@ -53,17 +56,17 @@ func (c *Client) GetUsers(ids []string, logins []string) ([]TwitchUser, error) {
 	url.RawQuery = query.Encode()
 
 	//Send GET request
-	req, err := http.NewRequest("GET", url.String(), http.NoBody)
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), http.NoBody)
 	if err != nil {
-		logrus.Warnf("Failed to make GetUsers request due to error %v", err)
+		c.log.Warnf("Failed to make GetUsers request due to error %v", err)
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Client-ID", c.clientID)
-	logrus.Tracef("Sending request %#v to retrieve users", req)
+	c.log.Tracef("Sending request %#v to retrieve users", req)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		logrus.Warnf("Failed to make GetUsers request due to error %v", err)
+		c.log.Warnf("Failed to make GetUsers request due to error %v", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -71,16 +74,16 @@ func (c *Client) GetUsers(ids []string, logins []string) ([]TwitchUser, error) {
 	//Decode response
 	var result twitchGetUserResult
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
-		dump, _ := httputil.DumpResponse(resp, true)
-		logrus.Infof("Got non-OK response %q to subscription list request", dump)
-		return nil, fmt.Errorf("got non-OK response %q to subscription list request", dump)
+		apiErr := newAPIError(resp)
+		c.log.Infof("Got non-OK response to users request: %v", apiErr)
+		return nil, apiErr
 	}
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
-		logrus.Warnf("Failed to decode response to subscriptions list request due to error %v", err)
-		logrus.Tracef("response: %v", resp)
+		c.log.Warnf("Failed to decode response to subscriptions list request due to error %v", err)
+		c.log.Tracef("response: %v", resp)
 		return nil, err
 	}
-	logrus.Trace(result)
+	c.log.Trace(result)
 	return result.Data, nil
 }
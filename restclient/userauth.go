@@ -0,0 +1,290 @@
+package restclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/tokenstore"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+const (
+	defaultStateTTL = 10 * time.Minute
+	stateCookieName = "nazuna_oauth_state"
+)
+
+var (
+	//ErrInvalidState is returned when the state passed to an authorization callback was not issued by the AuthCodeFlow,
+	//has already been used or has expired, which may indicate a cross-site request forgery attempt
+	ErrInvalidState = errors.New("invalid or expired oauth state")
+)
+
+//AuthorizationError is returned when the user does not authorize the application, or twitch reports some other error
+//to the redirect URL
+type AuthorizationError struct {
+	ErrorCode   string
+	Description string
+}
+
+func (e *AuthorizationError) Error() string {
+	return fmt.Sprintf("authorization failed with error %v: %v", e.ErrorCode, e.Description)
+}
+
+//AuthCodeConfig configures an AuthCodeFlow
+type AuthCodeConfig struct {
+	ClientID     string
+	ClientSecret string
+	//RedirectURL is the URL at which the handler returned by CallbackHandler is served. It must exactly match one of
+	//the redirect URLs registered for the application.
+	RedirectURL string
+	//Scopes are the scopes requested from the user
+	Scopes []string
+	//Endpoint contains the authorize and token URLs, defaulting to twitch's. They may be replaced to test against a
+	//mock server.
+	Endpoint oauth2.Endpoint
+	//ForceVerify makes twitch ask the user to authorize the application again, even if they already have
+	ForceVerify bool
+	//StateTTL is how long the user has to complete authorization after the URL is generated, defaulting to ten minutes
+	StateTTL time.Duration
+	//TokenStore, if set, holds user tokens keyed by user ID. Tokens obtained by CallbackHandler are saved to it, and
+	//refreshed tokens replace them, so that users do not need to authorize the application again after a restart.
+	TokenStore tokenstore.Store
+}
+
+//AuthCodeFlow obtains user access tokens using the OAuth authorization code flow, and creates clients which make
+//requests on behalf of the user
+type AuthCodeFlow struct {
+	conf        *oauth2.Config
+	forceVerify bool
+	stateTTL    time.Duration
+	store       tokenstore.Store
+	log         *logging.Entry
+
+	statesLock sync.Mutex
+	states     map[string]authState
+}
+
+type authState struct {
+	expires time.Time
+	//cookieBound is set if the state was also stored in a cookie by LoginHandler, in which case the callback must
+	//present the same cookie
+	cookieBound bool
+}
+
+//NewAuthCodeFlow creates an AuthCodeFlow which logs to log. The client secret and every token it issues are
+//registered with log's redactor.
+func NewAuthCodeFlow(config AuthCodeConfig, log *logging.Entry) *AuthCodeFlow {
+	endpoint := config.Endpoint
+	if endpoint.AuthURL == "" && endpoint.TokenURL == "" {
+		endpoint = endpoints.Twitch
+	}
+	stateTTL := config.StateTTL
+	if stateTTL <= 0 {
+		stateTTL = defaultStateTTL
+	}
+	log.Redactor().AddSecret(config.ClientSecret)
+	return &AuthCodeFlow{
+		conf: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     endpoint,
+			RedirectURL:  config.RedirectURL,
+			Scopes:       config.Scopes,
+		},
+		forceVerify: config.ForceVerify,
+		stateTTL:    stateTTL,
+		store:       config.TokenStore,
+		log:         log,
+		states:      make(map[string]authState),
+	}
+}
+
+//AuthURL returns the URL to which the user should be sent to authorize the application, along with the state which
+//twitch will pass back to the callback. Each state may be used once, and only before StateTTL has passed.
+func (f *AuthCodeFlow) AuthURL() (string, string, error) {
+	return f.newAuthURL(false)
+}
+
+func (f *AuthCodeFlow) newAuthURL(cookieBound bool) (string, string, error) {
+	stateBytes := make([]byte, 32)
+	if _, err := rand.Read(stateBytes); err != nil {
+		return "", "", fmt.Errorf("failed to generate oauth state due to error %w", err)
+	}
+	state := base64.RawURLEncoding.EncodeToString(stateBytes)
+
+	now := time.Now()
+	f.statesLock.Lock()
+	for s, entry := range f.states {
+		if now.After(entry.expires) {
+			delete(f.states, s)
+		}
+	}
+	f.states[state] = authState{expires: now.Add(f.stateTTL), cookieBound: cookieBound}
+	f.statesLock.Unlock()
+
+	var opts []oauth2.AuthCodeOption
+	if f.forceVerify {
+		opts = append(opts, oauth2.SetAuthURLParam("force_verify", "true"))
+	}
+	return f.conf.AuthCodeURL(state, opts...), state, nil
+}
+
+//consumeState checks that state was issued by this flow and has not expired, removing it so it cannot be reused
+func (f *AuthCodeFlow) consumeState(state string) (authState, bool) {
+	f.statesLock.Lock()
+	defer f.statesLock.Unlock()
+	entry, ok := f.states[state]
+	if !ok {
+		return authState{}, false
+	}
+	delete(f.states, state)
+	return entry, time.Now().Before(entry.expires)
+}
+
+//Exchange checks that state was issued by AuthURL and exchanges the authorization code passed to the callback for a
+//user access token
+func (f *AuthCodeFlow) Exchange(ctx context.Context, state, code string) (*oauth2.Token, error) {
+	if _, ok := f.consumeState(state); !ok {
+		return nil, ErrInvalidState
+	}
+	return f.exchange(ctx, code)
+}
+
+func (f *AuthCodeFlow) exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+	tok, err := f.conf.Exchange(ctx, code)
+	if err != nil {
+		f.log.Warnf("Failed to exchange authorization code for a user access token due to error %v", err)
+		return nil, err
+	}
+	f.log.Redactor().AddSecret(tok.AccessToken, tok.RefreshToken)
+	return tok, nil
+}
+
+//LoginHandler returns an http.Handler which redirects the user to twitch to authorize the application. The state is
+//also stored in a cookie, which the callback checks so that a user cannot be tricked into completing a flow started by
+//someone else.
+func (f *AuthCodeFlow) LoginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authURL, state, err := f.newAuthURL(true)
+		if err != nil {
+			f.log.Errorf("Failed to start authorization due to error %v", err)
+			http.Error(w, "failed to start authorization", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     stateCookieName,
+			Value:    state,
+			MaxAge:   int(f.stateTTL / time.Second),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, authURL, http.StatusFound)
+	})
+}
+
+//CallbackHandler returns an http.Handler to be served at the redirect URL. It checks the state, exchanges the code for
+//a token and passes the token to onToken, which should write the response shown to the user. If a TokenStore is
+//configured the token is saved to it first. If authorization fails, the handler responds with an error instead.
+func (f *AuthCodeFlow) CallbackHandler(onToken func(w http.ResponseWriter, r *http.Request, tok *oauth2.Token)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		state := query.Get("state")
+		entry, ok := f.consumeState(state)
+		if ok && entry.cookieBound {
+			cookie, err := r.Cookie(stateCookieName)
+			ok = err == nil && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) == 1
+		}
+		if !ok {
+			f.log.Warnf("Rejected authorization callback with invalid state")
+			http.Error(w, ErrInvalidState.Error(), http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: stateCookieName, MaxAge: -1})
+
+		if errCode := query.Get("error"); errCode != "" {
+			err := &AuthorizationError{ErrorCode: errCode, Description: query.Get("error_description")}
+			f.log.Infof("User did not authorize the application: %v", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		tok, err := f.exchange(r.Context(), query.Get("code"))
+		if err != nil {
+			http.Error(w, "failed to exchange authorization code", http.StatusBadGateway)
+			return
+		}
+		if f.store != nil {
+			if _, err := f.SaveToken(r.Context(), tok); err != nil {
+				http.Error(w, "failed to save user access token", http.StatusInternalServerError)
+				return
+			}
+		}
+		onToken(w, r, tok)
+	})
+}
+
+//TokenSource returns a TokenSource which starts from tok and refreshes it using its refresh token once it expires
+func (f *AuthCodeFlow) TokenSource(tok *oauth2.Token) oauth2.TokenSource {
+	return userTokenSource(context.Background(), f.conf, tok, f.log)
+}
+
+//Client returns a REST client which makes requests on behalf of the user who was issued tok, refreshing the token
+//automatically when it expires
+func (f *AuthCodeFlow) Client(tok *oauth2.Token) *Client {
+	f.log.Redactor().AddSecret(tok.AccessToken, tok.RefreshToken)
+	return newClient(f.conf.ClientID, f.conf.Endpoint.TokenURL, f.TokenSource(tok), nil, f.log)
+}
+
+//SaveToken looks up the user who was issued tok and saves it to the TokenStore under their ID, which is returned
+func (f *AuthCodeFlow) SaveToken(ctx context.Context, tok *oauth2.Token) (string, error) {
+	if f.store == nil {
+		return "", errors.New("no token store is configured")
+	}
+	users, err := f.Client(tok).GetUsersContext(ctx, nil, nil)
+	if err != nil {
+		f.log.Warnf("Failed to look up the user who authorized the application due to error %v", err)
+		return "", err
+	}
+	if len(users) == 0 {
+		return "", errors.New("no user is associated with the token")
+	}
+	userID := users[0].ID
+	if err := f.store.Put(userID, tokenstore.NewToken(tok)); err != nil {
+		f.log.Errorf("Failed to save token for user %v due to error %v", userID, err)
+		return "", err
+	}
+	return userID, nil
+}
+
+//UserClient returns a REST client which makes requests on behalf of the user with the given ID, using the token held
+//for them in the TokenStore. Refreshed tokens are saved back to the store. If no token is held for the user, the
+//returned error satisfies errors.Is(err, tokenstore.ErrNotFound).
+func (f *AuthCodeFlow) UserClient(userID string) (*Client, error) {
+	if f.store == nil {
+		return nil, errors.New("no token store is configured")
+	}
+	tok, err := f.store.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+	f.log.Redactor().AddSecret(tok.AccessToken, tok.RefreshToken)
+	source := oauth2.ReuseTokenSource(tok.OAuth2(), persistingTokenSource{
+		source: redactingTokenSource{
+			source:   f.conf.TokenSource(context.Background(), tok.OAuth2()),
+			redactor: f.log.Redactor(),
+		},
+		store: f.store,
+		key:   userID,
+		log:   f.log,
+	})
+	return newClient(f.conf.ClientID, f.conf.Endpoint.TokenURL, source, nil, f.log), nil
+}
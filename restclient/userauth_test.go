@@ -0,0 +1,157 @@
+package restclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+//newTestAuthCodeFlow creates an AuthCodeFlow whose token endpoint issues the access token "user-token" for any code
+func newTestAuthCodeFlow(t *testing.T) *AuthCodeFlow {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"user-token","refresh_token":"refresh","token_type":"bearer","expires_in":3600}`))
+	}))
+	t.Cleanup(server.Close)
+	return NewAuthCodeFlow(AuthCodeConfig{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/callback",
+		Endpoint:     oauth2.Endpoint{AuthURL: server.URL + "/authorize", TokenURL: server.URL + "/token"},
+	}, nil)
+}
+
+//login runs the LoginHandler, returning the state it issued and the cookie it set
+func login(t *testing.T, f *AuthCodeFlow) (string, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	f.LoginHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("LoginHandler responded %v, want %v", rec.Code, http.StatusFound)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("LoginHandler redirected to an invalid URL: %v", err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stateCookieName {
+		t.Fatalf("LoginHandler set cookies %v, want the state cookie", cookies)
+	}
+	return location.Query().Get("state"), cookies[0]
+}
+
+func TestCallbackHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		//cookie returns the cookie sent to the callback, given the one set by the login handler
+		cookie func(issued *http.Cookie) *http.Cookie
+		//unbound uses a state from AuthURL rather than the login handler
+		unbound bool
+		//state replaces the issued state, if set
+		state    string
+		errParam string
+		want     int
+		wantTok  bool
+	}{
+		{
+			name:    "matching cookie",
+			cookie:  func(issued *http.Cookie) *http.Cookie { return issued },
+			want:    http.StatusOK,
+			wantTok: true,
+		},
+		{
+			name:   "missing cookie",
+			cookie: func(issued *http.Cookie) *http.Cookie { return nil },
+			want:   http.StatusBadRequest,
+		},
+		{
+			name: "wrong cookie",
+			cookie: func(issued *http.Cookie) *http.Cookie {
+				return &http.Cookie{Name: stateCookieName, Value: "forged"}
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name:   "unknown state",
+			cookie: func(issued *http.Cookie) *http.Cookie { return &http.Cookie{Name: stateCookieName, Value: "forged"} },
+			state:  "forged",
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:    "state from AuthURL needs no cookie",
+			cookie:  func(issued *http.Cookie) *http.Cookie { return nil },
+			unbound: true,
+			want:    http.StatusOK,
+			wantTok: true,
+		},
+		{
+			name:     "user denies authorization",
+			cookie:   func(issued *http.Cookie) *http.Cookie { return issued },
+			errParam: "access_denied",
+			want:     http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestAuthCodeFlow(t)
+			state, cookie := login(t, f)
+			if tt.unbound {
+				var err error
+				if _, state, err = f.AuthURL(); err != nil {
+					t.Fatalf("AuthURL() error = %v", err)
+				}
+			}
+			if tt.state != "" {
+				state = tt.state
+			}
+
+			var got *oauth2.Token
+			handler := f.CallbackHandler(func(w http.ResponseWriter, r *http.Request, tok *oauth2.Token) {
+				got = tok
+			})
+			query := url.Values{"state": {state}, "code": {"code"}}
+			if tt.errParam != "" {
+				query.Set("error", tt.errParam)
+			}
+			req := httptest.NewRequest("GET", "/callback?"+query.Encode(), nil)
+			if c := tt.cookie(cookie); c != nil {
+				req.AddCookie(c)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("CallbackHandler responded %v, want %v", rec.Code, tt.want)
+			}
+			if tt.wantTok && (got == nil || got.AccessToken != "user-token") {
+				t.Errorf("onToken recieved %v, want the issued token", got)
+			} else if !tt.wantTok && got != nil {
+				t.Errorf("onToken was called with %v, want it not to be called", got)
+			}
+		})
+	}
+}
+
+func TestCallbackHandlerRejectsReplayedState(t *testing.T) {
+	f := newTestAuthCodeFlow(t)
+	state, cookie := login(t, f)
+	calls := 0
+	handler := f.CallbackHandler(func(w http.ResponseWriter, r *http.Request, tok *oauth2.Token) {
+		calls++
+	})
+	for i, want := range []int{http.StatusOK, http.StatusBadRequest} {
+		req := httptest.NewRequest("GET", "/callback?"+url.Values{"state": {state}, "code": {"code"}}.Encode(), nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("callback %v responded %v, want %v", i, rec.Code, want)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("onToken was called %v times, want 1", calls)
+	}
+}
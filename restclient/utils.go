@@ -2,6 +2,7 @@ package restclient
 
 import (
 	"net/url"
+	"strconv"
 
 	"github.com/callummance/nazuna/messages"
 )
@@ -9,6 +10,7 @@ import (
 type pagination struct {
 	Before string `json:"before,omitempty"`
 	After  string `json:"after,omitempty"`
+	First  int    `json:"first,omitempty"`
 }
 
 func (p pagination) insertToValues(initialValues *url.Values) {
@@ -17,20 +19,15 @@ func (p pagination) insertToValues(initialValues *url.Values) {
 	} else if p.Before != "" {
 		(*initialValues)["before"] = []string{p.Before}
 	}
+	if p.First > 0 {
+		(*initialValues)["first"] = []string{strconv.Itoa(p.First)}
+	}
 }
 
 type paginationCursor struct {
 	Cursor string `json:"cursor"`
 }
 
-type subscriptionsPage struct {
-	Total      int                     `json:"total"`
-	Data       []messages.Subscription `json:"data"`
-	Limit      int                     `json:"limit"`
-	Pagination paginationCursor        `json:"pagination"`
-}
+type subscriptionsPage = Page[messages.Subscription]
 
-type streamsPage struct {
-	Data       []TwitchStream   `json:"data"`
-	Pagination paginationCursor `json:"pagination"`
-}
+type streamsPage = Page[TwitchStream]
@@ -0,0 +1,174 @@
+package restclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//defaultValidationInterval is how often tokens are validated in the background, as required by twitch
+const defaultValidationInterval = time.Hour
+
+//CredentialsError is returned when twitch rejects the client ID or secret while issuing an app access token
+type CredentialsError struct {
+	//StatusCode is the HTTP status code of the response from the token endpoint
+	StatusCode int
+	//Message is the message given by twitch, such as "invalid client secret"
+	Message string
+}
+
+func (e *CredentialsError) Error() string {
+	return fmt.Sprintf("twitch rejected the client credentials with status %v: %v", e.StatusCode, e.Message)
+}
+
+//credentialsError converts the error returned when fetching a token into a CredentialsError if twitch rejected the
+//credentials, and returns nil otherwise
+func credentialsError(err error) *CredentialsError {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) || retrieveErr.Response == nil {
+		return nil
+	}
+	status := retrieveErr.Response.StatusCode
+	if status != http.StatusBadRequest && status != http.StatusUnauthorized && status != http.StatusForbidden {
+		return nil
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	message := string(retrieveErr.Body)
+	if json.Unmarshal(retrieveErr.Body, &body) == nil && body.Message != "" {
+		message = body.Message
+	}
+	return &CredentialsError{StatusCode: status, Message: message}
+}
+
+//TokenInfo describes an access token, as returned by the twitch validation endpoint
+type TokenInfo struct {
+	ClientID string   `json:"client_id"`
+	Login    string   `json:"login"`
+	UserID   string   `json:"user_id"`
+	Scopes   []string `json:"scopes"`
+	//Expiry is the time at which the token expires, calculated from the expires_in field of the response
+	Expiry time.Time `json:"-"`
+}
+
+//oauthEndpoint returns the URL of another endpoint of the OAuth server which issues tokens at tokenURL, such as
+//validate or revoke
+func oauthEndpoint(tokenURL, name string) string {
+	u, err := url.Parse(tokenURL)
+	if err != nil {
+		return tokenURL
+	}
+	u.Path = strings.TrimSuffix(path.Dir(u.Path), "/") + "/" + name
+	return u.String()
+}
+
+//ValidateToken checks the client's current access token with twitch, returning the details of the token. If twitch
+//reports that the token is invalid, the returned error satisfies IsUnauthorized.
+func (c *Client) ValidateToken(ctx context.Context) (*TokenInfo, error) {
+	tok, err := c.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", oauthEndpoint(c.tokenURL, "validate"), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "OAuth "+tok.AccessToken)
+	resp, err := c.oauthClient.Do(req)
+	if err != nil {
+		c.log.Warnf("Failed to make token validation request due to error %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := newAPIError(resp)
+		c.log.Infof("Got non-OK response to token validation request: %v", apiErr)
+		return nil, apiErr
+	}
+	var result struct {
+		TokenInfo
+		ExpiresIn int64 `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		c.log.Warnf("Failed to decode response to token validation request due to error %v", err)
+		return nil, err
+	}
+	info := result.TokenInfo
+	info.Expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return &info, nil
+}
+
+//RevokeToken revokes the client's current access token, after which requests made by the client will fail. It should
+//be used when a broadcaster stops using the application.
+func (c *Client) RevokeToken(ctx context.Context) error {
+	tok, err := c.tokens.Token()
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"client_id": []string{c.clientID},
+		"token":     []string{tok.AccessToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", oauthEndpoint(c.tokenURL, "revoke"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.oauthClient.Do(req)
+	if err != nil {
+		c.log.Warnf("Failed to make token revocation request due to error %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := newAPIError(resp)
+		c.log.Infof("Got non-OK response to token revocation request: %v", apiErr)
+		return apiErr
+	}
+	return nil
+}
+
+//RunValidator validates the client's token straight away and then every interval until ctx is done, calling onInvalid
+//if twitch reports that the token is no longer valid. Twitch requires applications to validate user tokens every hour,
+//which is the default interval. Other errors, such as network failures, are logged and the token is checked again at
+//the next interval. If the client uses an app access token, an invalid token is discarded and a new one requested.
+func (c *Client) RunValidator(ctx context.Context, interval time.Duration, onInvalid func(error)) {
+	if interval <= 0 {
+		interval = defaultValidationInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := c.ValidateToken(ctx)
+		if IsUnauthorized(err) {
+			c.log.Warnf("Access token is no longer valid: %v", err)
+			if c.resetToken() {
+				if _, err := c.tokens.Token(); err != nil {
+					c.log.Errorf("Failed to obtain a new app access token due to error %v", err)
+				} else {
+					c.log.Infof("Replaced invalid app access token")
+				}
+			}
+			onInvalid(err)
+		} else if err != nil && ctx.Err() == nil {
+			c.log.Warnf("Failed to validate access token due to error %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
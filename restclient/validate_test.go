@@ -0,0 +1,200 @@
+package restclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//oauthServer stands in for the twitch OAuth server. Each token it issues is "token" followed by a count, and it
+//accepts only the most recent one.
+type oauthServer struct {
+	*httptest.Server
+	lock   sync.Mutex
+	issued int
+	//rejectCredentials makes the token endpoint respond as twitch does to an incorrect client secret
+	rejectCredentials bool
+	revoked           []url.Values
+}
+
+func newOAuthServer(t *testing.T) *oauthServer {
+	s := &oauthServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if s.rejectCredentials {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"status":403,"message":"invalid client secret"}`))
+			return
+		}
+		s.issued++
+		fmt.Fprintf(w, `{"access_token":"token%v","token_type":"bearer","expires_in":3600}`, s.issued)
+	})
+	mux.HandleFunc("/oauth2/validate", func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		current := fmt.Sprint("OAuth token", s.issued)
+		s.lock.Unlock()
+		if r.Header.Get("Authorization") != current {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status":401,"message":"invalid access token"}`))
+			return
+		}
+		w.Write([]byte(`{"client_id":"client","login":"nazuna","user_id":"1234","scopes":["bits:read"],"expires_in":3600}`))
+	})
+	mux.HandleFunc("/oauth2/revoke", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.revoked = append(s.revoked, r.PostForm)
+		if r.PostForm.Get("client_id") != "client" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":400,"message":"Invalid client id"}`))
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+//rotate makes the server issue a new token, so that the one held by clients is no longer valid
+func (s *oauthServer) rotate() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.issued++
+}
+
+func (s *oauthServer) client(t *testing.T) *Client {
+	t.Helper()
+	c, err := NewClient(ClientOpts{ClientID: "client", ClientSecret: "secret", TokenURL: s.URL + "/oauth2/token"})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return c
+}
+
+func TestValidateToken(t *testing.T) {
+	s := newOAuthServer(t)
+	c := s.client(t)
+	info, err := c.ValidateToken(context.Background())
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	if info.ClientID != "client" || info.UserID != "1234" || len(info.Scopes) != 1 {
+		t.Errorf("ValidateToken() = %+v, want the details of the token", info)
+	}
+	if until := time.Until(info.Expiry); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("ValidateToken() expiry is %v away, want an hour", until)
+	}
+
+	s.rotate()
+	if _, err := c.ValidateToken(context.Background()); !IsUnauthorized(err) {
+		t.Errorf("ValidateToken() with a stale token error = %v, want one satisfying IsUnauthorized", err)
+	}
+}
+
+func TestRunValidatorReplacesInvalidToken(t *testing.T) {
+	s := newOAuthServer(t)
+	c := s.client(t)
+	s.rotate()
+	invalid := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.RunValidator(ctx, time.Hour, func(err error) { invalid <- err })
+	select {
+	case err := <-invalid:
+		if !IsUnauthorized(err) {
+			t.Errorf("onInvalid was passed %v, want an error satisfying IsUnauthorized", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("onInvalid was not called for a stale token")
+	}
+	if _, err := c.ValidateToken(context.Background()); err != nil {
+		t.Errorf("ValidateToken() after replacing the token error = %v", err)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		wantErr  bool
+	}{
+		{name: "revoked", clientID: "client"},
+		{name: "rejected", clientID: "other", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newOAuthServer(t)
+			c := s.client(t)
+			c.clientID = tt.clientID
+			err := c.RevokeToken(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RevokeToken() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			var apiErr *APIError
+			if tt.wantErr && (!errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest) {
+				t.Errorf("RevokeToken() error = %#v, want an *APIError with status 400", err)
+			}
+			if len(s.revoked) != 1 || s.revoked[0].Get("token") != "token1" {
+				t.Errorf("revocation requests = %v, want one for token1", s.revoked)
+			}
+		})
+	}
+}
+
+func TestCredentialsError(t *testing.T) {
+	retrieveErr := func(status int, body string) error {
+		return &oauth2.RetrieveError{Response: &http.Response{StatusCode: status}, Body: []byte(body)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want *CredentialsError
+	}{
+		{
+			name: "message from a JSON body",
+			err:  retrieveErr(http.StatusForbidden, `{"status":403,"message":"invalid client secret"}`),
+			want: &CredentialsError{StatusCode: http.StatusForbidden, Message: "invalid client secret"},
+		},
+		{
+			name: "plain body",
+			err:  retrieveErr(http.StatusBadRequest, "invalid client"),
+			want: &CredentialsError{StatusCode: http.StatusBadRequest, Message: "invalid client"},
+		},
+		{
+			name: "wrapped",
+			err:  &url.Error{Op: "Post", URL: "https://id.twitch.tv/oauth2/token", Err: retrieveErr(http.StatusUnauthorized, "")},
+			want: &CredentialsError{StatusCode: http.StatusUnauthorized},
+		},
+		{name: "server error", err: retrieveErr(http.StatusInternalServerError, "oops")},
+		{name: "network error", err: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := credentialsError(tt.err)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("credentialsError() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClientRejectsCredentials(t *testing.T) {
+	s := newOAuthServer(t)
+	s.rejectCredentials = true
+	_, err := NewClient(ClientOpts{ClientID: "client", ClientSecret: "wrong", TokenURL: s.URL + "/oauth2/token"})
+	var credErr *CredentialsError
+	if !errors.As(err, &credErr) || credErr.StatusCode != http.StatusForbidden || credErr.Message != "invalid client secret" {
+		t.Errorf("NewClient() error = %v, want a *CredentialsError giving twitch's message", err)
+	}
+}
@@ -0,0 +1,151 @@
+package tokenstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//FileStore is a Store which keeps tokens in a file encrypted with AES-GCM, so that they are remembered across
+//restarts without being readable by anyone who lacks the key. The whole file is rewritten on every change, replacing
+//the old one atomically. It should only be used by a single process at a time.
+type FileStore struct {
+	lock   sync.RWMutex
+	path   string
+	aead   cipher.AEAD
+	tokens map[string]Token
+}
+
+//OpenFileStore opens the store kept at path, which is created on the first write if it does not already exist. key
+//must be 16, 24 or 32 bytes long, selecting AES-128, AES-192 or AES-256.
+func OpenFileStore(path string, key []byte) (*FileStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{
+		path:   path,
+		aead:   aead,
+		tokens: make(map[string]Token),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//load decrypts the file into memory
+func (s *FileStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(data) < nonceSize {
+		return fmt.Errorf("token store %v is truncated", s.path)
+	}
+	plaintext, err := s.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt token store %v, the key may be wrong: %w", s.path, err)
+	}
+	return json.Unmarshal(plaintext, &s.tokens)
+}
+
+//save encrypts the tokens and replaces the file with them. It must be called with the lock held.
+func (s *FileStore) save() error {
+	plaintext, err := json.Marshal(s.tokens)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := s.aead.Seal(nonce, nonce, plaintext, nil)
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+//Get returns the token stored under key, or ErrNotFound if there is none
+func (s *FileStore) Get(key string) (*Token, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	tok, ok := s.tokens[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyToken(&tok), nil
+}
+
+//Put stores tok under key, replacing any token already there
+func (s *FileStore) Put(key string, tok *Token) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, existed := s.tokens[key]
+	s.tokens[key] = *copyToken(tok)
+	if err := s.save(); err != nil {
+		//Keep memory consistent with the file
+		if existed {
+			s.tokens[key] = old
+		} else {
+			delete(s.tokens, key)
+		}
+		return err
+	}
+	return nil
+}
+
+//Delete removes the token stored under key, if there is one
+func (s *FileStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, existed := s.tokens[key]
+	if !existed {
+		return nil
+	}
+	delete(s.tokens, key)
+	if err := s.save(); err != nil {
+		s.tokens[key] = old
+		return err
+	}
+	return nil
+}
+
+//Keys returns the keys of every stored token
+func (s *FileStore) Keys() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	keys := make([]string, 0, len(s.tokens))
+	for key := range s.tokens {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
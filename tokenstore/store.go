@@ -0,0 +1,122 @@
+package tokenstore
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+//AppKey is the key under which the app access token is stored. User tokens are stored under the user's ID.
+const AppKey = "app"
+
+//ErrNotFound is returned by Get when no token is stored under the requested key
+var ErrNotFound = errors.New("token not found")
+
+//Token is an OAuth token along with the scopes which were granted with it
+type Token struct {
+	oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+//NewToken wraps tok, taking the granted scopes from the "scope" field of the token response if it is present
+func NewToken(tok *oauth2.Token) *Token {
+	t := &Token{Token: *tok}
+	switch scopes := tok.Extra("scope").(type) {
+	case []interface{}:
+		for _, scope := range scopes {
+			if s, ok := scope.(string); ok {
+				t.Scopes = append(t.Scopes, s)
+			}
+		}
+	case []string:
+		t.Scopes = append(t.Scopes, scopes...)
+	}
+	return t
+}
+
+//OAuth2 returns a copy of the token as an *oauth2.Token
+func (t *Token) OAuth2() *oauth2.Token {
+	tok := t.Token
+	return &tok
+}
+
+//Store keeps OAuth tokens so that they survive restarts, keyed by user ID or by AppKey. Implementations must be safe
+//for concurrent use.
+type Store interface {
+	//Get returns the token stored under key, or ErrNotFound if there is none
+	Get(key string) (*Token, error)
+	//Put stores tok under key, replacing any token already there
+	Put(key string, tok *Token) error
+	//Delete removes the token stored under key, if there is one
+	Delete(key string) error
+}
+
+//Lister may be implemented by a Store to enumerate the keys it holds
+type Lister interface {
+	Keys() ([]string, error)
+}
+
+//MemoryStore is a Store which keeps tokens in memory, so they are forgotten when the process exits
+type MemoryStore struct {
+	lock   sync.RWMutex
+	tokens map[string]Token
+}
+
+//NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens: make(map[string]Token),
+	}
+}
+
+//Get returns the token stored under key, or ErrNotFound if there is none
+func (s *MemoryStore) Get(key string) (*Token, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	tok, ok := s.tokens[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyToken(&tok), nil
+}
+
+//Put stores tok under key, replacing any token already there
+func (s *MemoryStore) Put(key string, tok *Token) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens[key] = *copyToken(tok)
+	return nil
+}
+
+//Delete removes the token stored under key, if there is one
+func (s *MemoryStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.tokens, key)
+	return nil
+}
+
+//Keys returns the keys of every stored token
+func (s *MemoryStore) Keys() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	keys := make([]string, 0, len(s.tokens))
+	for key := range s.tokens {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+//copyToken copies tok so that callers cannot modify a stored token, dropping the raw token response
+func copyToken(tok *Token) *Token {
+	return &Token{
+		Token: oauth2.Token{
+			AccessToken:  tok.AccessToken,
+			TokenType:    tok.TokenType,
+			RefreshToken: tok.RefreshToken,
+			Expiry:       tok.Expiry,
+		},
+		Scopes: append([]string(nil), tok.Scopes...),
+	}
+}
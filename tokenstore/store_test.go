@@ -0,0 +1,238 @@
+package tokenstore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+//newStores opens an empty store of each kind, keyed by a name for subtests
+func newStores(t *testing.T) map[string]Store {
+	file, err := OpenFileStore(filepath.Join(t.TempDir(), "tokens"), testKey)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	return map[string]Store{"memory": NewMemoryStore(), "file": file}
+}
+
+func testToken(access string) *Token {
+	return &Token{
+		Token: oauth2.Token{
+			AccessToken:  access,
+			TokenType:    "bearer",
+			RefreshToken: "refresh-" + access,
+			Expiry:       time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		Scopes: []string{"user:read:email"},
+	}
+}
+
+func TestStore(t *testing.T) {
+	type op struct {
+		action string
+		key    string
+		//token is the access token to put, or the one which get should return, with "" meaning ErrNotFound
+		token string
+	}
+	tests := []struct {
+		name string
+		ops  []op
+		keys []string
+	}{
+		{
+			name: "missing tokens are not found",
+			ops:  []op{{action: "get", key: AppKey}},
+		},
+		{
+			name: "tokens are returned by key",
+			ops: []op{
+				{action: "put", key: AppKey, token: "app-token"},
+				{action: "put", key: "1234", token: "user-token"},
+				{action: "get", key: AppKey, token: "app-token"},
+				{action: "get", key: "1234", token: "user-token"},
+				{action: "get", key: "5678"},
+			},
+			keys: []string{"1234", AppKey},
+		},
+		{
+			name: "put replaces tokens",
+			ops: []op{
+				{action: "put", key: AppKey, token: "old"},
+				{action: "put", key: AppKey, token: "new"},
+				{action: "get", key: AppKey, token: "new"},
+			},
+			keys: []string{AppKey},
+		},
+		{
+			name: "deleted tokens are not found",
+			ops: []op{
+				{action: "put", key: AppKey, token: "app-token"},
+				{action: "put", key: "1234", token: "user-token"},
+				{action: "delete", key: AppKey},
+				{action: "get", key: AppKey},
+				{action: "get", key: "1234", token: "user-token"},
+			},
+			keys: []string{"1234"},
+		},
+		{
+			name: "deleting a missing token has no effect",
+			ops:  []op{{action: "delete", key: AppKey}, {action: "get", key: AppKey}},
+		},
+	}
+	for _, tt := range tests {
+		for name, s := range newStores(t) {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				for i, op := range tt.ops {
+					switch op.action {
+					case "put":
+						if err := s.Put(op.key, testToken(op.token)); err != nil {
+							t.Fatalf("op %v: Put(%v) error = %v", i, op.key, err)
+						}
+					case "delete":
+						if err := s.Delete(op.key); err != nil {
+							t.Fatalf("op %v: Delete(%v) error = %v", i, op.key, err)
+						}
+					case "get":
+						got, err := s.Get(op.key)
+						if op.token == "" {
+							if !errors.Is(err, ErrNotFound) {
+								t.Errorf("op %v: Get(%v) = %v, %v, want ErrNotFound", i, op.key, got, err)
+							}
+						} else if err != nil {
+							t.Errorf("op %v: Get(%v) error = %v", i, op.key, err)
+						} else if want := testToken(op.token); !reflect.DeepEqual(got, want) {
+							t.Errorf("op %v: Get(%v) = %+v, want %+v", i, op.key, got, want)
+						}
+					}
+				}
+				keys, err := s.(Lister).Keys()
+				if err != nil {
+					t.Fatalf("Keys() error = %v", err)
+				}
+				sort.Strings(keys)
+				if len(keys) != len(tt.keys) || (len(keys) > 0 && !reflect.DeepEqual(keys, tt.keys)) {
+					t.Errorf("Keys() = %v, want %v", keys, tt.keys)
+				}
+			})
+		}
+	}
+}
+
+func TestStoreCopiesTokens(t *testing.T) {
+	for name, s := range newStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tok := testToken("token")
+			if err := s.Put(AppKey, tok); err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+			tok.AccessToken = "changed"
+			tok.Scopes[0] = "changed"
+			got, _ := s.Get(AppKey)
+			got.Scopes[0] = "changed again"
+			if got, _ := s.Get(AppKey); !reflect.DeepEqual(got, testToken("token")) {
+				t.Errorf("Get() = %+v after modifying tokens outside the store, want it unchanged", got)
+			}
+		})
+	}
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	otherKey := bytes.Repeat([]byte{0x24}, 32)
+	tests := []struct {
+		name    string
+		key     []byte
+		wantErr bool
+	}{
+		{name: "same key", key: testKey},
+		{name: "wrong key", key: otherKey, wantErr: true},
+		{name: "different key size", key: testKey[:16], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens")
+			s, err := OpenFileStore(path, testKey)
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			if err := s.Put(AppKey, testToken("app-token")); err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+
+			reopened, err := OpenFileStore(path, tt.key)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("OpenFileStore() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenFileStore() error = %v", err)
+			}
+			if got, err := reopened.Get(AppKey); err != nil || !reflect.DeepEqual(got, testToken("app-token")) {
+				t.Errorf("Get() after reopening = %+v, %v, want the stored token", got, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreEncryptsTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	s, err := OpenFileStore(path, testKey)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	if err := s.Put(AppKey, testToken("plaintext-access-token")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read store file: %v", err)
+	}
+	for _, secret := range []string{"plaintext-access-token", "refresh-plaintext-access-token"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("store file contains %q in plaintext", secret)
+		}
+	}
+
+	//Tampering with the file is detected rather than returning corrupted tokens
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write store file: %v", err)
+	}
+	if _, err := OpenFileStore(path, testKey); err == nil {
+		t.Error("OpenFileStore() error = nil for a modified file, want an error")
+	}
+}
+
+func TestOpenFileStoreErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		key  []byte
+		data []byte
+	}{
+		{name: "short key", key: []byte("too short")},
+		{name: "truncated file", key: testKey, data: []byte{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens")
+			if tt.data != nil {
+				if err := os.WriteFile(path, tt.data, 0600); err != nil {
+					t.Fatalf("failed to write store file: %v", err)
+				}
+			}
+			if _, err := OpenFileStore(path, tt.key); err == nil {
+				t.Error("OpenFileStore() error = nil, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//SpanData describes a span which has ended
+type SpanData struct {
+	Name        string
+	SpanContext SpanContext
+	//Parent is the ID of the parent span, which is invalid for root spans
+	Parent     SpanID
+	Attributes map[string]interface{}
+	Errors     []error
+	StartTime  time.Time
+	EndTime    time.Time
+}
+
+//MemoryTracer is a Tracer which keeps every ended span in memory, for use in tests and debugging
+type MemoryTracer struct {
+	lock  sync.Mutex
+	spans []SpanData
+}
+
+//NewMemoryTracer creates a MemoryTracer with no recorded spans
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+//Start begins a span, which is a child of the span carried by ctx if there is one
+func (t *MemoryTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	parent := SpanContextFromContext(ctx)
+	sc := SpanContext{TraceID: parent.TraceID, SpanID: newSpanID()}
+	if !parent.IsValid() {
+		sc.TraceID = newTraceID()
+	}
+	span := &memorySpan{
+		tracer: t,
+		data: SpanData{
+			Name:        name,
+			SpanContext: sc,
+			Parent:      parent.SpanID,
+			Attributes:  make(map[string]interface{}),
+			StartTime:   time.Now(),
+		},
+	}
+	span.SetAttributes(attrs...)
+	return ContextWithSpanContext(ctx, sc), span
+}
+
+//Spans returns the spans which have ended, in the order they ended
+func (t *MemoryTracer) Spans() []SpanData {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]SpanData(nil), t.spans...)
+}
+
+//Reset discards all recorded spans
+func (t *MemoryTracer) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.spans = nil
+}
+
+type memorySpan struct {
+	tracer *MemoryTracer
+	lock   sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+func (s *memorySpan) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+func (s *memorySpan) SetAttributes(attrs ...Attribute) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, attr := range attrs {
+		s.data.Attributes[attr.Key] = attr.Value
+	}
+}
+
+func (s *memorySpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Errors = append(s.data.Errors, err)
+}
+
+func (s *memorySpan) End() {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = time.Now()
+	data := s.data
+	s.lock.Unlock()
+
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.tracer.spans = append(s.tracer.spans, data)
+}
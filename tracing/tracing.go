@@ -0,0 +1,153 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+//TraceID identifies a trace, using the same 16 byte representation as W3C Trace Context and OpenTelemetry
+type TraceID [16]byte
+
+//IsValid returns false for the all-zero ID
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+//SpanID identifies a span within a trace, using the same 8 byte representation as W3C Trace Context and OpenTelemetry
+type SpanID [8]byte
+
+//IsValid returns false for the all-zero ID
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+//SpanContext identifies a span, so that spans started elsewhere can be made its children
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+//IsValid reports whether the span context identifies a span
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+//Attribute is a key-value pair describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+//String creates a string attribute
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+//Int creates an integer attribute
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+//Span represents a single operation within a trace. It mirrors the subset of the OpenTelemetry Span interface used by
+//nazuna, so that an OpenTelemetry tracer can be used by wrapping it.
+type Span interface {
+	//SpanContext returns the identifiers of the span
+	SpanContext() SpanContext
+	//SetAttributes adds attributes to the span, replacing any with the same keys
+	SetAttributes(attrs ...Attribute)
+	//RecordError records that the operation failed
+	RecordError(err error)
+	//End completes the span. No methods should be called on the span afterwards.
+	End()
+}
+
+//Tracer starts spans. Implementations should make the new span a child of the span found in ctx, if any, which for
+//spans crossing between goroutines in nazuna is set using ContextWithSpanContext.
+type Tracer interface {
+	//Start begins a span, returning it along with a context which carries it
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+type contextKey int
+
+const spanContextKey contextKey = iota
+
+//ContextWithSpanContext returns a context carrying sc, so that spans started from it will be children of sc
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey, sc)
+}
+
+//SpanContextFromContext returns the span context carried by ctx, which is invalid if there is none
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey).(SpanContext)
+	return sc
+}
+
+//NoopTracer is a Tracer which creates spans that do nothing, and is used when tracing is not configured
+type NoopTracer struct{}
+
+//Start returns ctx unchanged along with a span which does nothing
+func (NoopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{sc: SpanContextFromContext(ctx)}
+}
+
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (s noopSpan) SpanContext() SpanContext         { return s.sc }
+func (s noopSpan) SetAttributes(attrs ...Attribute) {}
+func (s noopSpan) RecordError(err error)            {}
+func (s noopSpan) End()                             {}
+
+//newTraceID generates a random trace ID
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+//newSpanID generates a random span ID
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+//InstrumentTransport wraps an http.RoundTripper so that a span is started for every request made through it, as a
+//child of the span carried by the request's context. If base is nil, http.DefaultTransport is used.
+func InstrumentTransport(tracer Tracer, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		ctx, span := tracer.Start(req.Context(), "helix "+req.Method+" "+req.URL.Path,
+			String("http.method", req.Method),
+			String("http.url", req.URL.String()),
+		)
+		defer span.End()
+		resp, err := base.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			span.RecordError(err)
+			return resp, err
+		}
+		span.SetAttributes(Int("http.status_code", resp.StatusCode))
+		return resp, nil
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
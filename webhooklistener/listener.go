@@ -2,9 +2,11 @@ package webhooklistener
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -12,39 +14,56 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/callummance/nazuna/dedup"
+	"github.com/callummance/nazuna/journal"
+	"github.com/callummance/nazuna/logging"
 	"github.com/callummance/nazuna/messages"
-	"github.com/patrickmn/go-cache"
-	"github.com/sirupsen/logrus"
+	"github.com/callummance/nazuna/metrics"
+	"github.com/callummance/nazuna/tracing"
 )
 
 var messageExpiry, _ = time.ParseDuration("10m")
 
-const (
-	messageIDCacheExpiry  = 24 * time.Hour
-	messageIDCacheCleanup = time.Hour
-)
+//messageIDExpiry is how long the IDs of processed messages are remembered for
+const messageIDExpiry = 24 * time.Hour
 
 type Listener struct {
-	processedMessages    *cache.Cache
+	processedMessages    dedup.Store
+	journal              journal.Journal
+	metrics              *metrics.Metrics
+	tracer               tracing.Tracer
+	log                  *logging.Entry
 	secret               string
 	notificationsChannel chan messages.EventNotificationMessage
+	revocationsChannel   chan messages.Subscription
 	closeChannel         chan interface{}
 	permissive           bool
+	server               *http.Server
+	stateLock            sync.Mutex
+	closed               bool
+	inFlight             sync.WaitGroup
+	shutdownOnce         sync.Once
+	shutdownErr          error
 }
 
 func NewListenerWithSecret(secret string, permissive bool) (*Listener, error) {
-	messageIDs := cache.New(messageIDCacheExpiry, messageIDCacheCleanup)
+	messageIDs := dedup.NewMemoryStore()
 	notificationChannel := make(chan messages.EventNotificationMessage)
+	revocationsChannel := make(chan messages.Subscription)
 	closeChannel := make(chan interface{})
 	return &Listener{
 		processedMessages:    messageIDs,
 		secret:               secret,
 		notificationsChannel: notificationChannel,
+		revocationsChannel:   revocationsChannel,
 		closeChannel:         closeChannel,
 		permissive:           permissive,
+		tracer:               tracing.NoopTracer{},
 	}, nil
 }
 
@@ -65,89 +84,324 @@ func GenSecret() (string, error) {
 	return base64.URLEncoding.EncodeToString(secretBytes)[0:49], nil
 }
 
-//Listen starts listening for incoming webhook calls at the pattern `webhookPath` on interface and port `listenOk`
+//SetDedupStore replaces the store used to detect redelivered messages, which is in-memory by default.
+//It should be called before any requests are handled.
+func (l *Listener) SetDedupStore(store dedup.Store) {
+	l.processedMessages = store
+}
+
+//SetJournal makes the listener persist each notification to j before acknowledging it. It should be called before any
+//requests are handled.
+func (l *Listener) SetJournal(j journal.Journal) {
+	l.journal = j
+}
+
+//SetMetrics makes the listener record the messages it recieves in m. It should be called before any requests are handled.
+func (l *Listener) SetMetrics(m *metrics.Metrics) {
+	l.metrics = m
+}
+
+//SetTracer makes the listener start a span for each message it recieves. It should be called before any requests are handled.
+func (l *Listener) SetTracer(tracer tracing.Tracer) {
+	l.tracer = tracer
+}
+
+//SetLogger replaces the logger used by the listener, which is logging.Default() unless set. It should be called before any requests are handled.
+func (l *Listener) SetLogger(log *logging.Entry) {
+	l.log = log
+}
+
+//Listen starts listening for incoming webhook calls at the pattern `webhookPath` on interface and port `listenOn`.
+//Both IPv4 and IPv6 addresses are accepted.
 func (l *Listener) Listen(webhookPath string, listenOn string) error {
-	logrus.Infof("Starting server to listen for webhooks at path %v on address:port %v.", webhookPath, listenOn)
-	listener, err := net.Listen("tcp4", listenOn)
+	return l.listen(webhookPath, listenOn, nil)
+}
+
+//ListenTLS behaves like Listen, but serves HTTPS using the certificate and private key stored in the provided files.
+func (l *Listener) ListenTLS(webhookPath string, listenOn string, certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		l.log.Errorf("Failed to load TLS certificate for webhook server due to error %v", err)
+		return err
+	}
+	return l.listen(webhookPath, listenOn, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+func (l *Listener) listen(webhookPath string, listenOn string, tlsConfig *tls.Config) error {
+	l.log.Infof("Starting server to listen for webhooks at path %v on address:port %v.", webhookPath, listenOn)
+	listener, err := net.Listen("tcp", listenOn)
 	if err != nil {
-		logrus.Errorf("Failed to start listening for webhooks due to error %v", err)
+		l.log.Errorf("Failed to start listening for webhooks due to error %v", err)
 		return err
 	}
-	go func() {
-		//TODO: listen on closeChannel to exit server when signalled
-		mux := http.NewServeMux()
-		mux.HandleFunc(webhookPath, l.handleWebhook)
-		server := http.Server{
-			Addr:    listenOn,
-			Handler: mux,
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(webhookPath, l.Handler())
+	l.server = &http.Server{
+		Addr:      listenOn,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	go func(server *http.Server) {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			l.log.Errorf("Webhook server stopped unexpectedly due to error %v", err)
 		}
-		logrus.Fatal(server.Serve(listener))
-	}()
+	}(l.server)
 	return nil
 }
 
+//Handler returns an http.Handler which verifies and decodes incoming webhook calls, passing notifications on to the
+//notifications channel. It can be mounted on an existing server instead of calling Listen.
+func (l *Listener) Handler() http.Handler {
+	return http.HandlerFunc(l.handleWebhook)
+}
+
+//Shutdown stops the webhook server (if one was started by Listen) and the handler from accepting new requests, waits for in-flight requests to hand their
+//notifications over and then closes the notifications channel. If ctx expires first, requests which are still
+//waiting are rejected so that Twitch will redeliver them, and the context's error is returned.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.shutdownOnce.Do(func() {
+		l.log.Info("Shutting down webhook listener")
+		l.stateLock.Lock()
+		l.closed = true
+		l.stateLock.Unlock()
+
+		if l.server != nil {
+			l.shutdownErr = l.server.Shutdown(ctx)
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			l.inFlight.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			close(l.closeChannel)
+		case <-ctx.Done():
+			l.log.Warnf("Deadline reached whilst waiting for in-flight webhook requests; abandoning them")
+			close(l.closeChannel)
+			<-drained
+			if l.shutdownErr == nil {
+				l.shutdownErr = ctx.Err()
+			}
+		}
+		close(l.notificationsChannel)
+		close(l.revocationsChannel)
+	})
+	return l.shutdownErr
+}
+
+//beginRequest registers an in-flight request, returning false if the listener has already been shut down.
+func (l *Listener) beginRequest() bool {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	if l.closed {
+		return false
+	}
+	l.inFlight.Add(1)
+	return true
+}
+
 //NotificationsChannel returns the channel upon which messages are returned.
 func (l *Listener) NotificationsChannel() chan messages.EventNotificationMessage {
 	return l.notificationsChannel
 }
 
+//RevocationsChannel returns the channel upon which revoked subscriptions are returned.
+func (l *Listener) RevocationsChannel() chan messages.Subscription {
+	return l.revocationsChannel
+}
+
 //NotificationsChannel returns the channel upon which messages are returned.
 func (l *Listener) Secret() string {
 	return l.secret
 }
 
 func (l *Listener) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if !l.beginRequest() {
+		http.Error(w, "listener is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer l.inFlight.Done()
+
+	msgType := strings.Join(r.Header["Twitch-Eventsub-Message-Type"], "")
+	outcome := metrics.OutcomeRejected
+	_, span := l.tracer.Start(r.Context(), "eventsub.webhook",
+		tracing.String("eventsub.message_type", msgType),
+		tracing.String("eventsub.message_id", r.Header.Get("Twitch-Eventsub-Message-Id")),
+	)
+	defer func() {
+		l.metrics.ObserveWebhookRequest(msgType, outcome)
+		span.SetAttributes(tracing.String("eventsub.outcome", outcome))
+		span.End()
+	}()
+
 	//Verify message is from twitch and get body
 	body := l.verifyMessage(&w, r, l.secret)
 	if body == nil {
-		logrus.Trace("Rejected an HTTP reqest as it was not from Twitch")
+		l.log.Trace("Rejected an HTTP reqest as it was not from Twitch")
 		return
 	} else {
-		logrus.Tracef("Got request from Twitch: %s", string(body[:]))
+		l.log.Tracef("Got request from Twitch: %s", string(body[:]))
 	}
-	//Take note of the fact the message has been recieved
 	msgID := strings.Join(r.Header["Twitch-Eventsub-Message-Id"], "")
-	l.processedMessages.Set(msgID, nil, cache.DefaultExpiration)
 
 	//Branch based on message type
-	msgType := strings.Join(r.Header["Twitch-Eventsub-Message-Type"], "")
 	switch msgType {
 	case "webhook_callback_verification":
 		//Verification message
-		logrus.Debugf("Recieved verification message from twitch")
-		logrus.Tracef("Recieved verification message from twitch: %q", body)
+		l.log.Debugf("Recieved verification message from twitch")
+		l.log.Tracef("Recieved verification message from twitch: %q", body)
 		var message messages.VerificationMessage
 		err := json.Unmarshal(body, &message)
 		if err != nil {
-			logrus.Warnf("Failed to unmarshal webhook verification message from twitch")
+			l.log.Warnf("Failed to unmarshal webhook verification message from twitch")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			outcome = metrics.OutcomeInvalid
 			return
 		}
-		logrus.Infof("Responding to twitch callback verification for subscription %v.", message.Subscription)
+		l.log.Infof("Responding to twitch callback verification for subscription %v.", message.Subscription)
 		challenge := message.Challenge
 		w.Header().Set("Content-Type", "text/plain")
 		fmt.Fprintf(w, "%s", challenge)
+		l.markProcessed(msgID)
+		outcome = metrics.OutcomeAccepted
 		return
 	case "notification":
 		//Actual notification message
-		logrus.Tracef("Recieved notification from twitch: %q", body)
+		l.log.Tracef("Recieved notification from twitch: %q", body)
 		subscriptionType := strings.Join(r.Header["Twitch-Eventsub-Subscription-Type"], "")
-		message, err := decodeNotification(&body, subscriptionType)
+		message, err := messages.DecodeNotification(body, subscriptionType)
 		if err != nil {
-			logrus.Warnf("Discarding message.")
+			l.log.Warnf("Discarding message %v as it could not be decoded due to error %v", msgID, err)
+			l.metrics.ObserveDecodeFailure(messages.TransportWebhook, subscriptionType)
+			span.RecordError(err)
+			w.WriteHeader(http.StatusOK)
+			outcome = metrics.OutcomeInvalid
+			return
+		}
+		message.Metadata = requestMetadata(r, message.SubscriptionVersion)
+		message.SpanContext = span.SpanContext()
+		log := l.log.WithFields(logging.MessageFields(message))
+		span.SetAttributes(tracing.String("eventsub.subscription_type", message.Subscription.Type))
+		//Claim the message before passing it on, so that of several concurrent deliveries only one is dispatched
+		if !l.claim(msgID) {
+			log.Infof("Discarded message %v because it was recieved before.", msgID)
+			l.metrics.ObserveRejection(metrics.RejectionDuplicate)
+			w.WriteHeader(http.StatusOK)
+			outcome = metrics.OutcomeRejected
+			return
+		}
+		if l.journal != nil {
+			err = l.journal.Append(*message)
+			if err != nil {
+				//Twitch will redeliver the message, by which point the journal may be writable again
+				log.Errorf("Failed to journal notification %v due to error %v", msgID, err)
+				l.unmark(msgID)
+				http.Error(w, "failed to persist notification", http.StatusInternalServerError)
+				outcome = metrics.OutcomeError
+				return
+			}
+		}
+		select {
+		case l.notificationsChannel <- *message:
 			w.WriteHeader(http.StatusOK)
+			outcome = metrics.OutcomeAccepted
+		case <-l.closeChannel:
+			if l.journal != nil {
+				//The notification will be dispatched from the journal on the next start
+				log.Infof("Leaving notification %v in the journal as the listener is shutting down", msgID)
+				w.WriteHeader(http.StatusOK)
+				outcome = metrics.OutcomeAccepted
+				return
+			}
+			//Shutdown deadline passed before the message could be dispatched, so ask twitch to resend it later
+			log.Warnf("Rejecting notification %v as the listener is shutting down", msgID)
+			l.unmark(msgID)
+			http.Error(w, "listener is shutting down", http.StatusServiceUnavailable)
+			outcome = metrics.OutcomeUnavailable
+		}
+		return
+	case "revocation":
+		//Twitch has stopped sending notifications for a subscription
+		var message messages.RevocationMessage
+		err := json.Unmarshal(body, &message)
+		if err != nil {
+			l.log.Warnf("Failed to unmarshal revocation message %v from twitch due to error %v", msgID, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			outcome = metrics.OutcomeInvalid
 			return
 		}
-		l.notificationsChannel <- *message
-		w.WriteHeader(http.StatusOK)
+		l.log.Warnf("Twitch revoked subscription %v with status %v", message.Subscription.ID, message.Subscription.Status)
+		select {
+		case l.revocationsChannel <- message.Subscription:
+			w.WriteHeader(http.StatusOK)
+			l.markProcessed(msgID)
+			outcome = metrics.OutcomeAccepted
+		case <-l.closeChannel:
+			l.log.Warnf("Rejecting revocation %v as the listener is shutting down", msgID)
+			http.Error(w, "listener is shutting down", http.StatusServiceUnavailable)
+			outcome = metrics.OutcomeUnavailable
+		}
 		return
 	default:
 		//Unknown message type
-		logrus.Warnf("Recieved message with unknown message type %v from twitch: %v", msgType, body)
+		l.log.Warnf("Recieved message with unknown message type %v from twitch: %v", msgType, body)
+		outcome = metrics.OutcomeUnknownType
 		return
 	}
 }
 
+//requestMetadata reads the delivery metadata from the headers of a notification request which has passed verifyMessage
+//defaultVersion is used if the request has no subscription version header.
+func requestMetadata(r *http.Request, defaultVersion string) messages.Metadata {
+	//The timestamp has already been checked by verifyMessage
+	timestamp, _ := time.Parse(time.RFC3339, r.Header.Get("Twitch-Eventsub-Message-Timestamp"))
+	retry, _ := strconv.Atoi(r.Header.Get("Twitch-Eventsub-Message-Retry"))
+	version := r.Header.Get("Twitch-Eventsub-Subscription-Version")
+	if version == "" {
+		version = defaultVersion
+	}
+	return messages.Metadata{
+		MessageID:           r.Header.Get("Twitch-Eventsub-Message-Id"),
+		MessageTimestamp:    timestamp,
+		MessageRetry:        retry,
+		SubscriptionVersion: version,
+	}
+}
+
+//markProcessed records that a message has been handled so that any redelivery of it will be ignored
+func (l *Listener) markProcessed(msgID string) {
+	err := l.processedMessages.Mark(msgID, messageIDExpiry)
+	if err != nil {
+		l.log.Warnf("Failed to mark message %v as processed due to error %v", msgID, err)
+	}
+}
+
+//claim marks a notification as processed before it is passed on, returning false if it has already been claimed.
+//In permissive mode duplicates are still accepted.
+func (l *Listener) claim(msgID string) bool {
+	first, err := l.processedMessages.MarkIfAbsent(msgID, messageIDExpiry)
+	if err != nil {
+		//Prefer processing a message twice over dropping it
+		l.log.Warnf("Failed to mark message %v as processed due to error %v", msgID, err)
+		return true
+	}
+	return first || l.permissive
+}
+
+//unmark forgets a claimed notification which could not be passed on, so that twitch's redelivery of it is accepted
+func (l *Listener) unmark(msgID string) {
+	err := l.processedMessages.Unmark(msgID)
+	if err != nil {
+		l.log.Warnf("Failed to unmark message %v due to error %v", msgID, err)
+	}
+}
+
 //Attempts to verify the signature, send time and unique ID of a message, returning the body contents iff successful.
 func (l *Listener) verifyMessage(w *http.ResponseWriter, r *http.Request, secret string) []byte {
 	msgID := strings.Join(r.Header["Twitch-Eventsub-Message-Id"], "")
@@ -157,22 +411,29 @@ func (l *Listener) verifyMessage(w *http.ResponseWriter, r *http.Request, secret
 	oldestValidTime := time.Now().Add(-messageExpiry)
 	messageTime, err := time.Parse(time.RFC3339, msgTimestamp)
 	if err != nil {
-		logrus.Warnf("Failed to decode message timestamp %v due to error %v", msgTimestamp, err)
+		l.log.Warnf("Failed to decode message timestamp %v due to error %v", msgTimestamp, err)
 		http.Error(*w, err.Error(), http.StatusInternalServerError)
+		l.metrics.ObserveRejection(metrics.RejectionTimestamp)
 		return nil
 	}
 	if messageTime.Before(oldestValidTime) && !l.permissive {
 		//Message is too old
-		logrus.Infof("Discarded message because it was sent more than %v ago.", messageExpiry)
+		l.log.Infof("Discarded message because it was sent more than %v ago.", messageExpiry)
+		l.metrics.ObserveRejection(metrics.RejectionTimestamp)
 		http.Error(*w, fmt.Errorf("message was sent at %v, wheras only messages sent since %v are currently acceptible", messageTime, oldestValidTime).Error(), http.StatusBadRequest)
 		return nil
 	}
 
 	//Check if we have seen message before
-	_, seenBefore := l.processedMessages.Get(msgID)
+	seenBefore, err := l.processedMessages.Seen(msgID)
+	if err != nil {
+		//Prefer processing a message twice over dropping it
+		l.log.Warnf("Failed to check whether message %v was recieved before due to error %v", msgID, err)
+	}
 	if seenBefore && !l.permissive {
 		//Message is seen before
-		logrus.Infof("Discarded message because it was recieved before.", messageExpiry)
+		l.log.Infof("Discarded message %v because it was recieved before.", msgID)
+		l.metrics.ObserveRejection(metrics.RejectionDuplicate)
 		(*w).WriteHeader(http.StatusOK)
 		return nil
 	}
@@ -186,7 +447,7 @@ func (l *Listener) verifyMessage(w *http.ResponseWriter, r *http.Request, secret
 	hasher := hmac.New(sha256.New, []byte(secret))
 	_, err = hasher.Write(hmacBuf.Bytes())
 	if err != nil {
-		logrus.Warnf("Failed to copy bytes from request body to HMAC buf due to error %v", err)
+		l.log.Warnf("Failed to copy bytes from request body to HMAC buf due to error %v", err)
 		return nil
 	}
 
@@ -194,185 +455,13 @@ func (l *Listener) verifyMessage(w *http.ResponseWriter, r *http.Request, secret
 	headerSig := strings.Join(r.Header["Twitch-Eventsub-Message-Signature"], "")
 	providedHash, err := hex.DecodeString(strings.TrimPrefix(headerSig, "sha256="))
 	if err != nil {
-		logrus.Warnf("Provided HMAC signature '%v' was not valid hexadecimal: %v", headerSig, err)
+		l.log.Warnf("Provided HMAC signature '%v' was not valid hexadecimal: %v", headerSig, err)
 	}
 
 	if l.permissive || hmac.Equal(calculatedHash, providedHash) {
 		return bodyBuf.Bytes()
 	}
+	l.metrics.ObserveRejection(metrics.RejectionSignature)
 	http.Error(*w, "Hash did not match", http.StatusForbidden)
 	return nil
 }
-
-type intermediateNotification struct {
-	Subscription messages.Subscription `json:"subscription"`
-	Event        json.RawMessage       `json:"event"`
-}
-
-func decodeNotification(body *[]byte, subscriptionType string) (*messages.EventNotificationMessage, error) {
-	var intermediate intermediateNotification
-	err := json.Unmarshal(*body, &intermediate)
-	if err != nil {
-		logrus.Warnf("Failed to unmarshal JSON message from Twitch %v due to error %v.", body, err)
-		return nil, err
-	}
-	res := messages.EventNotificationMessage{
-		Subscription: intermediate.Subscription,
-		Event:        nil,
-	}
-	switch subscriptionType {
-	case messages.SubscriptionChannelUpdate:
-		var ev messages.ChannelUpdateEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelUpdate event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelFollow:
-		var ev messages.ChannelFollowEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelFollow event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelSubscribe:
-		var ev messages.ChannelSubscribeEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelSubscribe event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelCheer:
-		var ev messages.ChannelCheerEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelCheer event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelRaid:
-		var ev messages.ChannelRaidEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelRaid event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelBan:
-		var ev messages.ChannelBanEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelBan event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelUnban:
-		var ev messages.ChannelUnbanEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelUnban event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelPointsCustomRewardAdd:
-		var ev messages.ChannelPointsCustomRewardAddEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelPointsCustomRewardAdd event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelPointsCustomRewardUpdate:
-		var ev messages.ChannelPointsCustomRewardUpdateEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelPointsCustomRewardUpdate event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelPointsCustomRewardRemove:
-		var ev messages.ChannelPointsCustomRewardRemoveEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelPointsCustomRewardRemove event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelPointsCustomRewardRedemptionAdd:
-		var ev messages.ChannelPointsCustomRewardRedemptionAddEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelPointsCustomRewardRedemptionAdd event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelPointsCustomRewardRedemptionUpdate:
-		var ev messages.ChannelPointsCustomRewardRedemptionUpdateEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelPointsCustomRewardRedemptionUpdate event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelHypeTrainBegin:
-		var ev messages.ChannelHypeTrainBeginEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelHypeTrainBegin event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelHypeTrainProgress:
-		var ev messages.ChannelHypeTrainProgressEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelHypeTrainProgress event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionChannelHypeTrainEnd:
-		var ev messages.ChannelHypeTrainEndEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal ChannelHypeTrainEnd event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionStreamOnline:
-		var ev messages.StreamOnlineEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal StreamOnline event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionStreamOffline:
-		var ev messages.StreamOfflineEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal StreamOffline event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionUserAuthorizationRevoke:
-		var ev messages.UserAuthorizationRevokeEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal UserAuthorizationRevoke event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	case messages.SubscriptionUserUpdate:
-		var ev messages.UserUpdateEvent
-		err := json.Unmarshal(intermediate.Event, &ev)
-		if err != nil {
-			logrus.Warnf("Failed to unmarshal UserUpdate event %v due to error %v", intermediate.Event, err)
-			return nil, err
-		}
-		res.Event = &ev
-	}
-	return &res, nil
-}
@@ -0,0 +1,265 @@
+package webhooklistener
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/messages"
+)
+
+const testSecret = "webhook-secret"
+
+const onlineBody = `{"subscription":{"id":"sub","type":"stream.online","version":"1","status":"enabled"},"event":{"broadcaster_user_id":"1234","type":"live"}}`
+
+//signedRequest builds a webhook request signed with testSecret, as twitch would send it
+func signedRequest(msgType, msgID, body string, sentAt time.Time) *http.Request {
+	timestamp := sentAt.UTC().Format(time.RFC3339)
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(msgID + timestamp + body))
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader(body))
+	req.Header.Set("Twitch-Eventsub-Message-Type", msgType)
+	req.Header.Set("Twitch-Eventsub-Message-Id", msgID)
+	req.Header.Set("Twitch-Eventsub-Message-Timestamp", timestamp)
+	req.Header.Set("Twitch-Eventsub-Message-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func newTestListener(t *testing.T) *Listener {
+	l, err := NewListenerWithSecret(testSecret, false)
+	if err != nil {
+		t.Fatalf("NewListenerWithSecret() error = %v", err)
+	}
+	return l
+}
+
+//delivery is what became of a request passed to deliver
+type delivery struct {
+	resp         *httptest.ResponseRecorder
+	notification *messages.EventNotificationMessage
+	revocation   *messages.Subscription
+}
+
+//deliver passes req to the listener's handler, reading anything it sends on the listener's channels
+func deliver(t *testing.T, l *Listener, req *http.Request) delivery {
+	t.Helper()
+	d := delivery{resp: httptest.NewRecorder()}
+	done := make(chan struct{})
+	go func() {
+		l.Handler().ServeHTTP(d.resp, req)
+		close(done)
+	}()
+	for {
+		select {
+		case msg := <-l.NotificationsChannel():
+			d.notification = &msg
+		case sub := <-l.RevocationsChannel():
+			d.revocation = &sub
+		case <-done:
+			return d
+		case <-time.After(time.Second):
+			t.Fatal("handler did not return")
+		}
+	}
+}
+
+func TestHandleWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		want    int
+		wantMsg bool
+		wantSub bool
+	}{
+		{
+			name: "verification responds with the challenge",
+			req: func() *http.Request {
+				return signedRequest("webhook_callback_verification", "v1", `{"challenge":"pogchamp","subscription":{"id":"sub"}}`, time.Now())
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "notification is passed on",
+			req:     func() *http.Request { return signedRequest("notification", "n1", onlineBody, time.Now()) },
+			want:    http.StatusOK,
+			wantMsg: true,
+		},
+		{
+			name: "bad signature is rejected",
+			req: func() *http.Request {
+				req := signedRequest("notification", "n1", onlineBody, time.Now())
+				req.Header.Set("Twitch-Eventsub-Message-Signature", "sha256=00")
+				return req
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "stale message is rejected",
+			req: func() *http.Request {
+				return signedRequest("notification", "n1", onlineBody, time.Now().Add(-time.Hour))
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "undecodable notification is acknowledged and dropped",
+			req: func() *http.Request {
+				return signedRequest("notification", "n1", `{"subscription":{"type":"stream.online"},"event":[]}`, time.Now())
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "revocation is acknowledged and passed on",
+			req: func() *http.Request {
+				return signedRequest("revocation", "r1", `{"subscription":{"id":"sub","type":"stream.online","status":"authorization_revoked"}}`, time.Now())
+			},
+			want:    http.StatusOK,
+			wantSub: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestListener(t)
+			d := deliver(t, l, tt.req())
+			if d.resp.Code != tt.want {
+				t.Errorf("handler responded %v, want %v", d.resp.Code, tt.want)
+			}
+			if (d.notification != nil) != tt.wantMsg {
+				t.Errorf("handler passed on notification %+v, want one to be passed on: %v", d.notification, tt.wantMsg)
+			}
+			if (d.revocation != nil) != tt.wantSub {
+				t.Errorf("handler passed on revocation %+v, want one to be passed on: %v", d.revocation, tt.wantSub)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookDuplicates(t *testing.T) {
+	l := newTestListener(t)
+	if d := deliver(t, l, signedRequest("notification", "n1", onlineBody, time.Now())); d.notification == nil {
+		t.Fatal("first delivery was not passed on")
+	}
+	//Redeliveries are acknowledged so that twitch stops sending them, but not passed on again
+	d := deliver(t, l, signedRequest("notification", "n1", onlineBody, time.Now()))
+	if d.resp.Code != http.StatusOK || d.notification != nil {
+		t.Errorf("redelivery responded %v and passed on %+v, want 200 and nothing", d.resp.Code, d.notification)
+	}
+}
+
+func TestHandleWebhookRevocationReasons(t *testing.T) {
+	for _, reason := range []string{"user_removed", "authorization_revoked", "notification_failures_exceeded", "version_removed"} {
+		t.Run(reason, func(t *testing.T) {
+			l := newTestListener(t)
+			body := `{"subscription":{"id":"sub","type":"channel.follow","version":"1","status":"` + reason + `"}}`
+			d := deliver(t, l, signedRequest("revocation", "r-"+reason, body, time.Now()))
+			if d.resp.Code < 200 || d.resp.Code > 299 {
+				t.Errorf("revocation responded %v, want a 2xx status", d.resp.Code)
+			}
+			if d.revocation == nil || d.revocation.ID != "sub" || d.revocation.Status != reason {
+				t.Errorf("revocation passed on %+v, want subscription sub with status %v", d.revocation, reason)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookMetadata(t *testing.T) {
+	l := newTestListener(t)
+	sentAt := time.Now().Truncate(time.Second)
+	req := signedRequest("notification", "n1", onlineBody, sentAt)
+	req.Header.Set("Twitch-Eventsub-Message-Retry", "2")
+	req.Header.Set("Twitch-Eventsub-Subscription-Type", "stream.online")
+	req.Header.Set("Twitch-Eventsub-Subscription-Version", "beta")
+	d := deliver(t, l, req)
+	if d.notification == nil {
+		t.Fatal("notification was not passed on")
+	}
+	want := messages.Metadata{MessageID: "n1", MessageTimestamp: sentAt.UTC(), MessageRetry: 2, SubscriptionVersion: "beta"}
+	if got := d.notification.Metadata; got != want {
+		t.Errorf("Metadata = %+v, want %+v", got, want)
+	}
+	if string(d.notification.Raw) != onlineBody {
+		t.Errorf("Raw = %s, want the request body", d.notification.Raw)
+	}
+}
+
+func TestRequestMetadataDefaultsVersion(t *testing.T) {
+	req := signedRequest("notification", "n1", onlineBody, time.Now())
+	if got := requestMetadata(req, "1").SubscriptionVersion; got != "1" {
+		t.Errorf("SubscriptionVersion = %q without a version header, want the default", got)
+	}
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	l := newTestListener(t)
+	//Nothing reads the notifications channel yet, so the request stays in flight
+	inFlight := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		l.Handler().ServeHTTP(inFlight, signedRequest("notification", "n1", onlineBody, time.Now()))
+		close(served)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() { shutdown <- l.Shutdown(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+
+	rejected := httptest.NewRecorder()
+	l.Handler().ServeHTTP(rejected, signedRequest("notification", "n2", onlineBody, time.Now()))
+	if rejected.Code != http.StatusServiceUnavailable {
+		t.Errorf("request after shutdown began responded %v, want %v", rejected.Code, http.StatusServiceUnavailable)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() = %v before the in-flight request was drained", err)
+	default:
+	}
+
+	if msg := <-l.NotificationsChannel(); msg.MessageID != "n1" {
+		t.Errorf("in-flight request passed on %v, want n1", msg.MessageID)
+	}
+	<-served
+	if inFlight.Code != http.StatusOK {
+		t.Errorf("in-flight request responded %v, want 200", inFlight.Code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if _, open := <-l.NotificationsChannel(); open {
+		t.Error("notifications channel is still open after Shutdown")
+	}
+	if _, open := <-l.RevocationsChannel(); open {
+		t.Error("revocations channel is still open after Shutdown")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	l := newTestListener(t)
+	inFlight := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		l.Handler().ServeHTTP(inFlight, signedRequest("notification", "n1", onlineBody, time.Now()))
+		close(served)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	<-served
+	//Without a journal the notification would be lost, so twitch is asked to redeliver it
+	if inFlight.Code != http.StatusServiceUnavailable {
+		t.Errorf("abandoned request responded %v, want %v", inFlight.Code, http.StatusServiceUnavailable)
+	}
+	if _, open := <-l.NotificationsChannel(); open {
+		t.Error("notifications channel is still open after Shutdown")
+	}
+}
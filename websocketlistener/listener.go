@@ -0,0 +1,387 @@
+package websocketlistener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/callummance/nazuna/dedup"
+	"github.com/callummance/nazuna/journal"
+	"github.com/callummance/nazuna/logging"
+	"github.com/callummance/nazuna/messages"
+	"github.com/callummance/nazuna/metrics"
+	"github.com/callummance/nazuna/tracing"
+	"github.com/gorilla/websocket"
+)
+
+//DefaultURL is the address of Twitch's EventSub WebSocket server
+const DefaultURL = "wss://eventsub.wss.twitch.tv/ws"
+
+const (
+	//messageIDExpiry is how long the IDs of processed messages are remembered for
+	messageIDExpiry     = 24 * time.Hour
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+//These are variables so that tests can shorten them
+var (
+	//welcomeTimeout is how long to wait for a session_welcome message after connecting
+	welcomeTimeout = 10 * time.Second
+	//keepaliveGrace is added to the keepalive timeout requested by twitch to allow for network latency
+	keepaliveGrace = 5 * time.Second
+)
+
+//Listener receives EventSub notifications over a WebSocket connection, following reconnect requests from Twitch and
+//opening a fresh session if the connection is lost.
+type Listener struct {
+	url                  string
+	processedMessages    dedup.Store
+	journal              journal.Journal
+	metrics              *metrics.Metrics
+	tracer               tracing.Tracer
+	log                  *logging.Entry
+	notificationsChannel chan messages.EventNotificationMessage
+	revocationsChannel   chan messages.Subscription
+	closeChannel         chan interface{}
+	connLock             sync.Mutex
+	conn                 *websocket.Conn
+	sessionID            string
+	keepalive            time.Duration
+	onNewSession         func(sessionID string)
+	closed               bool
+	readers              sync.WaitGroup
+	shutdownOnce         sync.Once
+	shutdownErr          error
+}
+
+//NewListener creates a listener which will connect to the EventSub WebSocket server at url, or DefaultURL if url is empty.
+func NewListener(url string) *Listener {
+	if url == "" {
+		url = DefaultURL
+	}
+	return &Listener{
+		url:                  url,
+		processedMessages:    dedup.NewMemoryStore(),
+		notificationsChannel: make(chan messages.EventNotificationMessage),
+		revocationsChannel:   make(chan messages.Subscription),
+		closeChannel:         make(chan interface{}),
+		tracer:               tracing.NoopTracer{},
+	}
+}
+
+//SetDedupStore replaces the store used to detect redelivered messages, which is in-memory by default.
+//It should be called before Connect.
+func (l *Listener) SetDedupStore(store dedup.Store) {
+	l.processedMessages = store
+}
+
+//SetJournal makes the listener persist each notification to j before passing it on. It should be called before Connect.
+func (l *Listener) SetJournal(j journal.Journal) {
+	l.journal = j
+}
+
+//SetMetrics makes the listener record the messages it recieves in m. It should be called before Connect.
+func (l *Listener) SetMetrics(m *metrics.Metrics) {
+	l.metrics = m
+}
+
+//SetTracer makes the listener start a span for each message it recieves. It should be called before Connect.
+func (l *Listener) SetTracer(tracer tracing.Tracer) {
+	l.tracer = tracer
+}
+
+//SetLogger replaces the logger used by the listener, which is logging.Default() unless set. It should be called before Connect.
+func (l *Listener) SetLogger(log *logging.Entry) {
+	l.log = log
+}
+
+//Connect opens a connection to the EventSub WebSocket server and waits for the welcome message, returning the ID of the
+//new session. Subscriptions must be created using this session ID within a few seconds or twitch will close the connection.
+func (l *Listener) Connect() (string, error) {
+	l.log.Infof("Connecting to EventSub WebSocket server at %v.", l.url)
+	conn, session, err := l.dial(l.url)
+	if err != nil {
+		l.log.Errorf("Failed to connect to EventSub WebSocket server due to error %v", err)
+		return "", err
+	}
+	if !l.replaceConn(conn, session) {
+		return "", fmt.Errorf("listener was shut down whilst connecting")
+	}
+	return session.ID, nil
+}
+
+//OnNewSession sets a function to be called whenever the connection is lost and a new session has to be created.
+//Subscriptions belonging to the previous session are deleted by twitch, so they must be recreated using the new session ID.
+//Reconnects requested by twitch keep the same session and so do not trigger this function.
+func (l *Listener) OnNewSession(f func(sessionID string)) {
+	l.connLock.Lock()
+	defer l.connLock.Unlock()
+	l.onNewSession = f
+}
+
+//SessionID returns the ID of the current WebSocket session
+func (l *Listener) SessionID() string {
+	l.connLock.Lock()
+	defer l.connLock.Unlock()
+	return l.sessionID
+}
+
+//NotificationsChannel returns the channel upon which messages are returned.
+func (l *Listener) NotificationsChannel() chan messages.EventNotificationMessage {
+	return l.notificationsChannel
+}
+
+//RevocationsChannel returns the channel upon which revoked subscriptions are returned.
+func (l *Listener) RevocationsChannel() chan messages.Subscription {
+	return l.revocationsChannel
+}
+
+//Shutdown closes the WebSocket connection, waits for any notification which has already been read to be handed over and
+//then closes the notifications channel. If ctx expires first, the pending notification is dropped and the context's error returned.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.shutdownOnce.Do(func() {
+		l.log.Info("Shutting down websocket listener")
+		l.connLock.Lock()
+		l.closed = true
+		if l.conn != nil {
+			closeConn(l.conn)
+		}
+		l.connLock.Unlock()
+
+		drained := make(chan struct{})
+		go func() {
+			l.readers.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			close(l.closeChannel)
+		case <-ctx.Done():
+			l.log.Warnf("Deadline reached whilst waiting for websocket reader to stop; abandoning pending notification")
+			close(l.closeChannel)
+			<-drained
+			l.shutdownErr = ctx.Err()
+		}
+		close(l.notificationsChannel)
+		close(l.revocationsChannel)
+	})
+	return l.shutdownErr
+}
+
+//dial connects to an EventSub WebSocket server and reads the session_welcome message
+func (l *Listener) dial(url string) (*websocket.Conn, *messages.WebsocketSession, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(welcomeTimeout))
+	var message messages.WebsocketMessage
+	err = conn.ReadJSON(&message)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to read welcome message: %v", err)
+	}
+	if message.Metadata.MessageType != messages.WebsocketMessageSessionWelcome {
+		conn.Close()
+		return nil, nil, fmt.Errorf("expected %v message but got %v", messages.WebsocketMessageSessionWelcome, message.Metadata.MessageType)
+	}
+	var payload messages.WebsocketSessionPayload
+	err = json.Unmarshal(message.Payload, &payload)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to unmarshal welcome message: %v", err)
+	}
+	l.log.Debugf("Got welcome message for websocket session %v", payload.Session.ID)
+	return conn, &payload.Session, nil
+}
+
+func closeConn(conn *websocket.Conn) {
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	conn.Close()
+}
+
+//replaceConn makes conn the active connection and starts reading from it, closing any previous connection.
+//Returns false if the listener has been shut down, in which case conn is closed instead.
+func (l *Listener) replaceConn(conn *websocket.Conn, session *messages.WebsocketSession) bool {
+	l.connLock.Lock()
+	defer l.connLock.Unlock()
+	if l.closed {
+		closeConn(conn)
+		return false
+	}
+	previous := l.conn
+	l.conn = conn
+	l.sessionID = session.ID
+	l.keepalive = time.Duration(session.KeepaliveTimeoutSeconds)*time.Second + keepaliveGrace
+	l.readers.Add(1)
+	go l.read(conn)
+	if previous != nil {
+		closeConn(previous)
+	}
+	return true
+}
+
+//isCurrent checks whether conn is still the active connection
+func (l *Listener) isCurrent(conn *websocket.Conn) bool {
+	l.connLock.Lock()
+	defer l.connLock.Unlock()
+	return !l.closed && l.conn == conn
+}
+
+func (l *Listener) read(conn *websocket.Conn) {
+	defer l.readers.Done()
+	for {
+		l.connLock.Lock()
+		keepalive := l.keepalive
+		l.connLock.Unlock()
+		conn.SetReadDeadline(time.Now().Add(keepalive))
+
+		var message messages.WebsocketMessage
+		err := conn.ReadJSON(&message)
+		if err != nil {
+			if !l.isCurrent(conn) {
+				//Connection was closed deliberately, either due to shutdown or because it was replaced
+				return
+			}
+			l.log.Warnf("Lost connection to EventSub WebSocket server due to error %v; starting a new session", err)
+			conn.Close()
+			go l.reconnect()
+			return
+		}
+		l.log.Tracef("Recieved websocket message %v", message.Metadata)
+		l.handleMessage(&message)
+	}
+}
+
+func (l *Listener) handleMessage(message *messages.WebsocketMessage) {
+	switch message.Metadata.MessageType {
+	case messages.WebsocketMessageSessionKeepalive:
+		//Nothing to do; receiving the message has already reset the read deadline
+	case messages.WebsocketMessageSessionReconnect:
+		var payload messages.WebsocketSessionPayload
+		err := json.Unmarshal(message.Payload, &payload)
+		if err != nil {
+			l.log.Warnf("Failed to unmarshal websocket reconnect message due to error %v", err)
+			return
+		}
+		l.log.Infof("Twitch requested that websocket session %v reconnect to %v", payload.Session.ID, payload.Session.ReconnectURL)
+		//The old connection must keep being read until the new one has been welcomed
+		go l.migrate(payload.Session.ReconnectURL)
+	case messages.WebsocketMessageNotification:
+		msgID := message.Metadata.MessageID
+		_, span := l.tracer.Start(context.Background(), "eventsub.websocket.notification",
+			tracing.String("eventsub.message_id", msgID),
+			tracing.String("eventsub.subscription_type", message.Metadata.SubscriptionType),
+		)
+		defer span.End()
+		//Claim the message before passing it on, so that of several concurrent deliveries only one is dispatched
+		first, err := l.processedMessages.MarkIfAbsent(msgID, messageIDExpiry)
+		if err != nil {
+			//Prefer processing a message twice over dropping it
+			l.log.Warnf("Failed to mark message %v as processed due to error %v", msgID, err)
+			first = true
+		}
+		if !first {
+			l.log.Infof("Discarded message %v because it was recieved before.", msgID)
+			l.metrics.ObserveRejection(metrics.RejectionDuplicate)
+			return
+		}
+		notification, err := messages.DecodeNotification(message.Payload, message.Metadata.SubscriptionType)
+		if err != nil {
+			l.log.Warnf("Discarding message %v as it could not be decoded due to error %v", msgID, err)
+			l.metrics.ObserveDecodeFailure(messages.TransportWebsocket, message.Metadata.SubscriptionType)
+			span.RecordError(err)
+			return
+		}
+		notification.MessageID = msgID
+		notification.MessageTimestamp = message.Metadata.MessageTimestamp
+		if message.Metadata.SubscriptionVersion != "" {
+			notification.SubscriptionVersion = message.Metadata.SubscriptionVersion
+		}
+		notification.SpanContext = span.SpanContext()
+		log := l.log.WithFields(logging.MessageFields(notification))
+		if l.journal != nil {
+			err = l.journal.Append(*notification)
+			if err != nil {
+				//Unmark the message so that it is not discarded as a duplicate if twitch redelivers it
+				log.Errorf("Failed to journal notification %v due to error %v; dropping it", msgID, err)
+				span.RecordError(err)
+				l.unmark(msgID)
+				return
+			}
+		}
+		select {
+		case l.notificationsChannel <- *notification:
+		case <-l.closeChannel:
+			log.Warnf("Dropping notification %v as the listener is shutting down", msgID)
+			l.unmark(msgID)
+		}
+	case messages.WebsocketMessageRevocation:
+		var payload messages.RevocationMessage
+		err := json.Unmarshal(message.Payload, &payload)
+		if err != nil {
+			l.log.Warnf("Failed to unmarshal websocket revocation message due to error %v", err)
+			return
+		}
+		l.log.Warnf("Twitch revoked subscription %v with status %v", payload.Subscription.ID, payload.Subscription.Status)
+		select {
+		case l.revocationsChannel <- payload.Subscription:
+		case <-l.closeChannel:
+			l.log.Warnf("Dropping revocation of subscription %v as the listener is shutting down", payload.Subscription.ID)
+		}
+	default:
+		l.log.Warnf("Recieved websocket message with unknown message type %v from twitch", message.Metadata.MessageType)
+	}
+}
+
+//unmark forgets a claimed notification which could not be passed on, so that a redelivery of it is accepted
+func (l *Listener) unmark(msgID string) {
+	err := l.processedMessages.Unmark(msgID)
+	if err != nil {
+		l.log.Warnf("Failed to unmark message %v due to error %v", msgID, err)
+	}
+}
+
+//migrate moves to the connection at reconnectURL, keeping the existing session
+func (l *Listener) migrate(reconnectURL string) {
+	conn, session, err := l.dial(reconnectURL)
+	if err != nil {
+		l.log.Warnf("Failed to reconnect to %v due to error %v; starting a new session", reconnectURL, err)
+		l.reconnect()
+		return
+	}
+	l.replaceConn(conn, session)
+}
+
+//reconnect connects to the base URL with exponential backoff, creating an entirely new session
+func (l *Listener) reconnect() {
+	backoff := minReconnectBackoff
+	for {
+		conn, session, err := l.dial(l.url)
+		if err == nil {
+			if l.replaceConn(conn, session) {
+				l.connLock.Lock()
+				onNewSession := l.onNewSession
+				l.connLock.Unlock()
+				if onNewSession != nil {
+					onNewSession(session.ID)
+				}
+			}
+			return
+		}
+		l.log.Warnf("Failed to connect to EventSub WebSocket server due to error %v; retrying in %v", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-l.closeChannel:
+			return
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
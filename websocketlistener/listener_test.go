@@ -0,0 +1,332 @@
+package websocketlistener
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/callummance/nazuna/messages"
+	"github.com/gorilla/websocket"
+)
+
+const onlinePayload = `{"subscription":{"id":"sub","type":"stream.online","version":"1","status":"enabled"},"event":{"broadcaster_user_id":"1234","type":"live"}}`
+
+//standIn is a stand-in for the EventSub WebSocket server, which hands each connection made to it over to the test
+type standIn struct {
+	*httptest.Server
+	conns chan *websocket.Conn
+}
+
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{conns: make(chan *websocket.Conn, 4)}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade connection: %v", err)
+			return
+		}
+		s.conns <- conn
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+//url returns the websocket address of the server
+func (s *standIn) url() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+//accept waits for the listener to connect
+func (s *standIn) accept(t *testing.T) *websocket.Conn {
+	t.Helper()
+	select {
+	case conn := <-s.conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener did not connect")
+		return nil
+	}
+}
+
+//expectNoConnection checks that the listener does not connect again within d
+func (s *standIn) expectNoConnection(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case <-s.conns:
+		t.Fatal("listener connected again, want it to keep its connection")
+	case <-time.After(d):
+	}
+}
+
+//send writes a message with the given metadata and payload, as twitch would
+func send(t *testing.T, conn *websocket.Conn, metadata messages.WebsocketMetadata, payload string) {
+	t.Helper()
+	if metadata.MessageTimestamp.IsZero() {
+		metadata.MessageTimestamp = time.Now()
+	}
+	err := conn.WriteJSON(messages.WebsocketMessage{Metadata: metadata, Payload: json.RawMessage(payload)})
+	if err != nil {
+		t.Fatalf("failed to send %v message: %v", metadata.MessageType, err)
+	}
+}
+
+//sendSession sends a session_welcome or session_reconnect message
+func sendSession(t *testing.T, conn *websocket.Conn, msgType string, session messages.WebsocketSession) {
+	t.Helper()
+	payload, _ := json.Marshal(messages.WebsocketSessionPayload{Session: session})
+	send(t, conn, messages.WebsocketMetadata{MessageID: msgType + "-" + session.ID, MessageType: msgType}, string(payload))
+}
+
+func sendNotification(t *testing.T, conn *websocket.Conn, msgID string) {
+	t.Helper()
+	send(t, conn, messages.WebsocketMetadata{
+		MessageID:           msgID,
+		MessageType:         messages.WebsocketMessageNotification,
+		SubscriptionType:    messages.SubscriptionStreamOnline,
+		SubscriptionVersion: "1",
+	}, onlinePayload)
+}
+
+//connect creates a listener and connects it to s, which welcomes it to a session with the given ID
+func connect(t *testing.T, s *standIn, sessionID string, keepaliveSeconds int) (*Listener, *websocket.Conn) {
+	t.Helper()
+	l := NewListener(s.url())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		l.Shutdown(ctx)
+	})
+	type result struct {
+		sessionID string
+		err       error
+	}
+	connected := make(chan result)
+	go func() {
+		id, err := l.Connect()
+		connected <- result{id, err}
+	}()
+	conn := s.accept(t)
+	sendSession(t, conn, messages.WebsocketMessageSessionWelcome, messages.WebsocketSession{ID: sessionID, KeepaliveTimeoutSeconds: keepaliveSeconds})
+	if r := <-connected; r.err != nil || r.sessionID != sessionID {
+		t.Fatalf("Connect() = %v, %v, want session %v", r.sessionID, r.err, sessionID)
+	}
+	return l, conn
+}
+
+func receiveNotification(t *testing.T, l *Listener) messages.EventNotificationMessage {
+	t.Helper()
+	select {
+	case msg := <-l.NotificationsChannel():
+		return msg
+	case sub := <-l.RevocationsChannel():
+		t.Fatalf("got revocation of %v, want a notification", sub.ID)
+	case <-time.After(time.Second):
+		t.Fatal("no notification was passed on")
+	}
+	return messages.EventNotificationMessage{}
+}
+
+//shortenTimeouts makes the listener give up on a welcome after 100ms, and on a session with a one second keepalive
+//timeout after 200ms without a message, for the rest of the test
+func shortenTimeouts(t *testing.T) {
+	welcome, grace := welcomeTimeout, keepaliveGrace
+	welcomeTimeout = 100 * time.Millisecond
+	keepaliveGrace = -800 * time.Millisecond
+	t.Cleanup(func() {
+		welcomeTimeout, keepaliveGrace = welcome, grace
+	})
+}
+
+func TestConnectRequiresWelcome(t *testing.T) {
+	tests := []struct {
+		name string
+		//first is the message the server sends first, if any
+		first *messages.WebsocketMetadata
+	}{
+		{name: "no welcome before the timeout"},
+		{name: "another message first", first: &messages.WebsocketMetadata{MessageID: "k1", MessageType: messages.WebsocketMessageSessionKeepalive}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shortenTimeouts(t)
+			s := newStandIn(t)
+			l := NewListener(s.url())
+			failed := make(chan error)
+			go func() {
+				_, err := l.Connect()
+				failed <- err
+			}()
+			conn := s.accept(t)
+			if tt.first != nil {
+				send(t, conn, *tt.first, `{}`)
+			}
+			select {
+			case err := <-failed:
+				if err == nil {
+					t.Error("Connect() error = nil, want the connection to be rejected")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Connect() did not give up")
+			}
+		})
+	}
+}
+
+func TestMessageTypes(t *testing.T) {
+	s := newStandIn(t)
+	l, conn := connect(t, s, "s1", 10)
+
+	//Keepalives and unknown or undecodable messages are not passed on, so the first notification out is n1
+	send(t, conn, messages.WebsocketMetadata{MessageID: "k1", MessageType: messages.WebsocketMessageSessionKeepalive}, `{}`)
+	send(t, conn, messages.WebsocketMetadata{MessageID: "u1", MessageType: "session_unknown"}, `{}`)
+	send(t, conn, messages.WebsocketMetadata{
+		MessageID:        "bad",
+		MessageType:      messages.WebsocketMessageNotification,
+		SubscriptionType: messages.SubscriptionStreamOnline,
+	}, `{"subscription":{"type":"stream.online"},"event":[]}`)
+	sentAt := time.Now().UTC().Truncate(time.Millisecond)
+	send(t, conn, messages.WebsocketMetadata{
+		MessageID:           "n1",
+		MessageType:         messages.WebsocketMessageNotification,
+		MessageTimestamp:    sentAt,
+		SubscriptionType:    messages.SubscriptionStreamOnline,
+		SubscriptionVersion: "beta",
+	}, onlinePayload)
+	msg := receiveNotification(t, l)
+	if msg.MessageID != "n1" || !msg.MessageTimestamp.Equal(sentAt) || msg.SubscriptionVersion != "beta" {
+		t.Errorf("notification metadata = %+v, want n1 sent at %v with version beta", msg.Metadata, sentAt)
+	}
+	if event, ok := msg.Event.(*messages.StreamOnlineEvent); !ok || event.BroadcasterUID != "1234" {
+		t.Errorf("notification event = %#v, want the stream.online event", msg.Event)
+	}
+
+	//Redeliveries are discarded
+	sendNotification(t, conn, "n1")
+	send(t, conn, messages.WebsocketMetadata{MessageID: "r1", MessageType: messages.WebsocketMessageRevocation},
+		`{"subscription":{"id":"sub","type":"stream.online","version":"1","status":"authorization_revoked"}}`)
+	select {
+	case sub := <-l.RevocationsChannel():
+		if sub.ID != "sub" || sub.Status != "authorization_revoked" {
+			t.Errorf("revocation = %+v, want subscription sub with status authorization_revoked", sub)
+		}
+	case msg := <-l.NotificationsChannel():
+		t.Fatalf("redelivered notification %v was passed on", msg.MessageID)
+	case <-time.After(time.Second):
+		t.Fatal("revocation was not passed on")
+	}
+	sendNotification(t, conn, "n2")
+	if msg := receiveNotification(t, l); msg.MessageID != "n2" {
+		t.Errorf("notification = %v, want n2", msg.MessageID)
+	}
+}
+
+func TestSessionReconnect(t *testing.T) {
+	s := newStandIn(t)
+	l, old := connect(t, s, "s1", 10)
+	newSessions := make(chan string, 1)
+	l.OnNewSession(func(sessionID string) { newSessions <- sessionID })
+
+	sendSession(t, old, messages.WebsocketMessageSessionReconnect, messages.WebsocketSession{ID: "s1", Status: "reconnecting", ReconnectURL: s.url()})
+	migrated := s.accept(t)
+	//Notifications on the old connection are still handled until the new one is welcomed
+	sendNotification(t, old, "n1")
+	if msg := receiveNotification(t, l); msg.MessageID != "n1" {
+		t.Errorf("notification = %v, want n1", msg.MessageID)
+	}
+	sendSession(t, migrated, messages.WebsocketMessageSessionWelcome, messages.WebsocketSession{ID: "s1", KeepaliveTimeoutSeconds: 10})
+
+	old.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := old.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("old connection read error = %v, want it to be closed normally", err)
+	}
+	sendNotification(t, migrated, "n2")
+	if msg := receiveNotification(t, l); msg.MessageID != "n2" {
+		t.Errorf("notification = %v, want n2", msg.MessageID)
+	}
+	if id := l.SessionID(); id != "s1" {
+		t.Errorf("SessionID() = %v, want the session to be kept", id)
+	}
+	select {
+	case id := <-newSessions:
+		t.Errorf("OnNewSession was called with %v, want the session to be kept", id)
+	default:
+	}
+}
+
+func TestNewSessionAfterConnectionLost(t *testing.T) {
+	s := newStandIn(t)
+	l, conn := connect(t, s, "s1", 10)
+	newSessions := make(chan string, 1)
+	l.OnNewSession(func(sessionID string) { newSessions <- sessionID })
+
+	conn.Close()
+	replacement := s.accept(t)
+	sendSession(t, replacement, messages.WebsocketMessageSessionWelcome, messages.WebsocketSession{ID: "s2", KeepaliveTimeoutSeconds: 10})
+	select {
+	case id := <-newSessions:
+		if id != "s2" {
+			t.Errorf("OnNewSession was called with %v, want s2", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnNewSession was not called for the new session")
+	}
+	if id := l.SessionID(); id != "s2" {
+		t.Errorf("SessionID() = %v, want s2", id)
+	}
+	sendNotification(t, replacement, "n1")
+	if msg := receiveNotification(t, l); msg.MessageID != "n1" {
+		t.Errorf("notification = %v, want n1", msg.MessageID)
+	}
+}
+
+func TestKeepaliveDeadline(t *testing.T) {
+	shortenTimeouts(t)
+	s := newStandIn(t)
+	l, conn := connect(t, s, "s1", 1)
+	newSessions := make(chan string, 1)
+	l.OnNewSession(func(sessionID string) { newSessions <- sessionID })
+
+	//Each message resets the deadline
+	for i := 0; i < 6; i++ {
+		time.Sleep(50 * time.Millisecond)
+		send(t, conn, messages.WebsocketMetadata{MessageID: "k", MessageType: messages.WebsocketMessageSessionKeepalive}, `{}`)
+	}
+	s.expectNoConnection(t, 100*time.Millisecond)
+
+	//Once twitch falls silent for longer than the deadline, the listener starts a new session
+	replacement := s.accept(t)
+	sendSession(t, replacement, messages.WebsocketMessageSessionWelcome, messages.WebsocketSession{ID: "s2", KeepaliveTimeoutSeconds: 10})
+	select {
+	case id := <-newSessions:
+		if id != "s2" {
+			t.Errorf("OnNewSession was called with %v, want s2", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnNewSession was not called after the keepalive deadline passed")
+	}
+}
+
+func TestShutdownClosesConnection(t *testing.T) {
+	s := newStandIn(t)
+	l, conn := connect(t, s, "s1", 10)
+	if err := l.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("connection read error = %v, want it to be closed normally", err)
+	}
+	if _, open := <-l.NotificationsChannel(); open {
+		t.Error("notifications channel is still open after Shutdown")
+	}
+	if _, open := <-l.RevocationsChannel(); open {
+		t.Error("revocations channel is still open after Shutdown")
+	}
+	s.expectNoConnection(t, 50*time.Millisecond)
+}